@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/apache/arrow/go/v12/arrow"
+)
+
+// severity of a difference between two schema versions.
+type severity int
+
+const (
+	// compatible changes do not affect readers or writers of the old schema
+	compatible severity = iota
+	// additive changes extend the schema, consumers of the old version keep
+	// working
+	additive
+	// breaking changes make data of one version unreadable with the other
+	breaking
+)
+
+func (s severity) String() string {
+	switch s {
+	case additive:
+		return "additive"
+	case breaking:
+		return "breaking"
+	}
+	return "compatible"
+}
+
+type change struct {
+	severity severity
+	field    string
+	msg      string
+}
+
+func runDiff(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errors.New("usage: arrow-schema diff old.json new.json")
+	}
+
+	old, err := loadSchema(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	cur, err := loadSchema(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	changes := diffSchemas(old, cur)
+	worst := compatible
+	for _, c := range changes {
+		if c.severity > worst {
+			worst = c.severity
+		}
+		if c.field != "" {
+			fmt.Fprintf(out, "%-10s field %q: %s\n", c.severity, c.field, c.msg)
+		} else {
+			fmt.Fprintf(out, "%-10s %s\n", c.severity, c.msg)
+		}
+	}
+	if len(changes) == 0 {
+		fmt.Fprintln(out, "schemas are identical")
+	}
+	fmt.Fprintf(out, "result: %s\n", worst)
+	if worst == breaking {
+		return &exitError{code: 1}
+	}
+	return nil
+}
+
+// diffSchemas lists the changes from old to cur, fields are matched by name.
+func diffSchemas(old, cur *arrow.Schema) []change {
+	var changes []change
+	for i, of := range old.Fields() {
+		idx := cur.FieldIndices(of.Name)
+		if len(idx) == 0 {
+			changes = append(changes, change{breaking, of.Name, "removed"})
+			continue
+		}
+		nf := cur.Field(idx[0])
+		if !arrow.TypeEqual(of.Type, nf.Type) {
+			changes = append(changes, change{breaking, of.Name, fmt.Sprintf("type changed from %s to %s", of.Type, nf.Type)})
+		}
+		switch {
+		case of.Nullable && !nf.Nullable:
+			changes = append(changes, change{breaking, of.Name, "no longer nullable"})
+		case !of.Nullable && nf.Nullable:
+			changes = append(changes, change{additive, of.Name, "became nullable"})
+		}
+		if i != idx[0] {
+			changes = append(changes, change{compatible, of.Name, fmt.Sprintf("moved from position %d to %d", i, idx[0])})
+		}
+		if !of.Metadata.Equal(nf.Metadata) {
+			changes = append(changes, change{compatible, of.Name, "field metadata changed"})
+		}
+	}
+	for _, nf := range cur.Fields() {
+		if old.HasField(nf.Name) {
+			continue
+		}
+		if nf.Nullable {
+			changes = append(changes, change{additive, nf.Name, fmt.Sprintf("added as nullable %s", nf.Type)})
+		} else {
+			changes = append(changes, change{breaking, nf.Name, fmt.Sprintf("added as non-nullable %s, existing data has no values for it", nf.Type)})
+		}
+	}
+	if !old.Metadata().Equal(cur.Metadata()) {
+		changes = append(changes, change{compatible, "", "schema metadata changed"})
+	}
+	return changes
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/apache/arrow/go/v12/arrow"
+)
+
+var diffBase = arrow.NewSchema([]arrow.Field{
+	{Name: "ID", Type: arrow.PrimitiveTypes.Int64},
+	{Name: "NAME", Type: arrow.BinaryTypes.String, Nullable: true},
+}, nil)
+
+func TestDiffSchemas(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		fields []arrow.Field
+		want   []change
+	}{
+		{"identical", diffBase.Fields(), nil},
+		{"added nullable", append(diffBase.Fields(), arrow.Field{Name: "VAL", Type: arrow.PrimitiveTypes.Float64, Nullable: true}),
+			[]change{{additive, "VAL", "added as nullable float64"}}},
+		{"added required", append(diffBase.Fields(), arrow.Field{Name: "VAL", Type: arrow.PrimitiveTypes.Float64}),
+			[]change{{breaking, "VAL", "added as non-nullable float64, existing data has no values for it"}}},
+		{"removed", diffBase.Fields()[:1],
+			[]change{{breaking, "NAME", "removed"}}},
+		{"type changed", []arrow.Field{{Name: "ID", Type: arrow.BinaryTypes.String}, diffBase.Field(1)},
+			[]change{{breaking, "ID", "type changed from int64 to utf8"}}},
+		{"became nullable", []arrow.Field{{Name: "ID", Type: arrow.PrimitiveTypes.Int64, Nullable: true}, diffBase.Field(1)},
+			[]change{{additive, "ID", "became nullable"}}},
+		{"no longer nullable", []arrow.Field{diffBase.Field(0), {Name: "NAME", Type: arrow.BinaryTypes.String}},
+			[]change{{breaking, "NAME", "no longer nullable"}}},
+		{"moved", []arrow.Field{diffBase.Field(1), diffBase.Field(0)},
+			[]change{{compatible, "ID", "moved from position 0 to 1"}, {compatible, "NAME", "moved from position 1 to 0"}}},
+	} {
+		got := diffSchemas(diffBase, arrow.NewSchema(tc.fields, nil))
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: changes %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRunDiff(t *testing.T) {
+	write := func(s *arrow.Schema) string {
+		var buf bytes.Buffer
+		if err := writeSchema(&buf, s); err != nil {
+			t.Fatal(err)
+		}
+		return writeTestFile(t, "schema.json", buf.String())
+	}
+	old := write(diffBase)
+
+	for _, tc := range []struct {
+		fields   []arrow.Field
+		want     string
+		breaking bool
+	}{
+		{diffBase.Fields(), "schemas are identical\nresult: compatible\n", false},
+		{append(diffBase.Fields(), arrow.Field{Name: "VAL", Type: arrow.PrimitiveTypes.Float64, Nullable: true}),
+			"additive   field \"VAL\": added as nullable float64\nresult: additive\n", false},
+		{diffBase.Fields()[:1],
+			"breaking   field \"NAME\": removed\nresult: breaking\n", true},
+	} {
+		var out bytes.Buffer
+		err := runDiff([]string{old, write(arrow.NewSchema(tc.fields, nil))}, &out)
+		if got := out.String(); got != tc.want {
+			t.Errorf("printed %q, want %q", got, tc.want)
+		}
+		var exit *exitError
+		if tc.breaking != errors.As(err, &exit) || (err != nil && exit == nil) {
+			t.Errorf("%q returned %v", tc.want, err)
+		}
+	}
+}
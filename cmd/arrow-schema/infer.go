@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/itchyny/timefmt-go"
+)
+
+// timeFormats are the strptime formats tried on string columns to detect
+// timestamps, in order of preference.
+var timeFormats = []string{
+	"%Y-%m-%dT%H:%M:%S%z",
+	"%Y-%m-%dT%H:%M:%S.%f%z",
+	"%Y-%m-%dT%H:%M:%S",
+	"%Y-%m-%d %H:%M:%S",
+	"%Y-%m-%d %H:%M:%S.%f",
+	"%d/%b/%Y:%H:%M:%S %z",
+}
+
+// maxTimeSamples bounds how many values of a column are kept to detect
+// timestamps.
+const maxTimeSamples = 100
+
+// kind is the inferred value kind of a column, a column holding values of
+// different kinds is widened to the larger one.
+type kind int
+
+const (
+	kindNull kind = iota
+	kindBool
+	kindInt
+	kindFloat
+	kindString
+	kindOther
+)
+
+type column struct {
+	name       string
+	kind       kind
+	samples    []string
+	timeFormat string
+	// values counts the records with a value that is not null
+	values int
+}
+
+func (c *column) add(k kind, raw string) {
+	if k != kindNull {
+		c.values++
+	}
+	switch {
+	case k == kindNull:
+	case c.kind == kindNull:
+		c.kind = k
+	case c.kind == k:
+	case (c.kind == kindInt && k == kindFloat) || (c.kind == kindFloat && k == kindInt):
+		c.kind = kindFloat
+	case c.kind == kindOther || k == kindOther:
+		c.kind = kindOther
+	default:
+		c.kind = kindString
+	}
+	if k == kindString && len(c.samples) < maxTimeSamples {
+		c.samples = append(c.samples, raw)
+	}
+}
+
+// inference collects the columns seen in sample records in order of first
+// appearance.
+type inference struct {
+	columns []*column
+	index   map[string]*column
+	records int
+}
+
+func (in *inference) column(name string) *column {
+	if c, ok := in.index[name]; ok {
+		return c
+	}
+	c := &column{name: name}
+	in.index[name] = c
+	in.columns = append(in.columns, c)
+	return c
+}
+
+func runInfer(args []string, out io.Writer, diag io.Writer) error {
+	fs := flag.NewFlagSet("infer", flag.ExitOnError)
+	parsersFile := fs.String("parsers", "", "Fluent Bit parsers file defining -parser")
+	parserName := fs.String("parser", "", "name of the parser applied to every line, lines are read as NDJSON without it")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: arrow-schema infer [-parsers parsers.conf -parser name] sample")
+	}
+
+	var p *parserDef
+	if *parserName != "" {
+		if *parsersFile == "" {
+			return errors.New("-parser requires -parsers")
+		}
+		var err error
+		if p, err = readParser(*parsersFile, *parserName); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	in := &inference{index: make(map[string]*column)}
+	var skipped int
+	switch {
+	case p == nil || p.Format == "json":
+		skipped, err = inferJSON(f, in)
+	case p.Format == "regex":
+		skipped, err = inferRegex(f, p, in)
+	default:
+		return fmt.Errorf("parser format %q is not supported, use regex or json", p.Format)
+	}
+	if err != nil {
+		return err
+	}
+	if skipped > 0 {
+		fmt.Fprintf(diag, "skipped %d line(s) that could not be parsed\n", skipped)
+	}
+	if len(in.columns) == 0 {
+		return errors.New("no fields found in the sample")
+	}
+
+	s, timeFields, notes := in.schema(p)
+	for _, n := range notes {
+		fmt.Fprintln(diag, n)
+	}
+	if len(timeFields) > 0 {
+		fmt.Fprintf(diag, "suggested output configuration:\n    Time_Fields %s,\n", strings.Join(timeFields, ","))
+	}
+	return writeSchema(out, s)
+}
+
+// inferJSON reads one JSON object per line.
+func inferJSON(r io.Reader, in *inference) (int, error) {
+	skipped := 0
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if err := inferObject(line, in); err != nil {
+			skipped++
+			continue
+		}
+		in.records++
+	}
+	return skipped, sc.Err()
+}
+
+// inferObject adds the members of a JSON object keeping their order.
+func inferObject(data []byte, in *inference) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return errors.New("not a JSON object")
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := t.(string)
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			return err
+		}
+		c := in.column(key)
+		switch v := v.(type) {
+		case nil:
+			c.add(kindNull, "")
+		case bool:
+			c.add(kindBool, "")
+		case json.Number:
+			if _, err := v.Int64(); err == nil {
+				c.add(kindInt, "")
+			} else {
+				c.add(kindFloat, "")
+			}
+		case string:
+			c.add(kindString, v)
+		default:
+			c.add(kindOther, "")
+		}
+	}
+	return nil
+}
+
+// inferRegex applies the parser's regular expression to every line, values
+// are typed according to the parser's Types like Fluent Bit does.
+func inferRegex(r io.Reader, p *parserDef, in *inference) (int, error) {
+	re, err := compileRegex(p.Regex)
+	if err != nil {
+		return 0, fmt.Errorf("parser %s: %w", p.Name, err)
+	}
+	for _, name := range re.SubexpNames() {
+		if name != "" {
+			in.column(name)
+		}
+	}
+
+	skipped := 0
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		loc := re.FindStringSubmatchIndex(line)
+		if loc == nil {
+			skipped++
+			continue
+		}
+		in.records++
+		for i, name := range re.SubexpNames() {
+			if name == "" {
+				continue
+			}
+			c := in.column(name)
+			// an optional group that did not match leaves the key out
+			if loc[2*i] < 0 {
+				c.add(kindNull, "")
+				continue
+			}
+			m := line[loc[2*i]:loc[2*i+1]]
+			switch p.Types[name] {
+			case "integer", "hex":
+				base := 10
+				if p.Types[name] == "hex" {
+					base = 16
+				}
+				if _, err := strconv.ParseInt(m, base, 64); err == nil {
+					c.add(kindInt, "")
+				} else {
+					c.add(kindString, m)
+				}
+			case "float":
+				if _, err := strconv.ParseFloat(m, 64); err == nil {
+					c.add(kindFloat, "")
+				} else {
+					c.add(kindString, m)
+				}
+			case "bool":
+				c.add(kindBool, "")
+			default:
+				c.add(kindString, m)
+			}
+		}
+	}
+	return skipped, sc.Err()
+}
+
+// schema turns the inferred columns into an Arrow schema. String columns
+// whose samples all parse with one of timeFormats become timestamps, their
+// Time_Fields entries are returned along with notes on columns the plugin
+// cannot fill. Columns with a value in every record are not nullable.
+func (in *inference) schema(p *parserDef) (*arrow.Schema, []string, []string) {
+	var timeFields, notes []string
+	fields := make([]arrow.Field, 0, len(in.columns))
+	for _, c := range in.columns {
+		var dt arrow.DataType
+		switch c.kind {
+		case kindBool:
+			dt = arrow.FixedWidthTypes.Boolean
+		case kindInt:
+			dt = arrow.PrimitiveTypes.Int64
+		case kindFloat:
+			dt = arrow.PrimitiveTypes.Float64
+		case kindString:
+			dt = arrow.BinaryTypes.String
+			if format := c.detectTime(p); format != "" {
+				dt = &arrow.TimestampType{Unit: arrow.Millisecond, TimeZone: "UTC"}
+				timeFields = append(timeFields, c.name+"="+format)
+			}
+		case kindNull:
+			dt = arrow.BinaryTypes.String
+			notes = append(notes, fmt.Sprintf("field %q: only null values seen, assuming utf8", c.name))
+		default:
+			dt = arrow.BinaryTypes.String
+			notes = append(notes, fmt.Sprintf("field %q: nested values are not supported by the plugin, assuming utf8", c.name))
+		}
+		fields = append(fields, arrow.Field{Name: c.name, Type: dt, Nullable: c.values < in.records})
+	}
+	sort.Strings(timeFields)
+	return arrow.NewSchema(fields, nil), timeFields, notes
+}
+
+// detectTime returns the strptime format all samples of c parse with, the
+// parser's Time_Format is tried first for its Time_Key.
+func (c *column) detectTime(p *parserDef) string {
+	if len(c.samples) == 0 {
+		return ""
+	}
+	formats := timeFormats
+	if p != nil && p.TimeKey == c.name && p.TimeFormat != "" {
+		formats = append([]string{p.TimeFormat}, timeFormats...)
+	}
+	for _, format := range formats {
+		ok := true
+		for _, v := range c.samples {
+			if _, err := timefmt.Parse(v, format); err != nil {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return format
+		}
+	}
+	return ""
+}
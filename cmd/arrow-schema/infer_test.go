@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/apache/arrow/go/v12/arrow"
+)
+
+// inferred infers the schema of an NDJSON sample.
+func inferred(t *testing.T, lines ...string) (*arrow.Schema, []string, []string) {
+	t.Helper()
+	in := &inference{index: make(map[string]*column)}
+	if _, err := inferJSON(strings.NewReader(strings.Join(lines, "\n")), in); err != nil {
+		t.Fatal(err)
+	}
+	return in.schema(nil)
+}
+
+func TestInferTypes(t *testing.T) {
+	timestamp := &arrow.TimestampType{Unit: arrow.Millisecond, TimeZone: "UTC"}
+	for _, tc := range []struct {
+		values []string
+		want   arrow.DataType
+	}{
+		{[]string{`1`, `2`}, arrow.PrimitiveTypes.Int64},
+		{[]string{`1.5`, `2.5`}, arrow.PrimitiveTypes.Float64},
+		{[]string{`true`, `false`}, arrow.FixedWidthTypes.Boolean},
+		{[]string{`"a"`, `"b"`}, arrow.BinaryTypes.String},
+		{[]string{`"2024-01-01T12:00:00+0000"`, `"2024-01-02T12:00:00+0000"`}, timestamp},
+		// widening
+		{[]string{`1`, `2.5`}, arrow.PrimitiveTypes.Float64},
+		{[]string{`2.5`, `1`}, arrow.PrimitiveTypes.Float64},
+		{[]string{`1`, `"a"`}, arrow.BinaryTypes.String},
+		{[]string{`true`, `1`}, arrow.BinaryTypes.String},
+		{[]string{`"2024-01-01T12:00:00+0000"`, `"soon"`}, arrow.BinaryTypes.String},
+		{[]string{`1`, `{"a": 1}`}, arrow.BinaryTypes.String},
+		{[]string{`null`, `null`}, arrow.BinaryTypes.String},
+	} {
+		var lines []string
+		for _, v := range tc.values {
+			lines = append(lines, `{"X": `+v+`}`)
+		}
+		s, _, _ := inferred(t, lines...)
+		if got := s.Field(0).Type; !arrow.TypeEqual(got, tc.want) {
+			t.Errorf("%v inferred as %s, want %s", tc.values, got, tc.want)
+		}
+	}
+}
+
+func TestInferNullable(t *testing.T) {
+	s, _, notes := inferred(t,
+		`{"ALWAYS": 1, "NULL": null, "SOMETIMES": "a", "FLAG": true}`,
+		`{"ALWAYS": 2, "NULL": 3, "FLAG": false}`,
+		`not json`,
+	)
+	want := map[string]bool{"ALWAYS": false, "NULL": true, "SOMETIMES": true, "FLAG": false}
+	for name, nullable := range want {
+		f, ok := s.FieldsByName(name)
+		if !ok {
+			t.Fatalf("no field %s", name)
+		}
+		if f[0].Nullable != nullable {
+			t.Errorf("%s inferred with nullable %v, want %v", name, f[0].Nullable, nullable)
+		}
+	}
+	if len(notes) != 0 {
+		t.Errorf("notes %v, want none", notes)
+	}
+	// fields keep the order of their first appearance
+	var names []string
+	for _, f := range s.Fields() {
+		names = append(names, f.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"ALWAYS", "NULL", "SOMETIMES", "FLAG"}) {
+		t.Errorf("fields %v", names)
+	}
+}
+
+func TestInferNotes(t *testing.T) {
+	_, timeFields, notes := inferred(t, `{"N": null, "O": [1], "T": "2024-01-01 12:00:00"}`)
+	want := []string{
+		`field "N": only null values seen, assuming utf8`,
+		`field "O": nested values are not supported by the plugin, assuming utf8`,
+	}
+	if !reflect.DeepEqual(notes, want) {
+		t.Errorf("notes %q, want %q", notes, want)
+	}
+	if !reflect.DeepEqual(timeFields, []string{"T=%Y-%m-%d %H:%M:%S"}) {
+		t.Errorf("time fields %v", timeFields)
+	}
+}
+
+const testParsers = `
+[SERVICE]
+    Flush 1
+
+[PARSER]
+    Name   other
+    Format json
+
+[PARSER]
+    Name        sensor
+    Format      regex
+    Regex       ^(?<TIME>[^ ]+) (?<LEVEL>[^ ]+) (?<COUNT>[^ ]+) (?<RATIO>[^ ]+) (?<UP>[^ ]+)( (?<NOTE>.*))?$
+    Time_Key    TIME
+    Time_Format %d/%m/%Y-%H:%M
+    Types       COUNT:integer RATIO:float UP:bool
+`
+
+func writeTestFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadParser(t *testing.T) {
+	p, err := readParser(writeTestFile(t, "parsers.conf", testParsers), "SENSOR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Format != "regex" || p.TimeKey != "TIME" || p.TimeFormat != "%d/%m/%Y-%H:%M" {
+		t.Errorf("parsed %+v", p)
+	}
+	if want := map[string]string{"COUNT": "integer", "RATIO": "float", "UP": "bool"}; !reflect.DeepEqual(p.Types, want) {
+		t.Errorf("types %v, want %v", p.Types, want)
+	}
+	if _, err := readParser(writeTestFile(t, "parsers.conf", testParsers), "missing"); err == nil {
+		t.Error("missing parser found")
+	}
+}
+
+func TestInferRegex(t *testing.T) {
+	p, err := readParser(writeTestFile(t, "parsers.conf", testParsers), "sensor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := &inference{index: make(map[string]*column)}
+	skipped, err := inferRegex(strings.NewReader(strings.Join([]string{
+		"01/02/2024-10:00 info 3 0.5 true first",
+		"01/02/2024-10:05 warn x 1 false",
+		"garbage",
+	}, "\n")), p, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped != 1 {
+		t.Errorf("skipped %d lines, want 1", skipped)
+	}
+	s, timeFields, _ := in.schema(p)
+	want := []arrow.Field{
+		{Name: "TIME", Type: &arrow.TimestampType{Unit: arrow.Millisecond, TimeZone: "UTC"}},
+		{Name: "LEVEL", Type: arrow.BinaryTypes.String},
+		// x is no integer
+		{Name: "COUNT", Type: arrow.BinaryTypes.String},
+		{Name: "RATIO", Type: arrow.PrimitiveTypes.Float64},
+		{Name: "UP", Type: arrow.FixedWidthTypes.Boolean},
+		{Name: "NOTE", Type: arrow.BinaryTypes.String, Nullable: true},
+	}
+	if got := arrow.NewSchema(want, nil); !s.Equal(got) {
+		t.Errorf("inferred\n%s\nwant\n%s", s, got)
+	}
+	if !reflect.DeepEqual(timeFields, []string{"TIME=%d/%m/%Y-%H:%M"}) {
+		t.Errorf("time fields %v", timeFields)
+	}
+}
+
+func TestRunInfer(t *testing.T) {
+	sample := writeTestFile(t, "sample.ndjson", `{"A": 1}`+"\n"+`{"A": 2, "B": "x"}`+"\n")
+	var out, diag bytes.Buffer
+	if err := runInfer([]string{sample}, &out, &diag); err != nil {
+		t.Fatal(err)
+	}
+	s, err := loadSchema(writeTestFile(t, "schema.json", out.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := arrow.NewSchema([]arrow.Field{
+		{Name: "A", Type: arrow.PrimitiveTypes.Int64},
+		{Name: "B", Type: arrow.BinaryTypes.String, Nullable: true},
+	}, nil)
+	if !s.Equal(want) {
+		t.Errorf("wrote\n%s\nwant\n%s", s, want)
+	}
+	if diag.Len() != 0 {
+		t.Errorf("diagnostics %q, want none", diag.String())
+	}
+}
@@ -0,0 +1,170 @@
+// Command arrow-schema helps writing and maintaining the schema files used by
+// the Fluent Bit Arrow output plugin.
+//
+// Usage:
+//
+//	arrow-schema infer -parsers parsers.conf -parser sensor sample.log
+//	arrow-schema infer sample.ndjson
+//	arrow-schema validate [-time-fields 'DATE=%Y-%m-%d,'] schema.json
+//	arrow-schema print [-json] schema.json
+//	arrow-schema diff old.json new.json
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	arrowschema "github.com/anaray/fluent-bit-arrow-plugin/internal/arrow"
+	"github.com/anaray/fluent-bit-arrow-plugin/pkg/plugin"
+	"github.com/apache/arrow/go/v12/arrow"
+)
+
+const usage = `arrow-schema generates and checks schema files of the Fluent Bit Arrow output.
+
+Commands:
+  infer     infer a schema from a sample NDJSON or log file
+  validate  validate a schema file the way the plugin does at startup
+  print     pretty-print a schema file
+  diff      compare two schema files for compatibility
+
+Run 'arrow-schema <command> -h' for the options of a command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	args := os.Args[2:]
+	switch os.Args[1] {
+	case "infer":
+		err = runInfer(args, os.Stdout, os.Stderr)
+	case "validate":
+		err = runValidate(args, os.Stdout)
+	case "print":
+		err = runPrint(args, os.Stdout)
+	case "diff":
+		err = runDiff(args, os.Stdout)
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(os.Stdout, usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	var exit *exitError
+	switch {
+	case errors.As(err, &exit):
+		os.Exit(exit.code)
+	case err != nil:
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// exitError ends the program with code without printing anything more, the
+// command already reported what went wrong.
+type exitError struct {
+	code int
+}
+
+func (e *exitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.code)
+}
+
+func runValidate(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	timeFields := fs.String("time-fields", "", "Time_Fields value of the output, e.g. 'DATE=%Y-%m-%dT%H:%M:%S%z,'")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: arrow-schema validate [-time-fields value] schema.json")
+	}
+
+	file := fs.Arg(0)
+	doc, issues, err := readDocument(file)
+	if err != nil {
+		return err
+	}
+	var s *arrow.Schema
+	if doc != nil {
+		s = doc.Schema
+	}
+	issues = append(issues, plugin.ValidateSchema(s, parseTimeFields(*timeFields), doc)...)
+	if len(issues) > 0 {
+		fmt.Fprintln(out, (&arrowschema.SchemaError{Source: file, Issues: issues}).Error())
+		return &exitError{code: 1}
+	}
+	fmt.Fprintf(out, "%s: ok, %d fields\n", file, len(s.Fields()))
+	return nil
+}
+
+func runPrint(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("print", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the canonical Schema_File JSON instead of a summary")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: arrow-schema print [-json] schema.json")
+	}
+
+	s, err := loadSchema(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return writeSchema(out, s)
+	}
+	fmt.Fprintln(out, s)
+	return nil
+}
+
+// readDocument reads and decodes a schema file.
+func readDocument(file string) (*arrowschema.Document, []arrowschema.Issue, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	doc, issues := arrowschema.DecodeDocument(data)
+	return doc, issues, nil
+}
+
+// loadSchema reads a schema file that must not have any decoding issue.
+func loadSchema(file string) (*arrow.Schema, error) {
+	doc, issues, err := readDocument(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(issues) > 0 {
+		return nil, &arrowschema.SchemaError{Source: file, Issues: issues}
+	}
+	return doc.Schema, nil
+}
+
+// writeSchema writes s in the Schema_File format.
+func writeSchema(out io.Writer, s *arrow.Schema) error {
+	data, err := json.MarshalIndent(arrowschema.SchemaToJSON(s), "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%s\n", data)
+	return err
+}
+
+// parseTimeFields parses a Time_Fields value the same way the plugin does.
+func parseTimeFields(v string) map[string]string {
+	tf := make(map[string]string)
+	for _, split := range strings.Split(v, ",") {
+		mapping := strings.Split(split, "=")
+		if len(mapping) == 2 {
+			tf[mapping[0]] = mapping[1]
+		}
+	}
+	return tf
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// parserDef is a [PARSER] section of a Fluent Bit parsers file.
+type parserDef struct {
+	Name       string
+	Format     string
+	Regex      string
+	TimeKey    string
+	TimeFormat string
+	// Types maps a key to its Fluent Bit type: string, integer, float,
+	// bool or hex.
+	Types map[string]string
+}
+
+// readParser returns the parser called name from a Fluent Bit parsers file
+// in the classic configuration format.
+func readParser(file string, name string) (*parserDef, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cur *parserDef
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "["):
+			if cur != nil && strings.EqualFold(cur.Name, name) {
+				return cur, nil
+			}
+			cur = nil
+			if strings.EqualFold(line, "[PARSER]") {
+				cur = &parserDef{Types: make(map[string]string)}
+			}
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+
+		key, value := splitEntry(line)
+		switch strings.ToLower(key) {
+		case "name":
+			cur.Name = value
+		case "format":
+			cur.Format = strings.ToLower(value)
+		case "regex":
+			cur.Regex = value
+		case "time_key":
+			cur.TimeKey = value
+		case "time_format":
+			cur.TimeFormat = value
+		case "types":
+			for _, t := range strings.Fields(value) {
+				if kv := strings.SplitN(t, ":", 2); len(kv) == 2 {
+					cur.Types[kv[0]] = strings.ToLower(kv[1])
+				}
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if cur != nil && strings.EqualFold(cur.Name, name) {
+		return cur, nil
+	}
+	return nil, fmt.Errorf("parser %q not found in %s", name, file)
+}
+
+// splitEntry splits a "Key value" line of the classic format.
+func splitEntry(line string) (string, string) {
+	i := strings.IndexAny(line, " \t")
+	if i < 0 {
+		return line, ""
+	}
+	return line[:i], strings.TrimSpace(line[i:])
+}
+
+// compileRegex compiles an Onigmo regular expression as used by Fluent Bit,
+// rewriting its (?<name>...) groups to Go syntax.
+func compileRegex(expr string) (*regexp.Regexp, error) {
+	return regexp.Compile(strings.ReplaceAll(expr, "(?<", "(?P<"))
+}
@@ -0,0 +1,195 @@
+// Command flight-receiver is a minimal Arrow Flight server for developing and
+// testing the Fluent Bit Arrow output plugin.
+//
+// It accepts DoPut streams, keeps them per descriptor in memory or as Arrow
+// IPC files, acknowledges every batch carrying app_metadata with a PutResult
+// echoing it, and serves the received data back through DoGet, where the
+// ticket is the descriptor path joined by '/' ("default" for descriptors
+// without a path).
+//
+// Usage:
+//
+//	flight-receiver [-addr localhost:8082] [-dir ./received] [-schema iot/sensor=sensor.json]
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+
+	arrowschema "github.com/anaray/fluent-bit-arrow-plugin/internal/arrow"
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/flight"
+	"github.com/apache/arrow/go/v12/arrow/ipc"
+	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/encoding/gzip" // accepts Grpc_Compression gzip
+	"google.golang.org/grpc/status"
+)
+
+// schemaFlags collects the repeated -schema flag.
+type schemaFlags []string
+
+func (s *schemaFlags) String() string     { return strings.Join(*s, ",") }
+func (s *schemaFlags) Set(v string) error { *s = append(*s, v); return nil }
+
+func main() {
+	addr := flag.String("addr", "localhost:8082", "address to listen on")
+	dir := flag.String("dir", "", "store received streams as Arrow IPC files below this directory instead of in memory")
+	ack := flag.Bool("ack", true, "acknowledge batches carrying app_metadata with a PutResult")
+	quiet := flag.Bool("quiet", false, "do not print a summary of every batch")
+	var schemas schemaFlags
+	flag.Var(&schemas, "schema", "serve a schema file for a descriptor path before anything is received, as path=file (repeatable)")
+	flag.Parse()
+
+	st, err := newStore(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, s := range schemas {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 {
+			log.Fatalf("invalid -schema %q, expected path=file", s)
+		}
+		schema, err := loadSchema(kv[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		st.setSchema(strings.Trim(kv[0], "/"), schema)
+	}
+
+	srv := flight.NewServerWithMiddleware(nil)
+	if err := srv.Init(*addr); err != nil {
+		log.Fatal(err)
+	}
+	srv.RegisterFlightService(&receiver{store: st, ack: *ack, quiet: *quiet})
+	srv.SetShutdownOnSignals(os.Interrupt, syscall.SIGTERM)
+	log.Printf("flight receiver listening on %s", srv.Addr())
+	if err := srv.Serve(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func loadSchema(file string) (*arrow.Schema, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	doc, issues := arrowschema.DecodeDocument(data)
+	if len(issues) > 0 {
+		return nil, &arrowschema.SchemaError{Source: file, Issues: issues}
+	}
+	return doc.Schema, nil
+}
+
+type receiver struct {
+	flight.BaseFlightServer
+	store *store
+	ack   bool
+	quiet bool
+}
+
+func (r *receiver) DoPut(stream flight.FlightService_DoPutServer) error {
+	rdr, err := flight.NewRecordReader(stream)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "failed to read schema: %v", err)
+	}
+	defer rdr.Release()
+
+	key := descriptorKey(rdr.LatestFlightDescriptor())
+	sk, err := r.store.open(key, rdr.Schema())
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to store %q: %v", key, err)
+	}
+	defer sk.close()
+	log.Printf("[%s] stream opened, %d columns", key, len(rdr.Schema().Fields()))
+
+	var n int
+	for rdr.Next() {
+		rec := rdr.Record()
+		meta := rdr.LatestAppMetadata()
+		if err := sk.add(rec); err != nil {
+			return status.Errorf(codes.Internal, "failed to store %q: %v", key, err)
+		}
+		n++
+		if !r.quiet {
+			log.Printf("[%s] batch #%d rows=%d cols=%d app_metadata=%s", key, n, rec.NumRows(), rec.NumCols(), formatMetadata(meta))
+		}
+		if r.ack && len(meta) > 0 {
+			if err := stream.Send(&flight.PutResult{AppMetadata: meta}); err != nil {
+				return err
+			}
+		}
+	}
+	if err := rdr.Err(); err != nil && err != io.EOF {
+		log.Printf("[%s] stream failed after %d batches: %v", key, n, err)
+		return err
+	}
+	log.Printf("[%s] stream closed after %d batches", key, n)
+	return nil
+}
+
+// formatMetadata prints the plugin's 8 byte sequence numbers as numbers and
+// anything else as text.
+func formatMetadata(meta []byte) string {
+	switch {
+	case len(meta) == 0:
+		return "-"
+	case len(meta) == 8:
+		return fmt.Sprintf("seq:%d", binary.BigEndian.Uint64(meta))
+	}
+	return string(meta)
+}
+
+func (r *receiver) DoGet(tkt *flight.Ticket, stream flight.FlightService_DoGetServer) error {
+	key := string(tkt.Ticket)
+	i, ok := r.store.info(key)
+	if !ok {
+		return status.Errorf(codes.NotFound, "no stream for %q", key)
+	}
+	w := flight.NewRecordWriter(stream, ipc.WithSchema(i.schema))
+	defer w.Close()
+	return r.store.each(key, func(rec arrow.Record) error {
+		return w.Write(rec)
+	})
+}
+
+func (r *receiver) flightInfo(i info) *flight.FlightInfo {
+	return &flight.FlightInfo{
+		Schema:           flight.SerializeSchema(i.schema, r.store.mem),
+		FlightDescriptor: &flight.FlightDescriptor{Type: flight.DescriptorPATH, Path: strings.Split(i.key, "/")},
+		Endpoint:         []*flight.FlightEndpoint{{Ticket: &flight.Ticket{Ticket: []byte(i.key)}}},
+		TotalRecords:     i.rows,
+		TotalBytes:       -1,
+	}
+}
+
+func (r *receiver) ListFlights(_ *flight.Criteria, stream flight.FlightService_ListFlightsServer) error {
+	for _, i := range r.store.list() {
+		if err := stream.Send(r.flightInfo(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *receiver) GetFlightInfo(_ context.Context, desc *flight.FlightDescriptor) (*flight.FlightInfo, error) {
+	i, ok := r.store.info(descriptorKey(desc))
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no stream for %q", descriptorKey(desc))
+	}
+	return r.flightInfo(i), nil
+}
+
+func (r *receiver) GetSchema(_ context.Context, desc *flight.FlightDescriptor) (*flight.SchemaResult, error) {
+	i, ok := r.store.info(descriptorKey(desc))
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no schema for %q", descriptorKey(desc))
+	}
+	return &flight.SchemaResult{Schema: flight.SerializeSchema(i.schema, r.store.mem)}, nil
+}
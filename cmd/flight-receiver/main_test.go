@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/anaray/fluent-bit-arrow-plugin/pkg/convert"
+	"github.com/anaray/fluent-bit-arrow-plugin/pkg/convert/convtest"
+	"github.com/anaray/fluent-bit-arrow-plugin/pkg/plugin"
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+	"github.com/apache/arrow/go/v12/arrow/flight"
+	"google.golang.org/grpc"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+var sensorSchema = arrow.NewSchema([]arrow.Field{
+	{Name: "SENSOR", Type: arrow.BinaryTypes.String, Nullable: true},
+	{Name: "VALUE", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
+}, nil)
+
+// startReceiver serves a receiver with an in-memory store on a free port
+// until the end of the test.
+func startReceiver(t *testing.T, ack bool) (string, *store) {
+	t.Helper()
+	st, err := newStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := flight.NewServerWithMiddleware(nil)
+	if err := srv.Init("localhost:0"); err != nil {
+		t.Fatal(err)
+	}
+	srv.RegisterFlightService(&receiver{store: st, ack: ack, quiet: true})
+	go srv.Serve()
+	t.Cleanup(srv.Shutdown)
+	return srv.Addr().String(), st
+}
+
+// sensorRecords converts one record batch per value.
+func sensorRecords(t *testing.T, values ...float64) []arrow.Record {
+	t.Helper()
+	var recs []arrow.Record
+	for _, v := range values {
+		rs, err := convtest.Run(sensorSchema, convert.Config{},
+			convtest.Entry{Time: time.Now(), Record: map[string]interface{}{"SENSOR": "s1", "VALUE": v}},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rs...)
+	}
+	t.Cleanup(func() {
+		for _, r := range recs {
+			r.Release()
+		}
+	})
+	return recs
+}
+
+// readBack returns the VALUE column of everything the receiver serves for
+// key through DoGet.
+func readBack(t *testing.T, addr, key string) []float64 {
+	t.Helper()
+	client, err := flight.NewClientWithMiddleware(addr, nil, nil, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	stream, err := client.DoGet(context.Background(), &flight.Ticket{Ticket: []byte(key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdr, err := flight.NewRecordReader(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdr.Release()
+	if !rdr.Schema().Equal(sensorSchema) {
+		t.Fatalf("schema read back is %s, want %s", rdr.Schema(), sensorSchema)
+	}
+	var values []float64
+	for rdr.Next() {
+		values = append(values, rdr.Record().Column(1).(*array.Float64).Float64Values()...)
+	}
+	return values
+}
+
+func TestDoPutRoundTrip(t *testing.T) {
+	for _, am := range []string{plugin.AppMetadataSequence, plugin.AppMetadataJSON} {
+		t.Run(am, func(t *testing.T) {
+			addr, st := startReceiver(t, true)
+			svc, err := plugin.NewFlightService(addr, sensorSchema, plugin.FlightConfig{
+				RequireAck:  true,
+				AckTimeout:  5 * time.Second,
+				AppMetadata: am,
+				Descriptor:  &flight.FlightDescriptor{Type: flight.DescriptorPATH, Path: []string{"iot", "sensor"}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range sensorRecords(t, 1.5, 2.5, 3.5) {
+				if err := svc.Write(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := svc.Flush(); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+			if err := svc.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			i, ok := st.info("iot/sensor")
+			if !ok || i.batches != 3 || i.rows != 3 {
+				t.Fatalf("stored %+v, want 3 batches of 1 row", i)
+			}
+			got := readBack(t, addr, "iot/sensor")
+			want := []float64{1.5, 2.5, 3.5}
+			if len(got) != len(want) {
+				t.Fatalf("read back %v, want %v", got, want)
+			}
+			for j := range want {
+				if got[j] != want[j] {
+					t.Fatalf("read back %v, want %v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDoPutWithoutAck(t *testing.T) {
+	addr, _ := startReceiver(t, false)
+	svc, err := plugin.NewFlightService(addr, sensorSchema, plugin.FlightConfig{
+		RequireAck: true,
+		AckTimeout: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+	if err := svc.Write(sensorRecords(t, 1)[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Flush(); err == nil {
+		t.Fatal("Flush succeeded without acknowledgements")
+	}
+
+	// the stream is reopened for the retry
+	if err := svc.Write(sensorRecords(t, 2)[0]); err != nil {
+		t.Fatalf("Write after the ack timeout: %v", err)
+	}
+	if got := readBack(t, addr, "default"); len(got) != 2 {
+		t.Fatalf("read back %v, want both batches", got)
+	}
+}
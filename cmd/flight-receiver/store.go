@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/flight"
+	"github.com/apache/arrow/go/v12/arrow/ipc"
+	"github.com/apache/arrow/go/v12/arrow/memory"
+)
+
+// descriptorKey names the stream of a descriptor: the joined path for PATH
+// descriptors, the command for CMD descriptors and "default" otherwise.
+func descriptorKey(desc *flight.FlightDescriptor) string {
+	switch {
+	case desc == nil:
+		return "default"
+	case desc.Type == flight.DescriptorPATH && len(desc.Path) > 0:
+		return strings.Join(desc.Path, "/")
+	case desc.Type == flight.DescriptorCMD && len(desc.Cmd) > 0:
+		return string(desc.Cmd)
+	}
+	return "default"
+}
+
+// stream is everything received for one descriptor.
+type stream struct {
+	schema  *arrow.Schema
+	records []arrow.Record
+	files   []string
+	rows    int64
+	batches int64
+}
+
+// store keeps received streams in memory, or as Arrow IPC files below dir
+// when dir is set.
+type store struct {
+	dir string
+	mem memory.Allocator
+
+	mu      sync.Mutex
+	streams map[string]*stream
+}
+
+func newStore(dir string) (*store, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &store{
+		dir:     dir,
+		mem:     memory.DefaultAllocator,
+		streams: make(map[string]*stream),
+	}, nil
+}
+
+func (s *store) get(key string) *stream {
+	st, ok := s.streams[key]
+	if !ok {
+		st = &stream{}
+		s.streams[key] = st
+	}
+	return st
+}
+
+// setSchema declares the schema of key before anything was received, so that
+// GetSchema can answer for it.
+func (s *store) setSchema(key string, schema *arrow.Schema) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.get(key).schema = schema
+}
+
+// sink receives the batches of one DoPut stream.
+type sink struct {
+	store *store
+	key   string
+	file  *os.File
+	w     *ipc.FileWriter
+}
+
+// open starts receiving a DoPut stream for key with the given schema.
+func (s *store) open(key string, schema *arrow.Schema) (*sink, error) {
+	s.mu.Lock()
+	s.get(key).schema = schema
+	s.mu.Unlock()
+
+	sk := &sink{store: s, key: key}
+	if s.dir == "" {
+		return sk, nil
+	}
+
+	dir := filepath.Join(s.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	name := filepath.Join(dir, fmt.Sprintf("%d.arrow", time.Now().UnixNano()))
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	w, err := ipc.NewFileWriter(f, ipc.WithSchema(schema), ipc.WithAllocator(s.mem))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	sk.file, sk.w = f, w
+	return sk, nil
+}
+
+// add stores rec, which is retained when kept in memory.
+func (sk *sink) add(rec arrow.Record) error {
+	if sk.w != nil {
+		if err := sk.w.Write(rec); err != nil {
+			return err
+		}
+	}
+	sk.store.mu.Lock()
+	defer sk.store.mu.Unlock()
+	st := sk.store.get(sk.key)
+	if sk.w == nil {
+		rec.Retain()
+		st.records = append(st.records, rec)
+	}
+	st.rows += rec.NumRows()
+	st.batches++
+	return nil
+}
+
+// close finishes the IPC file of the stream, if any.
+func (sk *sink) close() error {
+	if sk.w == nil {
+		return nil
+	}
+	err := sk.w.Close()
+	if cerr := sk.file.Close(); err == nil {
+		err = cerr
+	}
+	sk.store.mu.Lock()
+	st := sk.store.get(sk.key)
+	st.files = append(st.files, sk.file.Name())
+	sk.store.mu.Unlock()
+	return err
+}
+
+// info describes a stored stream.
+type info struct {
+	key     string
+	schema  *arrow.Schema
+	rows    int64
+	batches int64
+}
+
+func (s *store) info(key string) (info, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.streams[key]
+	if !ok || st.schema == nil {
+		return info{}, false
+	}
+	return info{key: key, schema: st.schema, rows: st.rows, batches: st.batches}, true
+}
+
+func (s *store) list() []info {
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.streams))
+	for k := range s.streams {
+		keys = append(keys, k)
+	}
+	s.mu.Unlock()
+	sort.Strings(keys)
+
+	out := make([]info, 0, len(keys))
+	for _, k := range keys {
+		if i, ok := s.info(k); ok {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+// each calls fn for every record stored for key, in the order received.
+func (s *store) each(key string, fn func(arrow.Record) error) error {
+	s.mu.Lock()
+	st, ok := s.streams[key]
+	var records []arrow.Record
+	var files []string
+	if ok {
+		records = append(records, st.records...)
+		files = append(files, st.files...)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no stream for %q", key)
+	}
+
+	for _, rec := range records {
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	for _, name := range files {
+		if err := eachInFile(name, s.mem, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func eachInFile(name string, mem memory.Allocator, fn func(arrow.Record) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := ipc.NewFileReader(f, ipc.WithAllocator(mem))
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	defer r.Close()
+	for i := 0; i < r.NumRecords(); i++ {
+		rec, err := r.Record(i)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
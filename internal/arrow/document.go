@@ -0,0 +1,225 @@
+package arrow
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/apache/arrow/go/v12/arrow"
+)
+
+// Issue is a single problem found in a schema document.
+type Issue struct {
+	// Line is the 1-based line of the document the issue refers to, 0 when
+	// the schema did not come from a document.
+	Line int
+	// Field is the name of the top level field concerned, empty for issues
+	// about the document as a whole.
+	Field string
+	Msg   string
+}
+
+func (i Issue) String() string {
+	var b strings.Builder
+	if i.Line > 0 {
+		fmt.Fprintf(&b, "line %d: ", i.Line)
+	}
+	if i.Field != "" {
+		fmt.Fprintf(&b, "field %q: ", i.Field)
+	}
+	b.WriteString(i.Msg)
+	return b.String()
+}
+
+// SchemaError aggregates every issue found in a schema.
+type SchemaError struct {
+	Source string
+	Issues []Issue
+}
+
+func (e *SchemaError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "schema %s has %d problem(s):", e.Source, len(e.Issues))
+	for _, i := range e.Issues {
+		b.WriteString("\n  ")
+		b.WriteString(i.String())
+	}
+	return b.String()
+}
+
+// Document is a decoded Schema_File.
+type Document struct {
+	Schema *arrow.Schema
+	// FieldLines maps the name of every top level field to the line its
+	// definition starts on.
+	FieldLines map[string]int
+}
+
+// Line returns the line field is defined on, 0 if unknown.
+func (d *Document) Line(field string) int {
+	if d == nil {
+		return 0
+	}
+	return d.FieldLines[field]
+}
+
+// DecodeDocument decodes a Schema_File document of the form
+// {"schema": {"fields": [...], "metadata": [...]}}. Fields are decoded one
+// by one so that every malformed field is reported, not only the first, and
+// the returned schema holds the fields that could be decoded. Malformed input
+// never panics, it results in issues instead.
+func DecodeDocument(data []byte) (doc *Document, issues []Issue) {
+	defer func() {
+		if r := recover(); r != nil {
+			doc = nil
+			issues = append(issues, Issue{Msg: fmt.Sprintf("invalid schema: %v", r)})
+		}
+	}()
+
+	var raw struct {
+		Schema *struct {
+			Fields   []json.RawMessage `json:"fields"`
+			Metadata []metaKV          `json:"metadata"`
+		} `json:"schema"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, []Issue{{Line: errorLine(data, err), Msg: err.Error()}}
+	}
+	if raw.Schema == nil {
+		return nil, []Issue{{Line: 1, Msg: `missing top level "schema" object`}}
+	}
+	if len(raw.Schema.Fields) == 0 {
+		return nil, []Issue{{Line: 1, Msg: "schema has no fields"}}
+	}
+
+	starts := fieldStarts(data)
+	doc = &Document{FieldLines: make(map[string]int, len(raw.Schema.Fields))}
+	fields := make([]FieldWrapper, 0, len(raw.Schema.Fields))
+	for i, rf := range raw.Schema.Fields {
+		line := 0
+		if i < len(starts) {
+			line = starts[i]
+		}
+		var name struct {
+			Name string `json:"name"`
+		}
+		json.Unmarshal(rf, &name)
+		if name.Name == "" {
+			issues = append(issues, Issue{Line: line, Msg: fmt.Sprintf("field #%d has no name", i+1)})
+			continue
+		}
+		if prev, ok := doc.FieldLines[name.Name]; ok {
+			issues = append(issues, Issue{Line: line, Field: name.Name, Msg: fmt.Sprintf("duplicate field name, first defined on line %d", prev)})
+			continue
+		}
+		doc.FieldLines[name.Name] = line
+
+		var f FieldWrapper
+		if err := decodeField(rf, &f); err != nil {
+			issues = append(issues, Issue{Line: line, Field: name.Name, Msg: err.Error()})
+			continue
+		}
+		fields = append(fields, f)
+	}
+	if len(fields) == 0 {
+		return nil, issues
+	}
+
+	s := Schema{Fields: fields, Metadata: raw.Schema.Metadata}
+	if len(s.Metadata) > 0 {
+		keys := make([]string, len(s.Metadata))
+		vals := make([]string, len(s.Metadata))
+		for i, kv := range s.Metadata {
+			keys[i], vals[i] = kv.Key, kv.Value
+		}
+		s.arrowMeta = arrow.NewMetadata(keys, vals)
+	}
+	memo := NewMemo()
+	doc.Schema = SchemaFromJSON(s, &memo)
+	return doc, issues
+}
+
+// decodeField unmarshals a single field, turning panics of the type
+// conversion into errors.
+func decodeField(data []byte, f *FieldWrapper) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid field definition: %v", r)
+		}
+	}()
+	return json.Unmarshal(data, f)
+}
+
+// fieldStarts returns the line of every element of schema.fields.
+func fieldStarts(data []byte) []int {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if !enterKey(dec, "schema") || !enterKey(dec, "fields") {
+		return nil
+	}
+	if t, err := dec.Token(); err != nil || t != json.Delim('[') {
+		return nil
+	}
+	var lines []int
+	for dec.More() {
+		lines = append(lines, lineAt(data, skipSpace(data, int(dec.InputOffset()))))
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			break
+		}
+	}
+	return lines
+}
+
+// enterKey advances dec into the value of key of the next object.
+func enterKey(dec *json.Decoder, key string) bool {
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return false
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return false
+		}
+		if t == key {
+			return true
+		}
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return false
+		}
+	}
+	return false
+}
+
+// skipSpace returns the offset of the first value byte at or after off,
+// skipping whitespace and the separating comma.
+func skipSpace(data []byte, off int) int {
+	for off < len(data) && strings.IndexByte(" \t\r\n,", data[off]) >= 0 {
+		off++
+	}
+	return off
+}
+
+func lineAt(data []byte, off int) int {
+	if off > len(data) {
+		off = len(data)
+	}
+	return bytes.Count(data[:off], []byte("\n")) + 1
+}
+
+func errorLine(data []byte, err error) int {
+	var syn *json.SyntaxError
+	var typ *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syn):
+		return lineAt(data, int(syn.Offset))
+	case errors.As(err, &typ):
+		return lineAt(data, int(typ.Offset))
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return lineAt(data, len(data))
+	}
+	return 0
+}
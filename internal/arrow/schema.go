@@ -239,7 +239,6 @@ func typeToJSON(arrowType arrow.DataType) (json.RawMessage, error) {
 }
 
 func (f FieldWrapper) MarshalJSON() ([]byte, error) {
-	fmt.Println("MarshalJSON calledd....")
 	// for extension types, add the extension type metadata appropriately
 	// and then marshal as normal for the storage type.
 	if f.arrowType.ID() == arrow.EXTENSION {
@@ -664,6 +663,14 @@ func schemaToJSON(schema *arrow.Schema, mapper *Mapper) Schema {
 	}
 }
 
+// SchemaToJSON converts schema into the JSON document read by the plugin's
+// Schema_File, dictionary fields are numbered in the order they appear.
+func SchemaToJSON(schema *arrow.Schema) PayloadSchema {
+	var mapper Mapper
+	mapper.ImportSchema(schema)
+	return PayloadSchema{ArrowSchema: schemaToJSON(schema, &mapper)}
+}
+
 func SchemaFromJSON(schema Schema, memo *Memo) *arrow.Schema {
 	sc := arrow.NewSchema(fieldsFromJSON(schema.Fields), &schema.arrowMeta)
 	dictInfoFromJSONFields(schema.Fields, NewFieldPos(), memo)
@@ -0,0 +1,225 @@
+// Package flblog provides a leveled, structured logger whose lines follow
+// Fluent Bit's own log format, so that messages of the plugin blend in with
+// the rest of the Fluent Bit output:
+//
+//	[2023/01/28 13:22:01] [ warn] [output:arrow:sensor_tracking] message key=value
+package flblog
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is a Fluent Bit log level.
+type Level int
+
+const (
+	LevelOff Level = iota
+	LevelError
+	LevelWarn
+	LevelInfo
+	LevelDebug
+	LevelTrace
+)
+
+var levelNames = map[Level]string{
+	LevelError: "error",
+	LevelWarn:  " warn",
+	LevelInfo:  " info",
+	LevelDebug: "debug",
+	LevelTrace: "trace",
+}
+
+// ParseLevel parses a Log_Level value, it accepts the same names as
+// Fluent Bit: off, error, warn(ing), info, debug and trace.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "off":
+		return LevelOff, nil
+	case "error":
+		return LevelError, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "debug":
+		return LevelDebug, nil
+	case "trace":
+		return LevelTrace, nil
+	}
+	return LevelOff, fmt.Errorf("unknown log level [%s]", s)
+}
+
+// DefaultRateLimit is how often an error or warning with the same message
+// is written, repetitions within the interval are counted and reported with
+// the next line that gets through.
+const DefaultRateLimit = 10 * time.Second
+
+// output is shared by all loggers so that concurrent lines never interleave.
+var output = struct {
+	sync.Mutex
+	w io.Writer
+}{w: os.Stderr}
+
+// SetOutput redirects the lines of every logger to w.
+func SetOutput(w io.Writer) {
+	output.Lock()
+	output.w = w
+	output.Unlock()
+}
+
+// Logger writes leveled messages with key/value fields.
+type Logger struct {
+	name    string
+	level   Level
+	fields  string
+	limiter *limiter
+}
+
+// New returns a logger for the component name, e.g. "output:arrow:<Id>",
+// writing messages at level and below.
+func New(name string, level Level) *Logger {
+	return &Logger{
+		name:    name,
+		level:   level,
+		limiter: newLimiter(DefaultRateLimit),
+	}
+}
+
+// With returns a logger that adds the given key/value pairs to every message.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	c := *l
+	c.fields = l.fields + formatFields(kv)
+	return &c
+}
+
+// Enabled reports whether messages at level are written. It is meant to
+// guard log calls whose arguments are expensive to compute.
+func (l *Logger) Enabled(level Level) bool {
+	return level != LevelOff && level <= l.level
+}
+
+// Error logs msg at error level, rate limited per message.
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.limited(LevelError, msg, kv)
+}
+
+// Warn logs msg at warn level, rate limited per message.
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.limited(LevelWarn, msg, kv)
+}
+
+// Info logs msg at info level.
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log(LevelInfo, msg, kv)
+}
+
+// Debug logs msg at debug level.
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.log(LevelDebug, msg, kv)
+}
+
+// Trace logs msg at trace level.
+func (l *Logger) Trace(msg string, kv ...interface{}) {
+	l.log(LevelTrace, msg, kv)
+}
+
+func (l *Logger) limited(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	ok, suppressed := l.limiter.allow(msg)
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		kv = append(kv, "suppressed", suppressed)
+	}
+	l.log(level, msg, kv)
+}
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(time.Now().Format("[2006/01/02 15:04:05] ["))
+	b.WriteString(levelNames[level])
+	b.WriteString("] [")
+	b.WriteString(l.name)
+	b.WriteString("] ")
+	b.WriteString(msg)
+	b.WriteString(l.fields)
+	b.WriteString(formatFields(kv))
+	b.WriteByte('\n')
+
+	output.Lock()
+	io.WriteString(output.w, b.String())
+	output.Unlock()
+}
+
+func formatFields(kv []interface{}) string {
+	var b strings.Builder
+	for i := 0; i < len(kv); i += 2 {
+		b.WriteByte(' ')
+		b.WriteString(fmt.Sprint(kv[i]))
+		b.WriteByte('=')
+		if i+1 < len(kv) {
+			b.WriteString(formatValue(kv[i+1]))
+		}
+	}
+	return b.String()
+}
+
+func formatValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case error:
+		s = v.Error()
+	default:
+		return fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// limiter lets a message through at most once per interval.
+type limiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	last     map[string]time.Time
+	dropped  map[string]int
+}
+
+func newLimiter(interval time.Duration) *limiter {
+	return &limiter{
+		interval: interval,
+		last:     make(map[string]time.Time),
+		dropped:  make(map[string]int),
+	}
+}
+
+// allow reports whether msg may be written now and how many occurrences were
+// suppressed since it was last written.
+func (r *limiter) allow(msg string) (bool, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if last, ok := r.last[msg]; ok && now.Sub(last) < r.interval {
+		r.dropped[msg]++
+		return false, 0
+	}
+	r.last[msg] = now
+	n := r.dropped[msg]
+	delete(r.dropped, msg)
+	return true, n
+}
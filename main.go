@@ -2,7 +2,6 @@ package main
 
 import (
 	"C"
-	"log"
 	"unsafe"
 
 	"github.com/fluent/fluent-bit-go/output"
@@ -11,15 +10,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/anaray/fluent-bit-arrow-plugin/internal/flblog"
+	"github.com/anaray/fluent-bit-arrow-plugin/pkg/convert"
 	"github.com/anaray/fluent-bit-arrow-plugin/pkg/plugin"
 
 	arrowschema "github.com/anaray/fluent-bit-arrow-plugin/internal/arrow"
 	"github.com/apache/arrow/go/v12/arrow"
-	"github.com/apache/arrow/go/v12/arrow/array"
-	"github.com/itchyny/timefmt-go"
+	"github.com/apache/arrow/go/v12/arrow/flight"
+	"google.golang.org/grpc"
 )
 
 const PluginName = "arrow"
@@ -27,10 +30,66 @@ const Name = "Name"
 const Id = "Id"
 const Desc = "Fluent Bit Arrow Output plugin"
 const TimeFields = "Time_Fields"
+const MetadataFields = "Metadata_Fields"
 const FlightServerUrl = "Arrow_Flight_Server_Url"
 const InferSchema = "Infer_Schema"
 const SchemaFile = "Schema_File"
 const RecordBatchThreshold = "Record_Batch_Threshold"
+const IngestMode = "Ingest_Mode"
+const FlightSqlTable = "Flight_SQL_Table"
+const FlightSqlCreateTable = "Flight_SQL_Create_Table"
+const RequireAck = "Require_Ack"
+const AckTimeout = "Ack_Timeout"
+const MetricsListen = "Metrics_Listen"
+const LogLevel = "Log_Level"
+const SchemaSource = "Schema_Source"
+const SchemaCacheFile = "Schema_Cache_File"
+const FlightDescriptor = "Flight_Descriptor"
+const MemBufLimit = "Mem_Buf_Limit"
+const Allocator = "Allocator"
+const MemLeakCheck = "Mem_Leak_Check"
+const SpoolPath = "Spool_Path"
+const SpoolMaxSize = "Spool_Max_Size"
+const SpoolMaxAge = "Spool_Max_Age"
+const SpoolOverflow = "Spool_Overflow"
+const SpoolRetryInterval = "Spool_Retry_Interval"
+const EndpointStrategy = "Endpoint_Strategy"
+const GrpcKeepaliveTime = "Grpc_Keepalive_Time"
+const GrpcKeepaliveTimeout = "Grpc_Keepalive_Timeout"
+const GrpcMaxSendMsgSize = "Grpc_Max_Send_Msg_Size"
+const GrpcCompression = "Grpc_Compression"
+const GrpcUserAgent = "Grpc_User_Agent"
+const GrpcHeaders = "Grpc_Headers"
+const WriteTimeout = "Write_Timeout"
+const MaxBatchBytes = "Max_Batch_Bytes"
+const TargetBatchBytes = "Target_Batch_Bytes"
+const SortKeys = "Sort_Keys"
+const DedupKeys = "Dedup_Keys"
+const DedupWindow = "Dedup_Window"
+const DedupMaxKeys = "Dedup_Max_Keys"
+const RollupInterval = "Rollup_Interval"
+const RollupDimensions = "Rollup_Dimensions"
+const RollupMeasures = "Rollup_Measures"
+const RollupFunctions = "Rollup_Functions"
+const RollupTimeField = "Rollup_Time_Field"
+const RollupDelay = "Rollup_Delay"
+const RollupMode = "Rollup_Mode"
+const RollupDescriptor = "Rollup_Descriptor"
+const PartitionBy = "Partition_By"
+const PartitionIdleTimeout = "Partition_Idle_Timeout"
+const SchemaMetadata = "Schema_Metadata"
+const SchemaRuntimeMetadata = "Schema_Runtime_Metadata"
+const AppMetadata = "App_Metadata"
+const SchemaMap = "Schema_Map"
+const ExtraFieldsColumn = "Extra_Fields_Column"
+
+// Schema_Source values
+const SchemaSourceFile = "file"
+const SchemaSourceFlight = "flight"
+
+// Ingest_Mode values
+const IngestModeDoPut = "doput"
+const IngestModeFlightSql = "flightsql"
 
 // FluentArrowPlugin represents a FluentBit output plugin.
 
@@ -48,6 +107,9 @@ func NewPlugin() plugin.Plugin {
 
 var arrowPlugin plugin.Plugin = NewPlugin()
 
+// logger is used for messages not tied to a single output
+var logger = flblog.New("output:"+PluginName, flblog.LevelInfo)
+
 // Create reads the FluentBit configuration block for FluentArrowPlugin.
 
 // Create reads the configuration block, validates and creates PluginContext
@@ -64,6 +126,14 @@ func (p FluentArrowPlugin) Create(ctx unsafe.Pointer) (*plugin.PluginContext, er
 		return &plugin.PluginContext{}, fmt.Errorf(errMsg, Id)
 	}
 	c.Id = id
+	c.Metrics = plugin.NewMetrics(id)
+
+	// Log_Level, same values as Fluent Bit's own log_level
+	lvl, err := flblog.ParseLevel(output.FLBPluginConfigKey(ctx, LogLevel))
+	if err != nil {
+		return &plugin.PluginContext{}, err
+	}
+	c.Logger = flblog.New("output:"+PluginName+":"+id, lvl)
 
 	// 2) Time_Fields
 	tf := output.FLBPluginConfigKey(ctx, TimeFields)
@@ -71,22 +141,41 @@ func (p FluentArrowPlugin) Create(ctx unsafe.Pointer) (*plugin.PluginContext, er
 		// Time_Fields key's format is comma seperated string "<key_name>=<date_format>,<key_name>=<date_format>,"
 		// example: Time_Fields DATE_TIME=%Y-%m-%dT%H:%M:%S%z,
 		// the date format is format described in strptime function.
-		log.Printf("Time_Field configured in %s output plugin", PluginName)
 		splits := strings.Split(tf, ",")
 		for _, split := range splits {
 			mapping := strings.Split(split, "=")
 			if len(mapping) == 2 {
-				log.Printf("Time Field=%s, configured strptime format=%s", mapping[0], mapping[1])
+				c.Logger.Debug("time field configured", "column", mapping[0], "format", mapping[1])
 				c.TimeFields[mapping[0]] = mapping[1]
 			}
 		}
 	}
 
-	// 3) Arrow_Flight_Server_Url
+	// 3) Arrow_Flight_Server_Url, a comma separated list of endpoints, and
+	// Endpoint_Strategy
 	fs := output.FLBPluginConfigKey(ctx, FlightServerUrl)
 	if fs == "" {
 		return &plugin.PluginContext{}, fmt.Errorf(errMsg, FlightServerUrl)
 	}
+	var urls []string
+	for _, u := range strings.Split(fs, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	strategy := strings.ToLower(output.FLBPluginConfigKey(ctx, EndpointStrategy))
+	var dialOpts []grpc.DialOption
+	switch strategy {
+	case "", plugin.StrategyFailover, plugin.StrategyRoundRobin:
+	case plugin.StrategyDNS:
+		if len(urls) != 1 {
+			return &plugin.PluginContext{}, fmt.Errorf("%s %s takes a single %s", EndpointStrategy, strategy, FlightServerUrl)
+		}
+		urls[0] = plugin.DNSTarget(urls[0])
+		dialOpts = plugin.DNSDialOptions()
+	default:
+		return &plugin.PluginContext{}, fmt.Errorf("unsupported %s [%s]", EndpointStrategy, strategy)
+	}
 
 	// 4) Record_Batch_Count
 	rb, err := strconv.Atoi(output.FLBPluginConfigKey(ctx, RecordBatchThreshold))
@@ -95,106 +184,740 @@ func (p FluentArrowPlugin) Create(ctx unsafe.Pointer) (*plugin.PluginContext, er
 	}
 	c.RecordBatchThreshold = rb
 
-	// 5) Schema_File
-	sf := output.FLBPluginConfigKey(ctx, SchemaFile)
-	if sf == "" {
-		return &plugin.PluginContext{}, fmt.Errorf(errMsg, SchemaFile)
-	}
-	s, err := parseSchema(sf)
+	// Allocator and Mem_Buf_Limit, all Arrow buffers of the output are
+	// accounted for against the limit
+	mem, err := plugin.NewAllocator(strings.ToLower(output.FLBPluginConfigKey(ctx, Allocator)))
 	if err != nil {
 		return &plugin.PluginContext{}, err
 	}
-	c.Schema = s
+	limit, err := parseSize(output.FLBPluginConfigKey(ctx, MemBufLimit))
+	if err != nil {
+		return &plugin.PluginContext{}, fmt.Errorf("invalid %s: %v", MemBufLimit, err)
+	}
+	c.Memory = plugin.NewMemory(mem, limit, isTrue(output.FLBPluginConfigKey(ctx, MemLeakCheck)))
+
+	// 5) Schema_Source, Schema_File and Schema_Cache_File
+	var s *arrow.Schema
+	source := strings.ToLower(output.FLBPluginConfigKey(ctx, SchemaSource))
+	cache := output.FLBPluginConfigKey(ctx, SchemaCacheFile)
+	switch source {
+	case "", SchemaSourceFile:
+		sf := output.FLBPluginConfigKey(ctx, SchemaFile)
+		if sf == "" {
+			return &plugin.PluginContext{}, fmt.Errorf(errMsg, SchemaFile)
+		}
+		fileSchema, doc, issues, err := parseSchema(sf)
+		if err != nil {
+			return &plugin.PluginContext{}, err
+		}
+		if err := validateSchema(sf, fileSchema, doc, issues, c.TimeFields); err != nil {
+			return &plugin.PluginContext{}, err
+		}
+		s = fileSchema
+	case SchemaSourceFlight:
+		if output.FLBPluginConfigKey(ctx, SchemaMap) != "" {
+			return &plugin.PluginContext{}, fmt.Errorf("%s requires %s %s", SchemaMap, SchemaSource, SchemaSourceFile)
+		}
+		// the cached schema is only used if the server cannot be reached
+		if cache != "" {
+			cs, doc, issues, err := parseSchema(cache)
+			if err == nil {
+				err = validateSchema(cache, cs, doc, issues, c.TimeFields)
+			}
+			if err != nil {
+				c.Logger.Info("no usable schema cache", "file", cache, "error", err)
+			} else {
+				s = cs
+			}
+		}
+	default:
+		return &plugin.PluginContext{}, fmt.Errorf("unsupported %s [%s]", SchemaSource, source)
+	}
 
-	// Debug: print schema and fields in it.
-	fields := s.Fields()
-	for _, f := range fields {
-		log.Printf("field name=%s , field type=%s\n ", f.Name, f.Type)
+	// 6) Flight_Descriptor, path segments separated by '/'
+	desc := &flight.FlightDescriptor{Type: flight.DescriptorUNKNOWN}
+	if fd := output.FLBPluginConfigKey(ctx, FlightDescriptor); fd != "" {
+		desc = &flight.FlightDescriptor{
+			Type: flight.DescriptorPATH,
+			Path: strings.Split(strings.Trim(fd, "/"), "/"),
+		}
+	} else if source == SchemaSourceFlight {
+		return &plugin.PluginContext{}, fmt.Errorf(errMsg, FlightDescriptor)
 	}
 
-	// Set schema to RecordBuilder
-	b, err := plugin.NewRecordBuilder(c.Schema)
+	// Schema_Map, kinds of records with a schema and descriptor of their
+	// own, records of no kind keep Schema_File and Flight_Descriptor
+	var kinds *plugin.Kinds
+	if sm := output.FLBPluginConfigKey(ctx, SchemaMap); sm != "" {
+		if kinds, err = parseSchemaMap(sm, c.TimeFields); err != nil {
+			return &plugin.PluginContext{}, err
+		}
+		for _, k := range kinds.Kinds {
+			if strings.Join(k.Path, "/") == strings.Join(desc.Path, "/") {
+				return &plugin.PluginContext{}, fmt.Errorf("invalid %s: descriptor [%s] is the %s", SchemaMap, strings.Join(k.Path, "/"), FlightDescriptor)
+			}
+		}
+	}
+
+	// Rollup_*, the rollup rows are sent instead of the records unless
+	// Rollup_Mode is both
+	input := s
+	rollupMode := strings.ToLower(output.FLBPluginConfigKey(ctx, RollupMode))
+	if ri := output.FLBPluginConfigKey(ctx, RollupInterval); ri != "" {
+		if source == SchemaSourceFlight {
+			return &plugin.PluginContext{}, fmt.Errorf("%s requires %s %s", RollupInterval, SchemaSource, SchemaSourceFile)
+		}
+		if kinds != nil {
+			return &plugin.PluginContext{}, fmt.Errorf("%s cannot be combined with %s", RollupInterval, SchemaMap)
+		}
+		r, err := rollupConfig(ctx, ri, s, c.TimeFields)
+		if err != nil {
+			return &plugin.PluginContext{}, err
+		}
+		c.Rollup = r
+		switch rollupMode {
+		case "", plugin.RollupReplace:
+			s = r.Schema()
+		case plugin.RollupBoth:
+		default:
+			return &plugin.PluginContext{}, fmt.Errorf("unsupported %s [%s]", RollupMode, rollupMode)
+		}
+	}
+
+	// 7) Require_Ack and Ack_Timeout
+	c.RequireAck = isTrue(output.FLBPluginConfigKey(ctx, RequireAck))
+	at, err := parseDuration(output.FLBPluginConfigKey(ctx, AckTimeout))
 	if err != nil {
-		return &plugin.PluginContext{}, err
+		return &plugin.PluginContext{}, fmt.Errorf("invalid %s: %v", AckTimeout, err)
 	}
-	c.Builder = b
 
-	// create ArrowFlightService
-	fltSvc, err := plugin.NewFlightService(fs, s)
+	// Grpc_* and Write_Timeout
+	grpcCfg, err := grpcConfig(ctx)
 	if err != nil {
 		return &plugin.PluginContext{}, err
 	}
-	c.FlightSvc = fltSvc
+
+	// Max_Batch_Bytes, defaults to what fits into a gRPC message, and
+	// Target_Batch_Bytes
+	c.MaxBatchBytes = plugin.DefaultMaxBatchBytes
+	if grpcCfg.MaxSendMsgSize > 0 {
+		c.MaxBatchBytes = grpcCfg.MaxSendMsgSize - grpcCfg.MaxSendMsgSize/16
+	}
+	if v := output.FLBPluginConfigKey(ctx, MaxBatchBytes); v != "" {
+		if c.MaxBatchBytes, err = parseSize(v); err != nil {
+			return &plugin.PluginContext{}, fmt.Errorf("invalid %s: %v", MaxBatchBytes, err)
+		}
+	}
+	if c.TargetBatchBytes, err = parseSize(output.FLBPluginConfigKey(ctx, TargetBatchBytes)); err != nil {
+		return &plugin.PluginContext{}, fmt.Errorf("invalid %s: %v", TargetBatchBytes, err)
+	}
+	if c.MaxBatchBytes > 0 && c.TargetBatchBytes > c.MaxBatchBytes {
+		return &plugin.PluginContext{}, fmt.Errorf("%s must not exceed %s", TargetBatchBytes, MaxBatchBytes)
+	}
+
+	// 8) Ingest_Mode, defaults to raw DoPut
+	switch mode := strings.ToLower(output.FLBPluginConfigKey(ctx, IngestMode)); mode {
+	case "", IngestModeDoPut:
+		md, err := schemaMetadata(ctx, c.Id)
+		if err != nil {
+			return &plugin.PluginContext{}, err
+		}
+		am := strings.ToLower(output.FLBPluginConfigKey(ctx, AppMetadata))
+		switch am {
+		case "", plugin.AppMetadataSequence, plugin.AppMetadataJSON:
+		default:
+			return &plugin.PluginContext{}, fmt.Errorf("unsupported %s [%s]", AppMetadata, am)
+		}
+		host, _ := os.Hostname()
+		// create an ArrowFlightService per endpoint
+		cfg := plugin.FlightConfig{
+			RequireAck:      c.RequireAck,
+			AckTimeout:      at,
+			Metrics:         c.Metrics,
+			Logger:          c.Logger,
+			Descriptor:      desc,
+			FetchSchema:     source == SchemaSourceFlight,
+			SchemaCacheFile: cache,
+			GRPC:            grpcCfg,
+			DialOptions:     dialOpts,
+			Metadata:        md,
+			AppMetadata:     am,
+			Host:            host,
+			OutputId:        c.Id,
+			Pool:            plugin.NewConnPool(),
+		}
+		w, err := newWriter(&c, c.Metrics, urls, strategy, func(url string) (plugin.RecordWriter, error) {
+			ecfg := cfg
+			if len(urls) > 1 {
+				ecfg.Metrics = c.Metrics.ForEndpoint(url)
+			}
+			fltSvc, err := plugin.NewFlightService(url, s, ecfg)
+			if err != nil {
+				return nil, err
+			}
+			// endpoints opened later start from the schema of the first
+			if s == nil {
+				s = fltSvc.Schema
+			}
+			return fltSvc, nil
+		})
+		if err != nil {
+			return &plugin.PluginContext{}, err
+		}
+		c.FlightSvc = w
+
+		// partitions stream below the descriptor of the output, kinds at
+		// their own descriptor, sharing its connections
+		pm := c.Metrics.ForPartition()
+		prefix := desc.Path
+		if kinds != nil {
+			prefix = nil
+		}
+		c.NewPartitionWriter = func(path []string, schema *arrow.Schema) (plugin.RecordWriter, error) {
+			pcfg := cfg
+			pcfg.Metrics = pm
+			pcfg.FetchSchema = false
+			pcfg.SchemaCacheFile = ""
+			pcfg.Descriptor = &flight.FlightDescriptor{
+				Type: flight.DescriptorPATH,
+				Path: append(append([]string(nil), prefix...), path...),
+			}
+			return newWriter(&c, pm, urls, strategy, func(url string) (plugin.RecordWriter, error) {
+				return plugin.NewFlightService(url, schema, pcfg)
+			})
+		}
+		// with Rollup_Mode both the rollup rows have a stream of their own
+		if c.Rollup != nil && rollupMode == plugin.RollupBoth {
+			rdesc := &flight.FlightDescriptor{
+				Type: flight.DescriptorPATH,
+				Path: append(append([]string(nil), desc.Path...), "rollup"),
+			}
+			if rd := output.FLBPluginConfigKey(ctx, RollupDescriptor); rd != "" {
+				rdesc.Path = strings.Split(strings.Trim(rd, "/"), "/")
+			}
+			rm := c.Metrics.ForPartition()
+			c.NewRollupWriter = func(schema *arrow.Schema) (plugin.RecordWriter, error) {
+				rcfg := cfg
+				rcfg.Metrics = rm
+				rcfg.FetchSchema = false
+				rcfg.SchemaCacheFile = ""
+				rcfg.Descriptor = rdesc
+				return newWriter(&c, rm, urls, strategy, func(url string) (plugin.RecordWriter, error) {
+					return plugin.NewFlightService(url, schema, rcfg)
+				})
+			}
+		}
+		if source == SchemaSourceFlight {
+			if err := validateSchema(fs, s, nil, nil, c.TimeFields); err != nil {
+				c.Close()
+				return &plugin.PluginContext{}, err
+			}
+		}
+	case IngestModeFlightSql:
+		if source == SchemaSourceFlight {
+			return &plugin.PluginContext{}, fmt.Errorf("%s %s requires %s %s", SchemaSource, source, IngestMode, IngestModeDoPut)
+		}
+		if c.Rollup != nil && rollupMode == plugin.RollupBoth {
+			return &plugin.PluginContext{}, fmt.Errorf("%s %s requires %s %s", RollupMode, rollupMode, IngestMode, IngestModeDoPut)
+		}
+		table := output.FLBPluginConfigKey(ctx, FlightSqlTable)
+		if table == "" {
+			return &plugin.PluginContext{}, fmt.Errorf(errMsg, FlightSqlTable)
+		}
+		create := isTrue(output.FLBPluginConfigKey(ctx, FlightSqlCreateTable))
+		w, err := newWriter(&c, c.Metrics, urls, strategy, func(url string) (plugin.RecordWriter, error) {
+			return plugin.NewFlightSQLService(url, table, create, s, grpcCfg, dialOpts...)
+		})
+		if err != nil {
+			return &plugin.PluginContext{}, err
+		}
+		c.FlightSvc = w
+	default:
+		return &plugin.PluginContext{}, fmt.Errorf("unsupported %s [%s]", IngestMode, mode)
+	}
+
+	// Debug: print schema and fields in it.
+	if c.Logger.Enabled(flblog.LevelDebug) {
+		for _, f := range s.Fields() {
+			c.Logger.Debug("schema field", "column", f.Name, "type", f.Type)
+		}
+	}
+
+	// the schema fetched from the server is that of the records
+	if input == nil {
+		input = s
+	}
+
+	// Extra_Fields_Column, a map<utf8, utf8> or utf8 column of the records
+	// collecting the keys without a column of their own
+	if ef := output.FLBPluginConfigKey(ctx, ExtraFieldsColumn); ef != "" {
+		if _, ok := input.FieldsByName(ef); !ok {
+			c.Close()
+			return &plugin.PluginContext{}, fmt.Errorf("invalid %s: column [%s] is not in the schema", ExtraFieldsColumn, ef)
+		}
+		c.ExtraFieldsColumn = ef
+	}
+
+	// Set schema and create the converter for it
+	if err := c.SetSchema(s); err != nil {
+		c.Close()
+		return &plugin.PluginContext{}, err
+	}
+
+	// Metadata_Fields, same format as Time_Fields with the column name in
+	// place of the format: "<metadata_key>=<column>,<metadata_key>". A key
+	// without column is stored in the column of the same name.
+	if mf := output.FLBPluginConfigKey(ctx, MetadataFields); mf != "" {
+		c.MetadataFields = make(map[string]string)
+		for _, entry := range splitList(mf) {
+			key, col, ok := strings.Cut(entry, "=")
+			if !ok {
+				col = key
+			}
+			key, col = strings.TrimSpace(key), strings.TrimSpace(col)
+			if _, ok := input.FieldsByName(col); !ok {
+				c.Close()
+				return &plugin.PluginContext{}, fmt.Errorf("invalid %s: column [%s] is not in the schema", MetadataFields, col)
+			}
+			c.MetadataFields[key] = col
+		}
+	}
+
+	// Dedup_Keys, Dedup_Window and Dedup_Max_Keys
+	if dk := output.FLBPluginConfigKey(ctx, DedupKeys); dk != "" {
+		if err := configureDedup(ctx, &c, dk, input); err != nil {
+			c.Close()
+			return &plugin.PluginContext{}, err
+		}
+	}
+
+	// Sort_Keys, the columns every batch is ordered by
+	if sk := output.FLBPluginConfigKey(ctx, SortKeys); sk != "" {
+		if c.SortKeys, err = convert.ParseSortKeys(sk, c.Schema); err != nil {
+			c.Close()
+			return &plugin.PluginContext{}, fmt.Errorf("invalid %s: %v", SortKeys, err)
+		}
+		if kinds != nil {
+			for _, k := range kinds.Kinds {
+				if _, err := convert.ParseSortKeys(sk, k.Schema); err != nil {
+					c.Close()
+					return &plugin.PluginContext{}, fmt.Errorf("invalid %s: %v", SortKeys, err)
+				}
+			}
+		}
+	}
+
+	// Partition_By and Partition_Idle_Timeout, each partition gets a stream
+	// of its own
+	if pb := output.FLBPluginConfigKey(ctx, PartitionBy); pb != "" {
+		if err := configurePartitions(ctx, &c, pb); err != nil {
+			c.Close()
+			return &plugin.PluginContext{}, err
+		}
+	}
+
+	if kinds != nil {
+		if err := configureKinds(ctx, &c, kinds); err != nil {
+			c.Close()
+			return &plugin.PluginContext{}, err
+		}
+	}
+
+	// 9) Spool_Path, every output spools below its own Id
+	interval := plugin.DefaultSpoolRetryInterval
+	if sp := output.FLBPluginConfigKey(ctx, SpoolPath); sp != "" {
+		if interval, err = configureSpool(ctx, &c, filepath.Join(sp, id)); err != nil {
+			c.Close()
+			return &plugin.PluginContext{}, err
+		}
+	} else if c.Rollup != nil && c.Rollup.Config.Interval < interval {
+		interval = c.Rollup.Config.Interval
+	}
+	// the spool is replayed and closed rollup windows are sent in the
+	// background too
+	if c.Spool != nil || c.Rollup != nil {
+		c.StartTimer(interval)
+	}
+
+	// 10) Metrics_Listen, optional Prometheus endpoint
+	if addr := output.FLBPluginConfigKey(ctx, MetricsListen); addr != "" {
+		if err := plugin.ServeMetrics(addr); err != nil {
+			c.Close()
+			return &plugin.PluginContext{}, err
+		}
+	}
 	return &c, nil
 }
 
-// Writes given string array as a Apache Arrow columnar array
-func (p FluentArrowPlugin) WriteString(pluginId string, fieldName string, values []string, valid []bool) {
+// grpcConfig reads the Grpc_* options and Write_Timeout.
+func grpcConfig(ctx unsafe.Pointer) (plugin.GRPCConfig, error) {
+	var cfg plugin.GRPCConfig
+	var err error
+	if cfg.KeepaliveTime, err = parseDuration(output.FLBPluginConfigKey(ctx, GrpcKeepaliveTime)); err != nil {
+		return cfg, fmt.Errorf("invalid %s: %v", GrpcKeepaliveTime, err)
+	}
+	if cfg.KeepaliveTimeout, err = parseDuration(output.FLBPluginConfigKey(ctx, GrpcKeepaliveTimeout)); err != nil {
+		return cfg, fmt.Errorf("invalid %s: %v", GrpcKeepaliveTimeout, err)
+	}
+	if cfg.MaxSendMsgSize, err = parseSize(output.FLBPluginConfigKey(ctx, GrpcMaxSendMsgSize)); err != nil {
+		return cfg, fmt.Errorf("invalid %s: %v", GrpcMaxSendMsgSize, err)
+	}
+	if cfg.WriteTimeout, err = parseDuration(output.FLBPluginConfigKey(ctx, WriteTimeout)); err != nil {
+		return cfg, fmt.Errorf("invalid %s: %v", WriteTimeout, err)
+	}
+	if c := strings.ToLower(output.FLBPluginConfigKey(ctx, GrpcCompression)); c != "none" {
+		cfg.Compression = c
+	}
+	cfg.UserAgent = output.FLBPluginConfigKey(ctx, GrpcUserAgent)
+
+	// Grpc_Headers has the same format as Time_Fields, "<name>=<value>,<name>=<value>"
+	if hs := output.FLBPluginConfigKey(ctx, GrpcHeaders); hs != "" {
+		cfg.Headers = make(map[string]string)
+		for _, split := range strings.Split(hs, ",") {
+			if strings.TrimSpace(split) == "" {
+				continue
+			}
+			mapping := strings.SplitN(split, "=", 2)
+			if len(mapping) != 2 {
+				return cfg, fmt.Errorf("invalid %s entry [%s]", GrpcHeaders, split)
+			}
+			cfg.Headers[strings.ToLower(strings.TrimSpace(mapping[0]))] = strings.TrimSpace(mapping[1])
+		}
+	}
+	return cfg, cfg.Validate()
+}
+
+// newWriter opens the writer of a single endpoint, or Endpoints spreading
+// the records over several with strategy.
+func newWriter(c *plugin.PluginContext, m *plugin.Metrics, urls []string, strategy string, open func(url string) (plugin.RecordWriter, error)) (plugin.RecordWriter, error) {
+	if len(urls) == 1 {
+		return open(urls[0])
+	}
+	return plugin.NewEndpoints(urls, strategy, c.RequireAck, open, m, c.Logger)
+}
+
+// schemaMetadata returns the metadata added to the schema message of the
+// DoPut streams: the "<key>=<value>" pairs of Schema_Metadata and the runtime
+// values listed by Schema_Runtime_Metadata, all of them by default.
+func schemaMetadata(ctx unsafe.Pointer, id string) (*plugin.SchemaMetadata, error) {
+	var keys, vals []string
+	for _, e := range splitList(output.FLBPluginConfigKey(ctx, SchemaMetadata)) {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid %s entry [%s]", SchemaMetadata, e)
+		}
+		keys, vals = append(keys, strings.TrimSpace(kv[0])), append(vals, strings.TrimSpace(kv[1]))
+	}
+
+	md := &plugin.SchemaMetadata{}
+	rt := output.FLBPluginConfigKey(ctx, SchemaRuntimeMetadata)
+	if rt == "" {
+		rt = "hostname,id,version,fingerprint"
+	}
+	if strings.ToLower(rt) != "none" {
+		for _, e := range splitList(rt) {
+			switch strings.ToLower(e) {
+			case "hostname":
+				host, err := os.Hostname()
+				if err != nil {
+					return nil, fmt.Errorf("invalid %s: %v", SchemaRuntimeMetadata, err)
+				}
+				keys, vals = append(keys, plugin.MetadataHostname), append(vals, host)
+			case "id":
+				keys, vals = append(keys, plugin.MetadataOutputId), append(vals, id)
+			case "version":
+				// Fluent Bit does not pass its version to Go plugins, it
+				// has to be provided by the environment
+				if v := os.Getenv("FLUENT_BIT_VERSION"); v != "" {
+					keys, vals = append(keys, plugin.MetadataVersion), append(vals, v)
+				}
+			case "fingerprint":
+				md.Fingerprint = true
+			default:
+				return nil, fmt.Errorf("unsupported %s [%s]", SchemaRuntimeMetadata, e)
+			}
+		}
+	}
+	md.Pairs = arrow.NewMetadata(keys, vals)
+	return md, nil
+}
+
+// configureDedup drops duplicates of the comma separated columns of schema
+// in keys within Dedup_Window and Dedup_Max_Keys.
+func configureDedup(ctx unsafe.Pointer, c *plugin.PluginContext, keys string, schema *arrow.Schema) error {
+	var cols []string
+	for _, k := range strings.Split(keys, ",") {
+		if k = strings.TrimSpace(k); k == "" {
+			continue
+		}
+		if _, ok := schema.FieldsByName(k); !ok {
+			return fmt.Errorf("invalid %s: column [%s] is not in the schema", DedupKeys, k)
+		}
+		cols = append(cols, k)
+	}
+	window, err := parseDuration(output.FLBPluginConfigKey(ctx, DedupWindow))
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", DedupWindow, err)
+	}
+	var max int
+	if v := output.FLBPluginConfigKey(ctx, DedupMaxKeys); v != "" {
+		if max, err = strconv.Atoi(v); err != nil || max <= 0 {
+			return fmt.Errorf("invalid %s [%s]", DedupMaxKeys, v)
+		}
+	}
+	d, err := plugin.NewDeduplicator(cols, window, max)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", DedupKeys, err)
+	}
+	c.Dedup = d
+	return nil
+}
+
+// rollupConfig reads the Rollup_* options for records of schema, interval
+// is the value of Rollup_Interval.
+func rollupConfig(ctx unsafe.Pointer, interval string, schema *arrow.Schema, timeFields map[string]string) (*plugin.Rollup, error) {
+	var cfg plugin.RollupConfig
+	var err error
+	if cfg.Interval, err = parseDuration(interval); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", RollupInterval, err)
+	}
+	if cfg.Delay, err = parseDuration(output.FLBPluginConfigKey(ctx, RollupDelay)); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", RollupDelay, err)
+	}
+	cfg.Dimensions = splitList(output.FLBPluginConfigKey(ctx, RollupDimensions))
+	cfg.Measures = splitList(output.FLBPluginConfigKey(ctx, RollupMeasures))
+	cfg.Functions = splitList(strings.ToLower(output.FLBPluginConfigKey(ctx, RollupFunctions)))
+	cfg.TimeField = output.FLBPluginConfigKey(ctx, RollupTimeField)
+	return plugin.NewRollup(cfg, schema, timeFields)
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// configurePartitions sets up partitioning by spec with
+// Partition_Idle_Timeout, the ingest mode must support it.
+func configurePartitions(ctx unsafe.Pointer, c *plugin.PluginContext, spec string) error {
+	if c.NewPartitionWriter == nil {
+		return fmt.Errorf("%s requires %s %s", PartitionBy, IngestMode, IngestModeDoPut)
+	}
+	p, err := plugin.NewPartitioner(spec, c.Schema, c.TimeFields)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", PartitionBy, err)
+	}
+	idle, err := parseDuration(output.FLBPluginConfigKey(ctx, PartitionIdleTimeout))
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", PartitionIdleTimeout, err)
+	}
+	if idle == 0 {
+		idle = plugin.DefaultPartitionIdleTimeout
+	}
+	c.Partitioner = p
+	c.PartitionIdleTimeout = idle
+	return nil
+}
 
-	p.contexts[pluginId].Builder.FieldIndex[fieldName].(*array.StringBuilder).AppendValues(values, valid)
+// configureKinds routes the records of kinds to their streams, closed after
+// Partition_Idle_Timeout like partitions. The ingest mode must support it.
+func configureKinds(ctx unsafe.Pointer, c *plugin.PluginContext, kinds *plugin.Kinds) error {
+	if c.NewPartitionWriter == nil {
+		return fmt.Errorf("%s requires %s %s", SchemaMap, IngestMode, IngestModeDoPut)
+	}
+	if c.Partitioner != nil {
+		return fmt.Errorf("%s cannot be combined with %s", PartitionBy, SchemaMap)
+	}
+	idle, err := parseDuration(output.FLBPluginConfigKey(ctx, PartitionIdleTimeout))
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", PartitionIdleTimeout, err)
+	}
+	if idle == 0 {
+		idle = plugin.DefaultPartitionIdleTimeout
+	}
+	c.Kinds = kinds
+	c.PartitionIdleTimeout = idle
+	if err := c.CheckKinds(); err != nil {
+		return fmt.Errorf("invalid %s: %v", SchemaMap, err)
+	}
+	return nil
 }
 
-// Writes given int64 array as a Apache Arrow columnar array
-func (p FluentArrowPlugin) WriteInt64(pluginId string, fieldName string, values []int64, valid []bool) {
-	//pick the correct builder and append value to the field
-	p.contexts[pluginId].Builder.FieldIndex[fieldName].(*array.Int64Builder).AppendValues(values, valid)
+// configureSpool opens the spool in dir with the Spool_* options and returns
+// the interval it is replayed at.
+func configureSpool(ctx unsafe.Pointer, c *plugin.PluginContext, dir string) (time.Duration, error) {
+	size, err := parseSize(output.FLBPluginConfigKey(ctx, SpoolMaxSize))
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", SpoolMaxSize, err)
+	}
+	age, err := parseDuration(output.FLBPluginConfigKey(ctx, SpoolMaxAge))
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", SpoolMaxAge, err)
+	}
+	interval, err := parseDuration(output.FLBPluginConfigKey(ctx, SpoolRetryInterval))
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", SpoolRetryInterval, err)
+	}
+	if interval <= 0 {
+		interval = plugin.DefaultSpoolRetryInterval
+	}
+
+	spool, err := plugin.OpenSpool(dir, plugin.SpoolConfig{
+		MaxSize:  size,
+		MaxAge:   age,
+		Overflow: strings.ToLower(output.FLBPluginConfigKey(ctx, SpoolOverflow)),
+		Metrics:  c.Metrics,
+		Logger:   c.Logger,
+	}, c.Memory)
+	if err != nil {
+		return 0, err
+	}
+	if n := spool.Len(); n > 0 {
+		c.Logger.Info("spooled record batches found", "dir", dir, "batches", n, "bytes", spool.Size())
+	}
+	c.Spool = spool
+	return interval, nil
 }
 
-// Writes given uint64 array as a Apache Arrow columnar array
-func (p FluentArrowPlugin) WriteUInt64(pluginId string, fieldName string, values []uint64, valid []bool) {
-	//pick the correct builder and append value to the field
-	p.contexts[pluginId].Builder.FieldIndex[fieldName].(*array.Uint64Builder).AppendValues(values, valid)
+// isTrue reports whether a configuration value is one of Fluent Bit's truthy strings
+func isTrue(v string) bool {
+	switch strings.ToLower(v) {
+	case "true", "on", "yes", "1":
+		return true
+	}
+	return false
 }
 
-// Writes given int32 array as a Apache Arrow columnar array
-func (p FluentArrowPlugin) WriteInt32(pluginId string, fieldName string, values []int32, valid []bool) {
-	//pick the correct builder and append value to the field
-	p.contexts[pluginId].Builder.FieldIndex[fieldName].(*array.Int32Builder).AppendValues(values, valid)
+// parseDuration accepts Go duration strings ("1m30s") as well as a plain
+// number of seconds, an empty value yields zero.
+func parseDuration(v string) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	return time.ParseDuration(v)
 }
 
-// Writes given float64 array as a Apache Arrow columnar array
-func (p FluentArrowPlugin) WriteFloat64(pluginId string, fieldName string, values []float64, valid []bool) {
-	//pick the correct builder and append value to the field
-	p.contexts[pluginId].Builder.FieldIndex[fieldName].(*array.Float64Builder).AppendValues(values, valid)
+// parseSize accepts a number of bytes with an optional K, M or G suffix,
+// optionally followed by B, like Fluent Bit's size options. An empty value
+// yields zero.
+func parseSize(v string) (int64, error) {
+	v = strings.ToUpper(strings.TrimSpace(v))
+	if v == "" {
+		return 0, nil
+	}
+	v = strings.TrimSuffix(v, "B")
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(v, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(v, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(v, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		v = v[:len(v)-1]
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size [%s]", v)
+	}
+	return n * mult, nil
 }
 
-// Writes given float32 array as a Apache Arrow columnar array
-func (p FluentArrowPlugin) WriteFloat32(pluginId string, fieldName string, values []float32, valid []bool) {
-	//pick the correct builder and append value to the field
-	p.contexts[pluginId].Builder.FieldIndex[fieldName].(*array.Float32Builder).AppendValues(values, valid)
+// Reads a file and parses its content as Arrow Schema. Problems with the
+// content are returned as issues, the schema then only holds the fields that
+// could be decoded and is nil if there are none.
+func parseSchema(file string) (*arrow.Schema, *arrowschema.Document, []arrowschema.Issue, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error reading schema file %s: %w", file, err)
+	}
+
+	doc, issues := arrowschema.DecodeDocument(data)
+	if doc == nil || doc.Schema == nil {
+		return nil, doc, issues, nil
+	}
+	// doc.Schema keeps the schema and field metadata of the file
+	return doc.Schema, doc, issues, nil
 }
 
-// Writes given arrow timestamp array as a Apache Arrow columnar array
-func (p FluentArrowPlugin) WriteTimeStamp(pluginId string, fieldName string, values []arrow.Timestamp, valid []bool) {
-	p.contexts[pluginId].Builder.FieldIndex[fieldName].(*array.TimestampBuilder).AppendValues(values, valid)
+// schemaMapDoc is the content of a Schema_Map file. Kinds are tried in
+// order, a kind matches on the value of Field or on the tag of the record.
+// Relative schema files are relative to the Schema_Map file.
+type schemaMapDoc struct {
+	Field string `json:"field"`
+	Kinds []struct {
+		Value      string `json:"value"`
+		Tag        string `json:"tag"`
+		SchemaFile string `json:"schema_file"`
+		Descriptor string `json:"descriptor"`
+	} `json:"kinds"`
 }
 
-// Reads a file and parses its content as Arrow Schema
-func parseSchema(file string) (*arrow.Schema, error) {
-	f, err := os.Open(file)
+// parseSchemaMap reads a Schema_Map file and the schema files of its kinds.
+func parseSchemaMap(file string, timeFields map[string]string) (*plugin.Kinds, error) {
+	data, err := os.ReadFile(file)
 	if err != nil {
-		return nil, fmt.Errorf("error reading schema file %s", f)
+		return nil, fmt.Errorf("error reading schema map %s: %w", file, err)
+	}
+	var doc schemaMapDoc
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid schema map %s: %v", file, err)
 	}
 
-	dec := json.NewDecoder(f)
-	var s arrowschema.PayloadSchema
-	err = dec.Decode(&s)
+	kinds := make([]plugin.Kind, 0, len(doc.Kinds))
+	for i, k := range doc.Kinds {
+		if k.SchemaFile == "" {
+			return nil, fmt.Errorf("invalid schema map %s: kind #%d has no schema_file", file, i+1)
+		}
+		sf := k.SchemaFile
+		if !filepath.IsAbs(sf) {
+			sf = filepath.Join(filepath.Dir(file), sf)
+		}
+		s, sdoc, issues, err := parseSchema(sf)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateSchema(sf, s, sdoc, issues, timeFields); err != nil {
+			return nil, err
+		}
+		kind := plugin.Kind{Value: k.Value, TagPattern: k.Tag, Schema: s}
+		if d := strings.Trim(k.Descriptor, "/"); d != "" {
+			kind.Path = strings.Split(d, "/")
+		}
+		kinds = append(kinds, kind)
+	}
+	ks, err := plugin.NewKinds(doc.Field, kinds)
 	if err != nil {
-		return nil, fmt.Errorf("error decoding schema file %s \n %s", f, err.Error())
+		return nil, fmt.Errorf("invalid schema map %s: %v", file, err)
 	}
+	return ks, nil
+}
 
-	schema := arrow.NewSchema(
-		arrowschema.SchemaFromJSON(s.ArrowSchema, nil).Fields(),
-		nil,
-	)
-	return schema, nil
+// validateSchema aggregates the issues found while parsing the schema with
+// those of plugin.ValidateSchema into a single error.
+func validateSchema(source string, s *arrow.Schema, doc *arrowschema.Document, issues []arrowschema.Issue, timeFields map[string]string) error {
+	issues = append(issues, plugin.ValidateSchema(s, timeFields, doc)...)
+	if len(issues) > 0 {
+		return &arrowschema.SchemaError{Source: source, Issues: issues}
+	}
+	return nil
 }
 
 // Fluentbit's Internal Golang functions
 
 //export FLBPluginRegister
 func FLBPluginRegister(def unsafe.Pointer) int {
-	log.Printf("registering output plugin: [%s]", PluginName)
+	logger.Info("registering output plugin", "name", PluginName)
 	return output.FLBPluginRegister(def, PluginName, Desc)
 }
 
@@ -202,8 +925,8 @@ func FLBPluginRegister(def unsafe.Pointer) int {
 func FLBPluginInit(ctx unsafe.Pointer) int {
 	c, err := arrowPlugin.Create(ctx)
 	if err != nil {
-		log.Fatalf("%v\n", err)
-		return FLBPluginExit()
+		logger.Error("failed to initialize output", "error", err)
+		return output.FLB_ERROR
 	}
 
 	arrowPlugin.(FluentArrowPlugin).contexts[c.Id] = c
@@ -214,70 +937,22 @@ func FLBPluginInit(ctx unsafe.Pointer) int {
 //export FLBPluginFlushCtx
 func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int {
 	id := output.FLBPluginGetContext(ctx).(string)
-	dec := output.NewDecoder(data, int(length))
-	for {
-		ret, _, record := output.GetRecord(dec)
-		if ret != 0 {
-			break
-		}
-
-		for k, v := range record {
-			key := k.(string)
-			// process only if the fields are present in the arrow schema for the plugin
-			if _, ok := arrowPlugin.(FluentArrowPlugin).contexts[id].Builder.FieldIndex[key]; ok {
-				switch v := v.(type) {
-				case []uint8:
-					strVal := string(v)
-					if dateFormat, ok := arrowPlugin.(FluentArrowPlugin).contexts[id].TimeFields[key]; ok {
-						t, err := timefmt.Parse(strVal, dateFormat)
-						if err != nil {
-							log.Printf("failed to parse date %s using format %s", strVal, dateFormat)
-							//return output.FLB_ERROR
-						}
-						int64Val := t.Unix()
-						log.Printf("ctx= %s, got int64 value for key=%s value=%d", id, key, int64Val)
-						arrowPlugin.WriteTimeStamp(id, key, []arrow.Timestamp{arrow.Timestamp(int64Val)}, []bool{true})
-						//z, o := t.Zone()
-					} else {
-						log.Printf("ctx= %s, got string value for key=%s value=%s", id, key, strVal)
-						arrowPlugin.WriteString(id, key, []string{strVal}, []bool{true})
-					}
-				case float64:
-					flt64Val := v
-					log.Printf("ctx= %s, got float value for key=%s value=%f", id, key, flt64Val)
-					arrowPlugin.WriteFloat64(id, key, []float64{flt64Val}, []bool{true})
-				case int:
-					intVal := v
-					log.Printf("ctx= %s, got int value for key=%s value=%d", id, key, intVal)
-					arrowPlugin.WriteInt64(id, key, []int64{int64(intVal)}, []bool{true})
-				case int64:
-					intVal := v
-					log.Printf("ctx= %s, got int64 value for key=%s value=%d", id, key, intVal)
-					arrowPlugin.WriteInt64(id, key, []int64{intVal}, []bool{true})
-				case nil:
-					strVal := ""
-					log.Printf("ctx= %s, got nil value for key=%s value=%f", id, key, strVal)
-				default:
-					strVal := fmt.Sprintf("%v", v)
-					log.Printf("ctx= %s, got default value for key=%s value=%f", id, key, strVal)
-				}
-			}
-		}
-
-		arrowPlugin.(FluentArrowPlugin).contexts[id].RecordBatchCount++
-		if arrowPlugin.(FluentArrowPlugin).contexts[id].RecordBatchCount > arrowPlugin.(FluentArrowPlugin).contexts[id].RecordBatchThreshold {
-			//call make record and flush
-			r := arrowPlugin.(FluentArrowPlugin).contexts[id].Builder.RecordBuilder.NewRecord()
-			defer r.Release()
-			arrowPlugin.(FluentArrowPlugin).contexts[id].FlightSvc.Write(r)
-			arrowPlugin.(FluentArrowPlugin).contexts[id].RecordBatchCount = 0
-		}
+	c := arrowPlugin.(FluentArrowPlugin).contexts[id]
+	if err := c.Deliver(C.GoBytes(data, length), C.GoString(tag)); err != nil {
+		return output.FLB_RETRY
 	}
 	return output.FLB_OK
 }
 
+//export FLBPluginExit
 func FLBPluginExit() int {
-	log.Printf("[%s] [info] exit", PluginName)
+	logger.Info("exit")
+	for id, c := range arrowPlugin.(FluentArrowPlugin).contexts {
+		if err := c.Close(); err != nil {
+			c.Logger.Error("failed to close output", "error", err)
+		}
+		delete(arrowPlugin.(FluentArrowPlugin).contexts, id)
+	}
 	return output.FLB_OK
 }
 
@@ -0,0 +1,230 @@
+// Package convert turns Fluent Bit records into Arrow record batches.
+//
+// It has no dependency on Fluent Bit or cgo: records are either decoded from
+// the msgpack chunks Fluent Bit hands to output plugins, see Decoder and
+// Convert, or appended one by one with Append.
+package convert
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+	"github.com/apache/arrow/go/v12/arrow/memory"
+)
+
+// Config controls how records are converted.
+type Config struct {
+	// TimeFields maps timestamp columns to the strptime format of their
+	// string values, columns without an entry accept RFC 3339 strings.
+	TimeFields map[string]string
+	// BatchSize is the number of rows after which a record batch is sealed,
+	// zero only seals on Flush.
+	BatchSize int
+	// Allocator is used for the Arrow buffers, memory.DefaultAllocator if nil.
+	Allocator memory.Allocator
+	// OnError is called for every value that could not be converted.
+	OnError func(err *ValueError)
+	// ExtraColumn, if the schema has it, collects the keys of a record
+	// that have no column of their own. A map<utf8, utf8> column gets them
+	// as entries, a utf8 column as a JSON object.
+	ExtraColumn string
+}
+
+var errNotNullable = errors.New("column is not nullable")
+
+type column struct {
+	field  arrow.Field
+	b      array.Builder
+	append appender
+}
+
+// Converter appends records to the columns of an Arrow schema and seals
+// them into record batches. It is not safe for concurrent use.
+type Converter struct {
+	schema  *arrow.Schema
+	cfg     Config
+	b       *array.RecordBuilder
+	columns []column
+	index   map[string]int
+	// extra is the index of Config.ExtraColumn, -1 without it
+	extra   int
+	pending int
+}
+
+// New returns a Converter for schema. Every field must have a type
+// SupportedType accepts.
+func New(schema *arrow.Schema, cfg Config) (*Converter, error) {
+	if cfg.Allocator == nil {
+		cfg.Allocator = memory.DefaultAllocator
+	}
+	b := array.NewRecordBuilder(cfg.Allocator, schema)
+	c := &Converter{
+		schema:  schema,
+		cfg:     cfg,
+		b:       b,
+		columns: make([]column, len(schema.Fields())),
+		index:   make(map[string]int, len(schema.Fields())),
+		extra:   -1,
+	}
+	for i, f := range schema.Fields() {
+		app, err := newAppender(f.Type, b.Field(i), cfg.TimeFields[f.Name])
+		if err != nil {
+			b.Release()
+			return nil, fmt.Errorf("field %s: %w", f.Name, err)
+		}
+		c.columns[i] = column{field: f, b: b.Field(i), append: app}
+		if cfg.ExtraColumn != "" && f.Name == cfg.ExtraColumn {
+			switch {
+			case isTextMap(f.Type), f.Type.ID() == arrow.STRING, f.Type.ID() == arrow.LARGE_STRING:
+				c.extra = i
+				continue
+			}
+			b.Release()
+			return nil, fmt.Errorf("extra fields column %s must be map<utf8, utf8> or utf8, not %s", f.Name, f.Type)
+		}
+		c.index[f.Name] = i
+	}
+	return c, nil
+}
+
+// Schema returns the schema of the record batches.
+func (c *Converter) Schema() *arrow.Schema { return c.schema }
+
+// Pending returns the number of rows appended but not sealed yet.
+func (c *Converter) Pending() int { return c.pending }
+
+// Append adds record as a row, keys not present in the schema are ignored
+// unless there is an ExtraColumn, and columns missing from record are null.
+// ts is the Fluent Bit timestamp of the record. It returns the sealed record
+// batch once BatchSize rows are pending, nil otherwise; the caller must
+// release it.
+func (c *Converter) Append(ts time.Time, record map[interface{}]interface{}) arrow.Record {
+	seen := make([]bool, len(c.columns))
+	var extra map[interface{}]interface{}
+	for k, v := range record {
+		var key string
+		switch k := k.(type) {
+		case string:
+			key = k
+		case []byte:
+			key = string(k)
+		default:
+			continue
+		}
+		i, ok := c.index[key]
+		if !ok && c.extra >= 0 {
+			if extra == nil {
+				extra = make(map[interface{}]interface{})
+			}
+			extra[key] = v
+		}
+		if !ok || seen[i] {
+			continue
+		}
+		seen[i] = true
+		c.appendValue(&c.columns[i], v)
+	}
+	if len(extra) > 0 {
+		c.appendExtra(extra)
+		seen[c.extra] = true
+	}
+	for i := range c.columns {
+		if !seen[i] {
+			c.appendNull(&c.columns[i], ReasonMissing)
+		}
+	}
+
+	c.pending++
+	if c.cfg.BatchSize > 0 && c.pending >= c.cfg.BatchSize {
+		return c.Flush()
+	}
+	return nil
+}
+
+// appendExtra appends the keys without a column to the ExtraColumn.
+func (c *Converter) appendExtra(extra map[interface{}]interface{}) {
+	col := &c.columns[c.extra]
+	if isTextMap(col.field.Type) {
+		c.appendValue(col, extra)
+		return
+	}
+	s, err := JSON(extra)
+	if err != nil {
+		c.report(&ValueError{Column: col.field.Name, Reason: ReasonUnsupportedType, Value: extra, Err: err})
+		c.appendNull(col, "")
+		return
+	}
+	c.appendValue(col, s)
+}
+
+func (c *Converter) appendValue(col *column, v interface{}) {
+	if v == nil {
+		c.appendNull(col, ReasonNullValue)
+		return
+	}
+	if err := col.append(v); err != nil {
+		err.Column = col.field.Name
+		c.report(err)
+		c.appendNull(col, "")
+	}
+}
+
+// appendNull appends a null, or the zero value if the column is not
+// nullable, which is reported with reason.
+func (c *Converter) appendNull(col *column, reason string) {
+	if col.field.Nullable {
+		col.b.AppendNull()
+		return
+	}
+	if reason != "" {
+		c.report(&ValueError{Column: col.field.Name, Reason: reason, Err: errNotNullable})
+	}
+	col.b.AppendEmptyValue()
+}
+
+func (c *Converter) report(err *ValueError) {
+	if c.cfg.OnError != nil {
+		c.cfg.OnError(err)
+	}
+}
+
+// Flush seals the pending rows into a record batch, or returns nil if there
+// are none. The caller must release it.
+func (c *Converter) Flush() arrow.Record {
+	if c.pending == 0 {
+		return nil
+	}
+	c.pending = 0
+	return c.b.NewRecord()
+}
+
+// Convert decodes a Fluent Bit msgpack chunk and appends all of its records,
+// returning the record batches sealed on the way. Pending rows are kept for
+// the next call unless Flush is called. On a decoding error the batches
+// sealed so far are returned with it.
+func (c *Converter) Convert(data []byte) ([]arrow.Record, error) {
+	var out []arrow.Record
+	dec := NewDecoder(data)
+	for {
+		ts, record, err := dec.Next()
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return out, err
+		}
+		if r := c.Append(ts, record); r != nil {
+			out = append(out, r)
+		}
+	}
+}
+
+// Release frees the pending rows and the builders.
+func (c *Converter) Release() {
+	c.b.Release()
+	c.pending = 0
+}
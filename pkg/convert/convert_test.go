@@ -0,0 +1,259 @@
+package convert_test
+
+import (
+	"io"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/anaray/fluent-bit-arrow-plugin/pkg/convert"
+	"github.com/anaray/fluent-bit-arrow-plugin/pkg/convert/convtest"
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+	"github.com/apache/arrow/go/v12/arrow/memory"
+)
+
+// run converts entries with a checked allocator and returns the single
+// record batch and the reported errors by column. The batch is released and
+// the allocator checked at the end of the test.
+func run(t *testing.T, schema *arrow.Schema, cfg convert.Config, entries ...convtest.Entry) (arrow.Record, map[string]string) {
+	t.Helper()
+	mem := memory.NewCheckedAllocator(memory.NewGoAllocator())
+	errs := make(map[string]string)
+	cfg.Allocator = mem
+	cfg.OnError = func(err *convert.ValueError) { errs[err.Column] = err.Reason }
+	recs, err := convtest.Run(schema, cfg, entries...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 {
+		t.Fatalf("got %d record batches, want 1", len(recs))
+	}
+	t.Cleanup(func() {
+		recs[0].Release()
+		mem.AssertSize(t, 0)
+	})
+	return recs[0], errs
+}
+
+func field(name string, dt arrow.DataType, nullable bool) arrow.Field {
+	return arrow.Field{Name: name, Type: dt, Nullable: nullable}
+}
+
+func entry(record map[string]interface{}) convtest.Entry {
+	return convtest.Entry{Time: time.Unix(1700000000, 0), Record: record}
+}
+
+func TestCoercion(t *testing.T) {
+	schema := arrow.NewSchema([]arrow.Field{
+		field("I8", arrow.PrimitiveTypes.Int8, true),
+		field("U8", arrow.PrimitiveTypes.Uint8, true),
+		field("I64", arrow.PrimitiveTypes.Int64, true),
+		field("F64", arrow.PrimitiveTypes.Float64, true),
+		field("S", arrow.BinaryTypes.String, true),
+		field("B", arrow.FixedWidthTypes.Boolean, true),
+	}, nil)
+	r, errs := run(t, schema, convert.Config{},
+		entry(map[string]interface{}{"I8": -5, "U8": "200", "I64": "42", "F64": "2.5", "S": 7, "B": "true"}),
+		entry(map[string]interface{}{"I8": 300, "U8": -1, "I64": 1.5, "F64": 3, "S": true, "B": "nope"}),
+	)
+
+	i8 := r.Column(0).(*array.Int8)
+	u8 := r.Column(1).(*array.Uint8)
+	i64 := r.Column(2).(*array.Int64)
+	f64 := r.Column(3).(*array.Float64)
+	s := r.Column(4).(*array.String)
+	b := r.Column(5).(*array.Boolean)
+	if i8.Value(0) != -5 || u8.Value(0) != 200 || i64.Value(0) != 42 || f64.Value(0) != 2.5 || s.Value(0) != "7" || !b.Value(0) {
+		t.Errorf("first row converted to %v %v %v %v %q %v", i8.Value(0), u8.Value(0), i64.Value(0), f64.Value(0), s.Value(0), b.Value(0))
+	}
+	if f64.Value(1) != 3 || s.Value(1) != "true" {
+		t.Errorf("second row converted to %v %q", f64.Value(1), s.Value(1))
+	}
+	for col, reason := range map[string]string{"I8": convert.ReasonOverflow, "U8": convert.ReasonOverflow, "B": convert.ReasonTypeMismatch} {
+		if errs[col] != reason {
+			t.Errorf("column %s reported %q, want %q", col, errs[col], reason)
+		}
+		if !r.Column(schema.FieldIndices(col)[0]).IsNull(1) {
+			t.Errorf("column %s of the second row is not null", col)
+		}
+	}
+	if errs["I64"] == "" || !i64.IsNull(1) {
+		t.Errorf("float 1.5 in an int64 column converted to %v, reported %q", i64.Value(1), errs["I64"])
+	}
+}
+
+func TestOverflowBounds(t *testing.T) {
+	schema := arrow.NewSchema([]arrow.Field{
+		field("I16", arrow.PrimitiveTypes.Int16, true),
+		field("U64", arrow.PrimitiveTypes.Uint64, true),
+	}, nil)
+	r, errs := run(t, schema, convert.Config{},
+		entry(map[string]interface{}{"I16": math.MaxInt16, "U64": uint64(math.MaxUint64)}),
+		entry(map[string]interface{}{"I16": math.MinInt16 - 1, "U64": "18446744073709551616"}),
+	)
+	i16 := r.Column(0).(*array.Int16)
+	u64 := r.Column(1).(*array.Uint64)
+	if i16.Value(0) != math.MaxInt16 || u64.Value(0) != math.MaxUint64 {
+		t.Errorf("bounds converted to %v and %v", i16.Value(0), u64.Value(0))
+	}
+	if !i16.IsNull(1) || !u64.IsNull(1) {
+		t.Error("values beyond the bounds are not null")
+	}
+	if errs["I16"] != convert.ReasonOverflow {
+		t.Errorf("I16 reported %q, want %q", errs["I16"], convert.ReasonOverflow)
+	}
+	if errs["U64"] == "" {
+		t.Error("U64 beyond its bound not reported")
+	}
+}
+
+func TestTimeFields(t *testing.T) {
+	ts := &arrow.TimestampType{Unit: arrow.Millisecond}
+	schema := arrow.NewSchema([]arrow.Field{
+		field("FORMATTED", ts, true),
+		field("RFC3339", ts, true),
+	}, nil)
+	cfg := convert.Config{TimeFields: map[string]string{"FORMATTED": "%d/%m/%Y %H:%M:%S"}}
+	r, errs := run(t, schema, cfg,
+		entry(map[string]interface{}{"FORMATTED": "02/01/2023 03:04:05", "RFC3339": "2023-01-02T03:04:05.5Z"}),
+		entry(map[string]interface{}{"FORMATTED": 1672628645000, "RFC3339": 1672628645.25}),
+		entry(map[string]interface{}{"FORMATTED": "2023-01-02T03:04:05Z", "RFC3339": "02/01/2023"}),
+	)
+	want := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC).UnixMilli()
+	formatted := r.Column(0).(*array.Timestamp)
+	rfc := r.Column(1).(*array.Timestamp)
+	if got := int64(formatted.Value(0)); got != want {
+		t.Errorf("formatted time converted to %d, want %d", got, want)
+	}
+	if got := int64(rfc.Value(0)); got != want+500 {
+		t.Errorf("RFC 3339 time converted to %d, want %d", got, want+500)
+	}
+	if got := int64(formatted.Value(1)); got != want {
+		t.Errorf("integer converted to %d, want it as milliseconds %d", got, want)
+	}
+	if got := int64(rfc.Value(1)); got != want+250 {
+		t.Errorf("float converted to %d, want it as seconds %d", got, want+250)
+	}
+	if !formatted.IsNull(2) || !rfc.IsNull(2) {
+		t.Error("times not matching the format are not null")
+	}
+	if errs["FORMATTED"] != convert.ReasonTimeParse || errs["RFC3339"] != convert.ReasonTimeParse {
+		t.Errorf("reported %v, want %s for both columns", errs, convert.ReasonTimeParse)
+	}
+}
+
+func TestNullAndMissing(t *testing.T) {
+	schema := arrow.NewSchema([]arrow.Field{
+		field("OPT", arrow.PrimitiveTypes.Int32, true),
+		field("REQ", arrow.PrimitiveTypes.Int32, false),
+		field("REQ_S", arrow.BinaryTypes.String, false),
+	}, nil)
+	r, errs := run(t, schema, convert.Config{},
+		entry(map[string]interface{}{"OPT": nil, "REQ": nil, "IGNORED": 1}),
+	)
+	if !r.Column(0).IsNull(0) {
+		t.Error("nil in a nullable column is not null")
+	}
+	if r.Column(1).IsNull(0) || r.Column(1).(*array.Int32).Value(0) != 0 {
+		t.Error("nil in a non-nullable column is not the zero value")
+	}
+	if r.Column(2).IsNull(0) || r.Column(2).(*array.String).Value(0) != "" {
+		t.Error("missing non-nullable column is not the zero value")
+	}
+	want := map[string]string{"REQ": convert.ReasonNullValue, "REQ_S": convert.ReasonMissing}
+	if len(errs) != len(want) {
+		t.Errorf("reported %v, want %v", errs, want)
+	}
+	for col, reason := range want {
+		if errs[col] != reason {
+			t.Errorf("column %s reported %q, want %q", col, errs[col], reason)
+		}
+	}
+}
+
+func TestBatchSize(t *testing.T) {
+	schema := arrow.NewSchema([]arrow.Field{field("N", arrow.PrimitiveTypes.Int64, true)}, nil)
+	var entries []convtest.Entry
+	for i := 0; i < 5; i++ {
+		entries = append(entries, entry(map[string]interface{}{"N": i}))
+	}
+	recs, err := convtest.Run(schema, convert.Config{BatchSize: 2}, entries...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows []int64
+	for _, r := range recs {
+		rows = append(rows, r.NumRows())
+		r.Release()
+	}
+	if len(rows) != 3 || rows[0] != 2 || rows[1] != 2 || rows[2] != 1 {
+		t.Errorf("batches of %v rows, want [2 2 1]", rows)
+	}
+}
+
+func TestEventLayout(t *testing.T) {
+	at := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	data, err := convtest.Encode(
+		convtest.GroupStart(map[string]interface{}{"resource": "a"}),
+		convtest.Entry{Time: at, Record: map[string]interface{}{"MSG": "one"}, Metadata: map[string]interface{}{"trace_id": "t1"}},
+		convtest.Entry{Time: at.Add(time.Second), Record: map[string]interface{}{"MSG": "two"}, Metadata: map[string]interface{}{}},
+		convtest.GroupEnd(),
+		convtest.Entry{Time: at.Add(2 * time.Second), Record: map[string]interface{}{"MSG": "three"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dec := convert.NewDecoder(data)
+	var msgs []string
+	var times []time.Time
+	var traces []interface{}
+	for {
+		ts, record, err := dec.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, _ := convert.Text(record["MSG"])
+		msgs = append(msgs, msg)
+		times = append(times, ts)
+		var trace interface{}
+		if md := dec.Metadata(); md != nil {
+			trace = md["trace_id"]
+		}
+		if b, ok := trace.([]byte); ok {
+			trace = string(b)
+		}
+		traces = append(traces, trace)
+	}
+	if len(msgs) != 3 || msgs[0] != "one" || msgs[1] != "two" || msgs[2] != "three" {
+		t.Fatalf("decoded %v, want the three records without the markers", msgs)
+	}
+	for i, ts := range times {
+		if !ts.Equal(at.Add(time.Duration(i) * time.Second)) {
+			t.Errorf("record %d has time %s", i, ts)
+		}
+	}
+	if traces[0] != "t1" || traces[1] != nil || traces[2] != nil {
+		t.Errorf("decoded metadata %v", traces)
+	}
+
+	schema := arrow.NewSchema([]arrow.Field{field("MSG", arrow.BinaryTypes.String, false)}, nil)
+	c, err := convert.New(schema, convert.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Release()
+	recs, err := c.Convert(data)
+	if err != nil || len(recs) != 0 {
+		t.Fatalf("Convert returned %d batches, %v", len(recs), err)
+	}
+	r := c.Flush()
+	defer r.Release()
+	if r.NumRows() != 3 {
+		t.Errorf("converted %d rows, want 3", r.NumRows())
+	}
+}
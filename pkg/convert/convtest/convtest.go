@@ -0,0 +1,106 @@
+// Package convtest feeds records through package convert the way Fluent Bit
+// hands them to an output plugin, for use in tests of the conversion.
+//
+//	recs, err := convtest.Run(schema, convert.Config{BatchSize: 100},
+//		convtest.Entry{Time: now, Record: map[string]interface{}{"SENSOR_ID": "sensor01"}},
+//	)
+package convtest
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/anaray/fluent-bit-arrow-plugin/pkg/convert"
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/ugorji/go/codec"
+)
+
+// Entry is a record with its Fluent Bit timestamp. Record values may be
+// strings, numbers, booleans, nil and nested maps and slices of those.
+type Entry struct {
+	Time   time.Time
+	Record map[string]interface{}
+	// Metadata, when set, encodes the entry in the layout of Fluent Bit 2.1
+	// and later.
+	Metadata map[string]interface{}
+
+	// marker is the timestamp of a group marker, 0 for records
+	marker int64
+}
+
+// Timestamps of the group markers of Fluent Bit 2.1 and later.
+const (
+	groupStart = -1
+	groupEnd   = -2
+)
+
+// GroupStart returns the marker Fluent Bit 2.1 and later put before a group
+// of entries, attrs are the metadata of the group.
+func GroupStart(attrs map[string]interface{}) Entry {
+	if attrs == nil {
+		attrs = map[string]interface{}{}
+	}
+	return Entry{Metadata: attrs, Record: map[string]interface{}{}, marker: groupStart}
+}
+
+// GroupEnd returns the marker that ends a group of entries.
+func GroupEnd() Entry {
+	return Entry{Metadata: map[string]interface{}{}, Record: map[string]interface{}{}, marker: groupEnd}
+}
+
+// Encode returns entries as a msgpack chunk in Fluent Bit's format: one
+// [EventTime, map] array per entry, or [[EventTime, metadata], map] for
+// entries with Metadata and group markers, strings packed as str and
+// positive integers as unsigned, the way Fluent Bit packs them.
+func Encode(entries ...Entry) ([]byte, error) {
+	h := convert.Handle()
+	h.WriteExt = true
+	h.PositiveIntUnsigned = true
+	h.Canonical = true
+
+	var buf bytes.Buffer
+	enc := codec.NewEncoder(&buf, h)
+	for _, e := range entries {
+		var entry []interface{}
+		switch {
+		case e.marker != 0:
+			// the seconds of the EventTime wrap around like Fluent Bit's
+			entry = []interface{}{[]interface{}{convert.EventTime{Time: time.Unix(e.marker, 0)}, e.Metadata}, e.Record}
+		case e.Metadata != nil:
+			entry = []interface{}{[]interface{}{convert.EventTime{Time: e.Time}, e.Metadata}, e.Record}
+		default:
+			entry = []interface{}{convert.EventTime{Time: e.Time}, e.Record}
+		}
+		if err := enc.Encode(entry); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// Run converts entries with a new Converter for schema and returns every
+// record batch, including the one holding the rows still pending at the end.
+// The caller must release the records.
+func Run(schema *arrow.Schema, cfg convert.Config, entries ...Entry) ([]arrow.Record, error) {
+	data, err := Encode(entries...)
+	if err != nil {
+		return nil, err
+	}
+	c, err := convert.New(schema, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Release()
+
+	recs, err := c.Convert(data)
+	if err != nil {
+		for _, r := range recs {
+			r.Release()
+		}
+		return nil, err
+	}
+	if r := c.Flush(); r != nil {
+		recs = append(recs, r)
+	}
+	return recs, nil
+}
@@ -0,0 +1,228 @@
+package convert
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"strings"
+
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+)
+
+// Names of the extension types the converter fills, a schema refers to them
+// with the ARROW:extension:name metadata of a field.
+const (
+	UUIDExtensionName = "arrow.uuid"
+	JSONExtensionName = "arrow.json"
+	IPExtensionName   = "fluentbit.ip"
+)
+
+// The types are registered so that schemas referring to them, from a
+// Schema_File or the Flight server, are decoded with them. Registering fails
+// only for names already taken, columns of such types are not supported.
+func init() {
+	for _, t := range []arrow.ExtensionType{NewUUIDType(), NewJSONType(), NewIPType(16)} {
+		arrow.RegisterExtensionType(t)
+	}
+}
+
+// UUIDType is a UUID stored as fixed_size_binary(16). String values in any
+// of the forms of RFC 4122 are accepted.
+type UUIDType struct {
+	arrow.ExtensionBase
+}
+
+// NewUUIDType returns the UUID extension type.
+func NewUUIDType() *UUIDType {
+	return &UUIDType{ExtensionBase: arrow.ExtensionBase{Storage: &arrow.FixedSizeBinaryType{ByteWidth: 16}}}
+}
+
+func (*UUIDType) ArrayType() reflect.Type { return reflect.TypeOf(UUIDArray{}) }
+func (*UUIDType) ExtensionName() string   { return UUIDExtensionName }
+func (*UUIDType) Serialize() string       { return "" }
+
+func (*UUIDType) Deserialize(storage arrow.DataType, _ string) (arrow.ExtensionType, error) {
+	if !arrow.TypeEqual(storage, &arrow.FixedSizeBinaryType{ByteWidth: 16}) {
+		return nil, fmt.Errorf("%s: invalid storage type %s, expected fixed_size_binary[16]", UUIDExtensionName, storage)
+	}
+	return NewUUIDType(), nil
+}
+
+func (t *UUIDType) ExtensionEquals(other arrow.ExtensionType) bool {
+	return other.ExtensionName() == t.ExtensionName()
+}
+
+// UUIDArray is an array of UUIDType.
+type UUIDArray struct {
+	array.ExtensionArrayBase
+}
+
+// JSONType is a JSON document stored as utf8. String values must be valid
+// JSON, other values are encoded.
+type JSONType struct {
+	arrow.ExtensionBase
+}
+
+// NewJSONType returns the JSON extension type.
+func NewJSONType() *JSONType {
+	return &JSONType{ExtensionBase: arrow.ExtensionBase{Storage: arrow.BinaryTypes.String}}
+}
+
+func (*JSONType) ArrayType() reflect.Type { return reflect.TypeOf(JSONArray{}) }
+func (*JSONType) ExtensionName() string   { return JSONExtensionName }
+func (*JSONType) Serialize() string       { return "" }
+
+func (*JSONType) Deserialize(storage arrow.DataType, _ string) (arrow.ExtensionType, error) {
+	if storage.ID() != arrow.STRING {
+		return nil, fmt.Errorf("%s: invalid storage type %s, expected utf8", JSONExtensionName, storage)
+	}
+	return NewJSONType(), nil
+}
+
+func (t *JSONType) ExtensionEquals(other arrow.ExtensionType) bool {
+	return other.ExtensionName() == t.ExtensionName()
+}
+
+// JSONArray is an array of JSONType.
+type JSONArray struct {
+	array.ExtensionArrayBase
+}
+
+// IPType is an IP address stored as fixed_size_binary(4) for IPv4 only, or
+// fixed_size_binary(16) for IPv6 with IPv4 addresses mapped into it.
+type IPType struct {
+	arrow.ExtensionBase
+}
+
+// NewIPType returns the IP address extension type with addresses of width
+// bytes, 4 or 16.
+func NewIPType(width int) *IPType {
+	return &IPType{ExtensionBase: arrow.ExtensionBase{Storage: &arrow.FixedSizeBinaryType{ByteWidth: width}}}
+}
+
+func (*IPType) ArrayType() reflect.Type { return reflect.TypeOf(IPArray{}) }
+func (*IPType) ExtensionName() string   { return IPExtensionName }
+func (*IPType) Serialize() string       { return "" }
+
+func (*IPType) Deserialize(storage arrow.DataType, _ string) (arrow.ExtensionType, error) {
+	fsb, ok := storage.(*arrow.FixedSizeBinaryType)
+	if !ok || (fsb.ByteWidth != 4 && fsb.ByteWidth != 16) {
+		return nil, fmt.Errorf("%s: invalid storage type %s, expected fixed_size_binary[4] or fixed_size_binary[16]", IPExtensionName, storage)
+	}
+	return NewIPType(fsb.ByteWidth), nil
+}
+
+func (t *IPType) ExtensionEquals(other arrow.ExtensionType) bool {
+	o, ok := other.(*IPType)
+	return ok && arrow.TypeEqual(o.Storage, t.Storage)
+}
+
+// IPArray is an array of IPType.
+type IPArray struct {
+	array.ExtensionArrayBase
+}
+
+// supportedExtension reports whether dt is one of the extension types above.
+func supportedExtension(dt arrow.DataType) bool {
+	switch dt.(type) {
+	case *UUIDType, *JSONType, *IPType:
+		return true
+	}
+	return false
+}
+
+// extensionAppender returns the appender of a column of one of the
+// extension types above, it parses values into their storage.
+func extensionAppender(dt arrow.ExtensionType, b *array.ExtensionBuilder) (appender, error) {
+	switch dt := dt.(type) {
+	case *UUIDType:
+		sb := b.Builder.(*array.FixedSizeBinaryBuilder)
+		return func(v interface{}) *ValueError {
+			u, err := parseUUID(v, dt)
+			if err == nil {
+				sb.Append(u[:])
+			}
+			return err
+		}, nil
+	case *JSONType:
+		sb := b.Builder.(*array.StringBuilder)
+		return func(v interface{}) *ValueError {
+			var s string
+			switch v.(type) {
+			case []byte, string:
+				if s = text(v); !json.Valid([]byte(s)) {
+					return malformed(v, dt)
+				}
+			default:
+				var err error
+				if s, err = JSON(v); err != nil {
+					return &ValueError{Reason: ReasonUnsupportedType, Value: v, Err: err}
+				}
+			}
+			sb.Append(s)
+			return nil
+		}, nil
+	case *IPType:
+		sb := b.Builder.(*array.FixedSizeBinaryBuilder)
+		width := dt.Storage.(*arrow.FixedSizeBinaryType).ByteWidth
+		return func(v interface{}) *ValueError {
+			switch v.(type) {
+			case []byte, string:
+			default:
+				return mismatch(v, dt)
+			}
+			addr, err := netip.ParseAddr(text(v))
+			if err != nil || addr.Zone() != "" {
+				return malformed(v, dt)
+			}
+			if width == 4 {
+				if addr = addr.Unmap(); !addr.Is4() {
+					return malformed(v, dt)
+				}
+				a := addr.As4()
+				sb.Append(a[:])
+				return nil
+			}
+			a := addr.As16()
+			sb.Append(a[:])
+			return nil
+		}, nil
+	}
+	return nil, fmt.Errorf("type %s is not supported", dt)
+}
+
+// parseUUID parses the hex digits of a UUID, with or without hyphens, braces
+// or a urn:uuid: prefix.
+func parseUUID(v interface{}, dt arrow.ExtensionType) ([16]byte, *ValueError) {
+	var u [16]byte
+	switch v.(type) {
+	case []byte, string:
+	default:
+		return u, mismatch(v, dt)
+	}
+	s := text(v)
+	s = strings.TrimPrefix(strings.ToLower(s), "urn:uuid:")
+	if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+		s = s[1 : len(s)-1]
+	}
+	if len(s) == 36 {
+		if s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+			return u, malformed(v, dt)
+		}
+		s = s[:8] + s[9:13] + s[14:18] + s[19:23] + s[24:]
+	}
+	if len(s) != 32 {
+		return u, malformed(v, dt)
+	}
+	if _, err := hex.Decode(u[:], []byte(s)); err != nil {
+		return u, malformed(v, dt)
+	}
+	return u, nil
+}
+
+func malformed(v interface{}, dt arrow.ExtensionType) *ValueError {
+	return &ValueError{Reason: ReasonMalformed, Value: v, Err: fmt.Errorf("malformed %s value %q", dt.ExtensionName(), text(v))}
+}
@@ -0,0 +1,144 @@
+package convert_test
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+
+	"github.com/anaray/fluent-bit-arrow-plugin/pkg/convert"
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+)
+
+// convertValue converts v into a column of type dt and returns the storage
+// of the column and the reported error reason, if any.
+func convertValue(t *testing.T, dt arrow.DataType, v interface{}) (arrow.Array, string) {
+	t.Helper()
+	schema := arrow.NewSchema([]arrow.Field{field("X", dt, true)}, nil)
+	r, errs := run(t, schema, convert.Config{}, entry(map[string]interface{}{"X": v}))
+	return r.Column(0).(array.ExtensionArray).Storage(), errs["X"]
+}
+
+// fixedValue returns the value of a valid fixed_size_binary row, failing on
+// a null one.
+func fixedValue(t *testing.T, a arrow.Array) []byte {
+	t.Helper()
+	if a.IsNull(0) {
+		t.Fatal("value stored as null")
+	}
+	return a.(*array.FixedSizeBinary).Value(0)
+}
+
+func TestUUID(t *testing.T) {
+	want := []byte{0x12, 0x3e, 0x45, 0x67, 0xe8, 0x9b, 0x12, 0xd3, 0xa4, 0x56, 0x42, 0x66, 0x14, 0x17, 0x40, 0x00}
+	for _, v := range []interface{}{
+		"123e4567-e89b-12d3-a456-426614174000",
+		"123E4567-E89B-12D3-A456-426614174000",
+		"{123e4567-e89b-12d3-a456-426614174000}",
+		"urn:uuid:123e4567-e89b-12d3-a456-426614174000",
+		"123e4567e89b12d3a456426614174000",
+		[]byte("123e4567-e89b-12d3-a456-426614174000"),
+	} {
+		a, reason := convertValue(t, convert.NewUUIDType(), v)
+		if reason != "" {
+			t.Errorf("%s reported as %s", v, reason)
+			continue
+		}
+		if got := fixedValue(t, a); !bytes.Equal(got, want) {
+			t.Errorf("%s stored as %x", v, got)
+		}
+	}
+
+	for _, tc := range []struct {
+		v      interface{}
+		reason string
+	}{
+		{"123e4567-e89b-12d3-a456-42661417400", convert.ReasonMalformed},
+		{"123e4567+e89b+12d3+a456+426614174000", convert.ReasonMalformed},
+		{"123e4567-e89b-12d3-a456-42661417400g", convert.ReasonMalformed},
+		{"{123e4567-e89b-12d3-a456-426614174000", convert.ReasonMalformed},
+		{"", convert.ReasonMalformed},
+		{42, convert.ReasonTypeMismatch},
+	} {
+		a, reason := convertValue(t, convert.NewUUIDType(), tc.v)
+		if reason != tc.reason || !a.IsNull(0) {
+			t.Errorf("%v reported as %q, null %v, want %q and null", tc.v, reason, a.IsNull(0), tc.reason)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	for _, tc := range []struct {
+		v      interface{}
+		want   string
+		reason string
+	}{
+		{`{"a": [1, 2]}`, `{"a": [1, 2]}`, ""},
+		{[]byte(`"text"`), `"text"`, ""},
+		{"null", "null", ""},
+		{`{"a": `, "", convert.ReasonMalformed},
+		{"text", "", convert.ReasonMalformed},
+		// values that are not strings are encoded
+		{map[interface{}]interface{}{"a": int64(1)}, `{"a":1}`, ""},
+		{[]interface{}{int64(1), "b"}, `[1,"b"]`, ""},
+		{int64(7), "7", ""},
+	} {
+		a, reason := convertValue(t, convert.NewJSONType(), tc.v)
+		if reason != tc.reason {
+			t.Errorf("%v reported as %q, want %q", tc.v, reason, tc.reason)
+			continue
+		}
+		s := a.(*array.String)
+		if tc.reason != "" {
+			if !s.IsNull(0) {
+				t.Errorf("malformed %v stored as %q", tc.v, s.Value(0))
+			}
+			continue
+		}
+		if s.IsNull(0) || s.Value(0) != tc.want {
+			t.Errorf("%v stored as %q, want %q", tc.v, s.Value(0), tc.want)
+		}
+	}
+}
+
+func TestIP(t *testing.T) {
+	for _, tc := range []struct {
+		width int
+		v     interface{}
+		want  string
+	}{
+		{4, "192.0.2.1", "192.0.2.1"},
+		{4, []byte("192.0.2.1"), "192.0.2.1"},
+		{4, "::ffff:192.0.2.1", "192.0.2.1"},
+		{16, "2001:db8::1", "2001:db8::1"},
+		// IPv4 addresses are mapped into IPv6
+		{16, "192.0.2.1", "::ffff:192.0.2.1"},
+	} {
+		a, reason := convertValue(t, convert.NewIPType(tc.width), tc.v)
+		if reason != "" {
+			t.Errorf("%s in a width %d column reported as %s", tc.v, tc.width, reason)
+			continue
+		}
+		want := netip.MustParseAddr(tc.want)
+		if got, _ := netip.AddrFromSlice(fixedValue(t, a)); got != want {
+			t.Errorf("%s in a width %d column stored as %s, want %s", tc.v, tc.width, got, want)
+		}
+	}
+
+	for _, tc := range []struct {
+		width  int
+		v      interface{}
+		reason string
+	}{
+		{4, "2001:db8::1", convert.ReasonMalformed},
+		{16, "fe80::1%eth0", convert.ReasonMalformed},
+		{16, "192.0.2", convert.ReasonMalformed},
+		{4, "host.example", convert.ReasonMalformed},
+		{16, int64(3232235777), convert.ReasonTypeMismatch},
+	} {
+		a, reason := convertValue(t, convert.NewIPType(tc.width), tc.v)
+		if reason != tc.reason || !a.IsNull(0) {
+			t.Errorf("%v in a width %d column reported as %q, null %v, want %q and null", tc.v, tc.width, reason, a.IsNull(0), tc.reason)
+		}
+	}
+}
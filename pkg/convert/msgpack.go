@@ -0,0 +1,157 @@
+package convert
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+// EventTime is Fluent Bit's EventTime, the msgpack extension of type 0
+// holding the seconds and nanoseconds of the record timestamp as two 32 bit
+// big-endian integers.
+type EventTime struct {
+	time.Time
+}
+
+// WriteExt encodes v, an EventTime or *EventTime, as the extension payload.
+func (EventTime) WriteExt(v interface{}) []byte {
+	var t time.Time
+	switch v := v.(type) {
+	case EventTime:
+		t = v.Time
+	case *EventTime:
+		t = v.Time
+	default:
+		panic(fmt.Sprintf("convert: cannot encode %T as EventTime", v))
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, uint32(t.Unix()))
+	binary.BigEndian.PutUint32(b[4:], uint32(t.Nanosecond()))
+	return b
+}
+
+// ReadExt decodes the extension payload src into dst, an *EventTime.
+func (EventTime) ReadExt(dst interface{}, src []byte) {
+	out := dst.(*EventTime)
+	if len(src) != 8 {
+		out.Time = time.Time{}
+		return
+	}
+	sec := binary.BigEndian.Uint32(src)
+	nsec := binary.BigEndian.Uint32(src[4:])
+	out.Time = time.Unix(int64(sec), int64(nsec))
+}
+
+// Handle returns the msgpack handle used to decode Fluent Bit chunks:
+// strings are kept as []byte and EventTime is registered as extension 0,
+// the same as fluent-bit-go's decoder.
+func Handle() *codec.MsgpackHandle {
+	h := &codec.MsgpackHandle{}
+	h.SetBytesExt(reflect.TypeOf(EventTime{}), 0, EventTime{})
+	return h
+}
+
+// Timestamps of the markers Fluent Bit 2.1 and later put around a group
+// of entries, as integers or as the seconds of an EventTime.
+const (
+	groupStart = -1
+	groupEnd   = -2
+)
+
+// Decoder reads the entries of a chunk as handed to an output plugin by
+// Fluent Bit, [timestamp, record] up to Fluent Bit 2.0 and
+// [[timestamp, metadata], record] from 2.1 on.
+type Decoder struct {
+	dec      *codec.Decoder
+	metadata map[interface{}]interface{}
+}
+
+// NewDecoder returns a Decoder reading the msgpack chunk data.
+func NewDecoder(data []byte) *Decoder {
+	return &Decoder{dec: codec.NewDecoderBytes(data, Handle())}
+}
+
+// Next returns the timestamp and the record of the next entry, or io.EOF at
+// the end of the chunk. Group markers are skipped. Timestamps that are not
+// an EventTime or a number of seconds are replaced by the current time,
+// like fluent-bit-go does.
+func (d *Decoder) Next() (time.Time, map[interface{}]interface{}, error) {
+	for {
+		d.metadata = nil
+		var entry interface{}
+		if err := d.dec.Decode(&entry); err != nil {
+			if err == io.EOF {
+				return time.Time{}, nil, io.EOF
+			}
+			return time.Time{}, nil, fmt.Errorf("decoding entry: %w", err)
+		}
+		slice, ok := entry.([]interface{})
+		if !ok || len(slice) != 2 {
+			return time.Time{}, nil, fmt.Errorf("decoding entry: expected [timestamp, record], got %T", entry)
+		}
+
+		ts := slice[0]
+		if header, ok := ts.([]interface{}); ok {
+			if len(header) != 2 {
+				return time.Time{}, nil, fmt.Errorf("decoding entry: expected [timestamp, metadata], got %d elements", len(header))
+			}
+			ts = header[0]
+			if groupMarker(ts) {
+				continue
+			}
+			if header[1] != nil {
+				md, ok := header[1].(map[interface{}]interface{})
+				if !ok {
+					return time.Time{}, nil, fmt.Errorf("decoding entry: expected a map as metadata, got %T", header[1])
+				}
+				d.metadata = md
+			}
+		}
+		record, ok := slice[1].(map[interface{}]interface{})
+		if !ok {
+			return time.Time{}, nil, fmt.Errorf("decoding entry: expected a map as record, got %T", slice[1])
+		}
+		return entryTime(ts), record, nil
+	}
+}
+
+// Metadata returns the metadata of the entry last returned by Next, nil if
+// it has none.
+func (d *Decoder) Metadata() map[interface{}]interface{} {
+	return d.metadata
+}
+
+// groupMarker reports whether ts is the timestamp of a group marker. The
+// seconds of an EventTime are unsigned, so the markers wrap around there.
+func groupMarker(ts interface{}) bool {
+	switch t := ts.(type) {
+	case int64:
+		return t == groupStart || t == groupEnd
+	case EventTime:
+		sec := t.Unix()
+		return sec == math.MaxUint32+1+groupStart || sec == math.MaxUint32+1+groupEnd
+	}
+	return false
+}
+
+func entryTime(v interface{}) time.Time {
+	switch t := v.(type) {
+	case EventTime:
+		return t.Time
+	case *EventTime:
+		return t.Time
+	case uint64:
+		return time.Unix(int64(t), 0)
+	case int64:
+		return time.Unix(t, 0)
+	case float64:
+		sec := int64(t)
+		return time.Unix(sec, int64((t-float64(sec))*1e9))
+	}
+	return time.Now()
+}
@@ -0,0 +1,110 @@
+package convert
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+)
+
+// isTextMap reports whether dt is map<utf8, utf8>.
+func isTextMap(dt arrow.DataType) bool {
+	m, ok := dt.(*arrow.MapType)
+	return ok && m.KeyType().ID() == arrow.STRING && m.ItemType().ID() == arrow.STRING
+}
+
+// mapAppender returns the appender of a map<utf8, utf8> column. It takes
+// msgpack maps, scalar values are stored as text and nested ones as JSON.
+func mapAppender(dt arrow.DataType, b *array.MapBuilder) appender {
+	kb := b.KeyBuilder().(*array.StringBuilder)
+	ib := b.ItemBuilder().(*array.StringBuilder)
+	return func(v interface{}) *ValueError {
+		m, ok := v.(map[interface{}]interface{})
+		if !ok {
+			return mismatch(v, dt)
+		}
+		keys := make([]string, 0, len(m))
+		items := make(map[string]interface{}, len(m))
+		for k, x := range m {
+			key, ok := Text(k)
+			if !ok {
+				return mismatch(v, dt)
+			}
+			keys = append(keys, key)
+			items[key] = x
+		}
+		sort.Strings(keys)
+		vals := make([]string, len(keys))
+		for i, key := range keys {
+			x := items[key]
+			if x == nil {
+				continue
+			}
+			s, ok := Text(x)
+			if t, isText := jsonValue(x).(string); !ok && isText {
+				s, ok = t, true
+			}
+			if !ok {
+				var err error
+				if s, err = JSON(x); err != nil {
+					return &ValueError{Reason: ReasonUnsupportedType, Value: v, Err: err}
+				}
+			}
+			vals[i] = s
+		}
+
+		b.Append(true)
+		for i, key := range keys {
+			kb.Append(key)
+			if items[key] == nil {
+				ib.AppendNull()
+			} else {
+				ib.Append(vals[i])
+			}
+		}
+		return nil
+	}
+}
+
+// JSON returns the msgpack value v encoded as JSON. Binary strings are
+// encoded as strings and timestamps in RFC 3339.
+func JSON(v interface{}) (string, error) {
+	data, err := json.Marshal(jsonValue(v))
+	if err != nil {
+		return "", fmt.Errorf("cannot encode %T as JSON: %w", v, err)
+	}
+	return string(data), nil
+}
+
+// jsonValue returns v with the msgpack types encoding/json does not handle
+// replaced.
+func jsonValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case []byte:
+		return string(x)
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(x))
+		for k, e := range x {
+			key, ok := Text(k)
+			if !ok {
+				key = fmt.Sprint(k)
+			}
+			m[key] = jsonValue(e)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(x))
+		for i, e := range x {
+			a[i] = jsonValue(e)
+		}
+		return a
+	case EventTime:
+		return x.Time.UTC().Format(time.RFC3339Nano)
+	case *EventTime:
+		return x.Time.UTC().Format(time.RFC3339Nano)
+	}
+	return v
+}
@@ -0,0 +1,231 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+	"github.com/apache/arrow/go/v12/arrow/compute"
+	"github.com/apache/arrow/go/v12/arrow/memory"
+)
+
+// SortKey is a column records are sorted by.
+type SortKey struct {
+	Column     string
+	Descending bool
+	// NullsFirst places nulls before the values, regardless of Descending.
+	NullsFirst bool
+}
+
+// ParseSortKeys parses a Sort_Keys value, a comma separated list of columns
+// of schema each optionally followed by ":asc" or ":desc" and
+// ":nulls_first" or ":nulls_last", e.g. "LOCATION_ID,MEASUREMENT_DATE:desc".
+// Columns are sorted ascending with nulls last unless stated otherwise.
+func ParseSortKeys(spec string, schema *arrow.Schema) ([]SortKey, error) {
+	var keys []SortKey
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		key := SortKey{Column: parts[0]}
+		for _, opt := range parts[1:] {
+			switch strings.ToLower(opt) {
+			case "asc":
+				key.Descending = false
+			case "desc":
+				key.Descending = true
+			case "nulls_first":
+				key.NullsFirst = true
+			case "nulls_last":
+				key.NullsFirst = false
+			default:
+				return nil, fmt.Errorf("sort key [%s]: unknown option [%s]", key.Column, opt)
+			}
+		}
+		fields, ok := schema.FieldsByName(key.Column)
+		if !ok {
+			return nil, fmt.Errorf("sort key [%s] is not in the schema", key.Column)
+		}
+		if !sortable(fields[0].Type) {
+			return nil, fmt.Errorf("sort key [%s]: cannot sort by %s", key.Column, fields[0].Type)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no sort keys in [%s]", spec)
+	}
+	return keys, nil
+}
+
+// Sort returns record with its rows ordered by keys, rows with equal keys
+// keep their order. The sorted columns are allocated from mem, record is
+// returned retained when it is sorted already. The caller must release the
+// returned record.
+func Sort(record arrow.Record, keys []SortKey, mem memory.Allocator) (arrow.Record, error) {
+	cmps := make([]func(i, j int) int, len(keys))
+	for k, key := range keys {
+		idx := record.Schema().FieldIndices(key.Column)
+		if len(idx) == 0 {
+			return nil, fmt.Errorf("sort key [%s] is not in the record", key.Column)
+		}
+		cmps[k] = comparator(record.Column(idx[0]), key)
+		if cmps[k] == nil {
+			return nil, fmt.Errorf("sort key [%s]: cannot sort by %s", key.Column, record.Column(idx[0]).DataType())
+		}
+	}
+
+	rows := make([]int, record.NumRows())
+	for i := range rows {
+		rows[i] = i
+	}
+	sort.SliceStable(rows, func(a, b int) bool {
+		for _, cmp := range cmps {
+			if c := cmp(rows[a], rows[b]); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	if sort.IntsAreSorted(rows) {
+		record.Retain()
+		return record, nil
+	}
+
+	b := array.NewInt64Builder(mem)
+	defer b.Release()
+	b.Reserve(len(rows))
+	for _, i := range rows {
+		b.UnsafeAppend(int64(i))
+	}
+	indices := b.NewArray()
+	defer indices.Release()
+
+	ctx := compute.WithAllocator(context.Background(), mem)
+	values := compute.NewDatumWithoutOwning(record)
+	idx := compute.NewDatum(indices)
+	defer idx.Release()
+	out, err := compute.Take(ctx, *compute.DefaultTakeOptions(), values, idx)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Release()
+	sorted := out.(*compute.RecordDatum).Value
+	sorted.Retain()
+	return sorted, nil
+}
+
+// sortable reports whether comparator supports columns of dt.
+func sortable(dt arrow.DataType) bool {
+	switch dt.ID() {
+	case arrow.BOOL, arrow.INT8, arrow.INT16, arrow.INT32, arrow.INT64,
+		arrow.UINT8, arrow.UINT16, arrow.UINT32, arrow.UINT64,
+		arrow.FLOAT32, arrow.FLOAT64, arrow.STRING, arrow.LARGE_STRING,
+		arrow.BINARY, arrow.LARGE_BINARY, arrow.TIMESTAMP, arrow.DATE32,
+		arrow.DATE64, arrow.TIME32, arrow.TIME64, arrow.DURATION:
+		return true
+	}
+	return false
+}
+
+// comparator returns a function ordering the rows of arr by key, or nil if
+// arr is not sortable.
+func comparator(arr arrow.Array, key SortKey) func(i, j int) int {
+	var cmp func(i, j int) int
+	switch a := arr.(type) {
+	case *array.Boolean:
+		cmp = func(i, j int) int {
+			x, y := a.Value(i), a.Value(j)
+			switch {
+			case x == y:
+				return 0
+			case !x:
+				return -1
+			}
+			return 1
+		}
+	case *array.Int8:
+		cmp = compareValues(a.Value)
+	case *array.Int16:
+		cmp = compareValues(a.Value)
+	case *array.Int32:
+		cmp = compareValues(a.Value)
+	case *array.Int64:
+		cmp = compareValues(a.Value)
+	case *array.Uint8:
+		cmp = compareValues(a.Value)
+	case *array.Uint16:
+		cmp = compareValues(a.Value)
+	case *array.Uint32:
+		cmp = compareValues(a.Value)
+	case *array.Uint64:
+		cmp = compareValues(a.Value)
+	case *array.Float32:
+		cmp = compareValues(a.Value)
+	case *array.Float64:
+		cmp = compareValues(a.Value)
+	case *array.String:
+		cmp = compareValues(a.Value)
+	case *array.LargeString:
+		cmp = compareValues(a.Value)
+	case *array.Binary:
+		cmp = func(i, j int) int { return bytes.Compare(a.Value(i), a.Value(j)) }
+	case *array.LargeBinary:
+		cmp = func(i, j int) int { return bytes.Compare(a.Value(i), a.Value(j)) }
+	case *array.Timestamp:
+		cmp = compareValues(a.Value)
+	case *array.Date32:
+		cmp = compareValues(a.Value)
+	case *array.Date64:
+		cmp = compareValues(a.Value)
+	case *array.Time32:
+		cmp = compareValues(a.Value)
+	case *array.Time64:
+		cmp = compareValues(a.Value)
+	case *array.Duration:
+		cmp = compareValues(a.Value)
+	default:
+		return nil
+	}
+
+	return func(i, j int) int {
+		ni, nj := arr.IsNull(i), arr.IsNull(j)
+		switch {
+		case ni && nj:
+			return 0
+		case ni != nj:
+			if ni == key.NullsFirst {
+				return -1
+			}
+			return 1
+		}
+		if key.Descending {
+			return -cmp(i, j)
+		}
+		return cmp(i, j)
+	}
+}
+
+type ordered interface {
+	~int8 | ~int16 | ~int32 | ~int64 | ~uint8 | ~uint16 | ~uint32 | ~uint64 |
+		~float32 | ~float64 | ~string
+}
+
+// compareValues orders rows by the values value returns for them.
+func compareValues[T ordered](value func(int) T) func(i, j int) int {
+	return func(i, j int) int {
+		x, y := value(i), value(j)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+}
@@ -0,0 +1,109 @@
+package convert_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/anaray/fluent-bit-arrow-plugin/pkg/convert"
+	"github.com/anaray/fluent-bit-arrow-plugin/pkg/convert/convtest"
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+	"github.com/apache/arrow/go/v12/arrow/memory"
+)
+
+var sortSchema = arrow.NewSchema([]arrow.Field{
+	{Name: "ID", Type: arrow.PrimitiveTypes.Int64},
+	{Name: "LOC", Type: arrow.BinaryTypes.String, Nullable: true},
+	{Name: "VAL", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
+}, nil)
+
+// sortedIds sorts rows of LOC and VAL values by spec and returns the ids of
+// the rows in their new order, the id of a row being its index.
+func sortedIds(t *testing.T, spec string, rows ...[2]interface{}) []int64 {
+	t.Helper()
+	var entries []convtest.Entry
+	for i, row := range rows {
+		entries = append(entries, entry(map[string]interface{}{"ID": i, "LOC": row[0], "VAL": row[1]}))
+	}
+	recs, err := convtest.Run(sortSchema, convert.Config{}, entries...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recs[0].Release()
+
+	keys, err := convert.ParseSortKeys(spec, sortSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := memory.NewCheckedAllocator(memory.NewGoAllocator())
+	defer mem.AssertSize(t, 0)
+	sorted, err := convert.Sort(recs[0], keys, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sorted.Release()
+	return sorted.Column(0).(*array.Int64).Int64Values()
+}
+
+func TestSort(t *testing.T) {
+	rows := [][2]interface{}{
+		{"b", 2.0},
+		{nil, 1.0},
+		{"a", nil},
+		{"b", 1.0},
+		{"a", 3.0},
+		{nil, nil},
+	}
+	for _, tc := range []struct {
+		spec string
+		want []int64
+	}{
+		{"LOC", []int64{2, 4, 0, 3, 1, 5}},
+		{"LOC:nulls_first", []int64{1, 5, 2, 4, 0, 3}},
+		{"LOC:desc", []int64{0, 3, 2, 4, 1, 5}},
+		{"LOC:desc:nulls_first", []int64{1, 5, 0, 3, 2, 4}},
+		{"LOC,VAL:desc", []int64{4, 2, 0, 3, 1, 5}},
+		{"VAL:desc:nulls_first,LOC", []int64{2, 5, 4, 0, 3, 1}},
+		{"VAL,LOC:desc", []int64{3, 1, 0, 4, 2, 5}},
+	} {
+		if got := sortedIds(t, tc.spec, rows...); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("sorted by %s: %v, want %v", tc.spec, got, tc.want)
+		}
+	}
+}
+
+func TestSortSorted(t *testing.T) {
+	recs, err := convtest.Run(sortSchema, convert.Config{},
+		entry(map[string]interface{}{"ID": 0, "LOC": "a"}),
+		entry(map[string]interface{}{"ID": 1, "LOC": "b"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recs[0].Release()
+	keys, _ := convert.ParseSortKeys("LOC", sortSchema)
+	sorted, err := convert.Sort(recs[0], keys, memory.DefaultAllocator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sorted.Release()
+	if sorted != recs[0] {
+		t.Error("a sorted record is not returned as it is")
+	}
+}
+
+func TestParseSortKeys(t *testing.T) {
+	keys, err := convert.ParseSortKeys(" LOC:desc , VAL:nulls_first", sortSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []convert.SortKey{{Column: "LOC", Descending: true}, {Column: "VAL", NullsFirst: true}}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("parsed %+v, want %+v", keys, want)
+	}
+	for _, spec := range []string{"", "NOPE", "LOC:sideways"} {
+		if _, err := convert.ParseSortKeys(spec, sortSchema); err == nil {
+			t.Errorf("%q parsed without an error", spec)
+		}
+	}
+}
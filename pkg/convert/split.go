@@ -0,0 +1,134 @@
+package convert
+
+import (
+	"fmt"
+
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+	"github.com/apache/arrow/go/v12/arrow/bitutil"
+	"github.com/apache/arrow/go/v12/arrow/memory"
+)
+
+// EstimateSize returns the approximate number of bytes rows [i, j) of record
+// take in the body of an Arrow IPC message, the message metadata is not
+// included.
+func EstimateSize(record arrow.Record, i, j int64) int64 {
+	var size int64
+	for _, col := range record.Columns() {
+		size += estimateData(col.Data(), i, j)
+	}
+	return size
+}
+
+// estimateData estimates rows [i, j) of data. Types the converter does not
+// produce are estimated in proportion to their buffers.
+func estimateData(data arrow.ArrayData, i, j int64) int64 {
+	n := j - i
+	var size int64
+	if bufs := data.Buffers(); len(bufs) > 0 && bufs[0] != nil {
+		size += padded(bitutil.BytesForBits(n))
+	}
+	switch dt := data.DataType(); dt.ID() {
+	case arrow.BOOL:
+		return size + padded(bitutil.BytesForBits(n))
+	case arrow.STRING, arrow.BINARY:
+		offsets := arrow.Int32Traits.CastFromBytes(data.Buffers()[1].Bytes())[int64(data.Offset()):]
+		return size + padded(4*(n+1)) + padded(int64(offsets[j]-offsets[i]))
+	case arrow.LARGE_STRING, arrow.LARGE_BINARY:
+		offsets := arrow.Int64Traits.CastFromBytes(data.Buffers()[1].Bytes())[int64(data.Offset()):]
+		return size + padded(8*(n+1)) + padded(offsets[j]-offsets[i])
+	default:
+		if fw, ok := dt.(arrow.FixedWidthDataType); ok && len(data.Children()) == 0 {
+			return size + padded(n*int64(fw.BitWidth()/8))
+		}
+	}
+
+	if data.Len() == 0 {
+		return size
+	}
+	var total int64
+	for _, buf := range data.Buffers()[1:] {
+		if buf != nil {
+			total += int64(buf.Len())
+		}
+	}
+	for _, child := range data.Children() {
+		total += estimateData(child, 0, int64(child.Len()))
+	}
+	return size + total*n/int64(data.Len())
+}
+
+// padded rounds n up to the 8 byte alignment of IPC buffers.
+func padded(n int64) int64 {
+	return bitutil.CeilByte64(n)
+}
+
+// Split slices record into consecutive records whose EstimateSize is at
+// most maxBytes, a row exceeding it on its own forms a record. The slices
+// share the buffers of record, which is returned retained when it fits
+// already. The caller must release the returned records.
+func Split(record arrow.Record, maxBytes int64) []arrow.Record {
+	if maxBytes <= 0 || EstimateSize(record, 0, record.NumRows()) <= maxBytes {
+		record.Retain()
+		return []arrow.Record{record}
+	}
+	return split(record, 0, record.NumRows(), maxBytes, nil)
+}
+
+// split halves rows [i, j) of record until the halves fit maxBytes.
+func split(record arrow.Record, i, j, maxBytes int64, out []arrow.Record) []arrow.Record {
+	if j-i <= 1 || EstimateSize(record, i, j) <= maxBytes {
+		return append(out, record.NewSlice(i, j))
+	}
+	mid := i + (j-i)/2
+	out = split(record, i, mid, maxBytes, out)
+	return split(record, mid, j, maxBytes, out)
+}
+
+// Concatenable reports whether Concat supports records of schema, Arrow
+// cannot concatenate union columns.
+func Concatenable(schema *arrow.Schema) bool {
+	for _, f := range schema.Fields() {
+		if _, ok := f.Type.(arrow.UnionType); ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Concat concatenates records of the same schema into a single record
+// allocated from mem. The caller must release it.
+func Concat(records []arrow.Record, mem memory.Allocator) (arrow.Record, error) {
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no records to concatenate")
+	}
+	schema := records[0].Schema()
+	var rows int64
+	for _, r := range records {
+		if !r.Schema().Equal(schema) {
+			return nil, fmt.Errorf("cannot concatenate records of different schemas")
+		}
+		rows += r.NumRows()
+	}
+
+	cols := make([]arrow.Array, len(schema.Fields()))
+	defer func() {
+		for _, c := range cols {
+			if c != nil {
+				c.Release()
+			}
+		}
+	}()
+	arrs := make([]arrow.Array, len(records))
+	for i := range cols {
+		for k, r := range records {
+			arrs[k] = r.Column(i)
+		}
+		col, err := array.Concatenate(arrs, mem)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", schema.Field(i).Name, err)
+		}
+		cols[i] = col
+	}
+	return array.NewRecord(schema, cols, rows), nil
+}
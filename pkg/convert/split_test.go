@@ -0,0 +1,109 @@
+package convert_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/anaray/fluent-bit-arrow-plugin/pkg/convert"
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+	"github.com/apache/arrow/go/v12/arrow/memory"
+)
+
+// textRecord returns a record with a row per value of the ID and TEXT
+// columns, TEXT holding width characters.
+func textRecord(mem memory.Allocator, rows, width int) arrow.Record {
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "ID", Type: arrow.PrimitiveTypes.Int64},
+		{Name: "TEXT", Type: arrow.BinaryTypes.String, Nullable: true},
+	}, nil)
+	b := array.NewRecordBuilder(mem, schema)
+	defer b.Release()
+	for i := 0; i < rows; i++ {
+		b.Field(0).(*array.Int64Builder).Append(int64(i))
+		if i%7 == 3 {
+			b.Field(1).AppendNull()
+		} else {
+			b.Field(1).(*array.StringBuilder).Append(strings.Repeat("x", width))
+		}
+	}
+	return b.NewRecord()
+}
+
+func TestSplit(t *testing.T) {
+	mem := memory.NewCheckedAllocator(memory.NewGoAllocator())
+	defer mem.AssertSize(t, 0)
+	r := textRecord(mem, 100, 100)
+	defer r.Release()
+	total := convert.EstimateSize(r, 0, r.NumRows())
+
+	for _, max := range []int64{total, total / 2, total / 7, 500, 1} {
+		t.Run(fmt.Sprint(max), func(t *testing.T) {
+			parts := convert.Split(r, max)
+			defer func() {
+				for _, p := range parts {
+					p.Release()
+				}
+			}()
+			var next int64
+			for _, p := range parts {
+				if size := convert.EstimateSize(p, 0, p.NumRows()); size > max && p.NumRows() > 1 {
+					t.Errorf("part of %d rows estimated at %d bytes, more than %d", p.NumRows(), size, max)
+				}
+				ids := p.Column(0).(*array.Int64)
+				for i := 0; i < ids.Len(); i++ {
+					if ids.Value(i) != next {
+						t.Fatalf("row %d is followed by row %d", next-1, ids.Value(i))
+					}
+					next++
+				}
+			}
+			if next != r.NumRows() {
+				t.Errorf("parts hold %d rows, want %d", next, r.NumRows())
+			}
+			if max >= total && (len(parts) != 1 || parts[0] != r) {
+				t.Errorf("a record that fits is split into %d parts", len(parts))
+			}
+		})
+	}
+}
+
+func TestSplitEstimate(t *testing.T) {
+	mem := memory.NewCheckedAllocator(memory.NewGoAllocator())
+	defer mem.AssertSize(t, 0)
+	r := textRecord(mem, 10, 16)
+	defer r.Release()
+	// validity bitmaps, 8 byte ids, 4 byte offsets and the text, each padded
+	// to 8 bytes
+	want := int64(8 + 80 + 8 + 48 + 9*16)
+	if got := convert.EstimateSize(r, 0, r.NumRows()); got != want {
+		t.Errorf("estimated %d bytes, want %d", got, want)
+	}
+	whole := convert.EstimateSize(r, 0, r.NumRows())
+	if half := convert.EstimateSize(r, 0, 5) + convert.EstimateSize(r, 5, 10); half < whole {
+		t.Errorf("halves estimated at %d bytes, less than the whole %d", half, whole)
+	}
+}
+
+func TestConcat(t *testing.T) {
+	mem := memory.NewCheckedAllocator(memory.NewGoAllocator())
+	defer mem.AssertSize(t, 0)
+	r := textRecord(mem, 20, 8)
+	defer r.Release()
+	parts := convert.Split(r, 100)
+	if len(parts) < 2 {
+		t.Fatalf("split into %d parts", len(parts))
+	}
+	joined, err := convert.Concat(parts, mem)
+	for _, p := range parts {
+		p.Release()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer joined.Release()
+	if !array.RecordEqual(joined, r) {
+		t.Error("concatenated parts differ from the record")
+	}
+}
@@ -0,0 +1,152 @@
+package convert
+
+import (
+	"math"
+	"time"
+
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+)
+
+// unionChild is a child of a union column with the appender of its builder.
+type unionChild struct {
+	code   arrow.UnionTypeCode
+	dt     arrow.DataType
+	b      array.Builder
+	append appender
+	// fits reports whether append accepts a value, without appending it
+	fits func(v interface{}) bool
+}
+
+// unionAppender returns the appender of a sparse or dense union column. A
+// value goes to the first child of the type msgpack decoded it as, e.g. an
+// integer column for integers, and otherwise to the first child that can
+// hold it.
+func unionAppender(dt arrow.UnionType, b array.UnionBuilder, timeFormat string) (appender, error) {
+	children := make([]unionChild, len(dt.Fields()))
+	for i, f := range dt.Fields() {
+		app, err := newAppender(f.Type, b.Child(i), timeFormat)
+		if err != nil {
+			return nil, err
+		}
+		children[i] = unionChild{
+			code:   dt.TypeCodes()[i],
+			dt:     f.Type,
+			b:      b.Child(i),
+			append: app,
+			fits:   fits(f.Type, timeFormat),
+		}
+	}
+	sparse := dt.Mode() == arrow.SparseMode
+
+	return func(v interface{}) *ValueError {
+		c := pickChild(children, v)
+		if c == nil {
+			return mismatch(v, dt)
+		}
+		b.Append(c.code)
+		if err := c.append(v); err != nil {
+			// fits accepted v, so this cannot happen
+			c.b.AppendNull()
+		}
+		if sparse {
+			for i := range children {
+				if &children[i] != c {
+					children[i].b.AppendEmptyValue()
+				}
+			}
+		}
+		return nil
+	}, nil
+}
+
+// pickChild returns the child v is appended to, or nil if none can hold it.
+func pickChild(children []unionChild, v interface{}) *unionChild {
+	for i := range children {
+		if native(children[i].dt, v) && children[i].fits(v) {
+			return &children[i]
+		}
+	}
+	for i := range children {
+		if children[i].fits(v) {
+			return &children[i]
+		}
+	}
+	return nil
+}
+
+// native reports whether dt is the Arrow counterpart of the type msgpack
+// decoded v as.
+func native(dt arrow.DataType, v interface{}) bool {
+	switch v.(type) {
+	case bool:
+		return dt.ID() == arrow.BOOL
+	case int64, uint64, int:
+		return arrow.IsInteger(dt.ID())
+	case float64, float32:
+		return arrow.IsFloating(dt.ID())
+	case string, []byte:
+		switch dt.ID() {
+		case arrow.STRING, arrow.LARGE_STRING, arrow.BINARY, arrow.LARGE_BINARY:
+			return true
+		}
+	case EventTime, *EventTime, time.Time:
+		return dt.ID() == arrow.TIMESTAMP
+	case map[interface{}]interface{}:
+		return dt.ID() == arrow.MAP
+	}
+	return false
+}
+
+// fits returns a function reporting whether the appender of a column of
+// type dt accepts a value.
+func fits(dt arrow.DataType, timeFormat string) func(v interface{}) bool {
+	switch dt.ID() {
+	case arrow.BOOL:
+		return func(v interface{}) bool { _, err := toBool(v, dt); return err == nil }
+	case arrow.INT8:
+		return intFits(dt, math.MinInt8, math.MaxInt8)
+	case arrow.INT16:
+		return intFits(dt, math.MinInt16, math.MaxInt16)
+	case arrow.INT32:
+		return intFits(dt, math.MinInt32, math.MaxInt32)
+	case arrow.INT64:
+		return intFits(dt, math.MinInt64, math.MaxInt64)
+	case arrow.UINT8:
+		return uintFits(dt, math.MaxUint8)
+	case arrow.UINT16:
+		return uintFits(dt, math.MaxUint16)
+	case arrow.UINT32:
+		return uintFits(dt, math.MaxUint32)
+	case arrow.UINT64:
+		return uintFits(dt, math.MaxUint64)
+	case arrow.FLOAT32, arrow.FLOAT64:
+		return func(v interface{}) bool { _, err := toFloat64(v, dt); return err == nil }
+	case arrow.STRING, arrow.LARGE_STRING:
+		return func(v interface{}) bool { _, err := toString(v, dt); return err == nil }
+	case arrow.BINARY, arrow.LARGE_BINARY:
+		return func(v interface{}) bool {
+			switch v.(type) {
+			case []byte, string:
+				return true
+			}
+			return false
+		}
+	case arrow.TIMESTAMP:
+		unit := dt.(*arrow.TimestampType).Unit
+		return func(v interface{}) bool { _, err := toTimestamp(v, dt, unit, timeFormat); return err == nil }
+	case arrow.MAP:
+		return func(v interface{}) bool { _, ok := v.(map[interface{}]interface{}); return ok }
+	}
+	return func(interface{}) bool { return false }
+}
+
+func intFits(dt arrow.DataType, min, max int64) func(v interface{}) bool {
+	app := intAppender(dt, min, max, func(int64) {})
+	return func(v interface{}) bool { return app(v) == nil }
+}
+
+func uintFits(dt arrow.DataType, max uint64) func(v interface{}) bool {
+	app := uintAppender(dt, max, func(uint64) {})
+	return func(v interface{}) bool { return app(v) == nil }
+}
@@ -0,0 +1,125 @@
+package convert_test
+
+import (
+	"testing"
+
+	"github.com/anaray/fluent-bit-arrow-plugin/pkg/convert"
+	"github.com/anaray/fluent-bit-arrow-plugin/pkg/convert/convtest"
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+)
+
+// unionChildren are the children of the union columns of the tests, with
+// type codes that differ from their indices.
+var (
+	unionChildren = []arrow.Field{
+		field("I8", arrow.PrimitiveTypes.Int8, true),
+		field("S", arrow.BinaryTypes.String, true),
+		field("F", arrow.PrimitiveTypes.Float64, true),
+	}
+	unionCodes = []arrow.UnionTypeCode{3, 5, 9}
+)
+
+// unionValues are converted into a union column, each followed by the
+// type code of the child it goes to and its value there.
+var unionValues = []struct {
+	v     interface{}
+	code  arrow.UnionTypeCode
+	value interface{}
+}{
+	{7, 3, int8(7)},
+	{"x", 5, "x"},
+	{2.5, 9, 2.5},
+	// native types go first, even if another child holds the value too
+	{"12", 5, "12"},
+	{3.0, 9, 3.0},
+	// otherwise the first child that holds it
+	{300, 5, "300"},
+}
+
+// unionValue returns the value at i of child.
+func unionValue(t *testing.T, child arrow.Array, i int) interface{} {
+	t.Helper()
+	switch a := child.(type) {
+	case *array.Int8:
+		return a.Value(i)
+	case *array.String:
+		return a.Value(i)
+	case *array.Float64:
+		return a.Value(i)
+	}
+	t.Fatalf("unexpected child %s", child.DataType())
+	return nil
+}
+
+func unionRecord(t *testing.T, dt arrow.DataType) (arrow.Record, map[string]string) {
+	t.Helper()
+	schema := arrow.NewSchema([]arrow.Field{field("U", dt, true)}, nil)
+	var entries []convtest.Entry
+	for _, tc := range unionValues {
+		entries = append(entries, entry(map[string]interface{}{"U": tc.v}))
+	}
+	// a value no child can hold, nested values are not supported in unions
+	entries = append(entries, entry(map[string]interface{}{"U": map[interface{}]interface{}{"a": 1}}))
+	return run(t, schema, convert.Config{}, entries...)
+}
+
+func TestSparseUnion(t *testing.T) {
+	r, errs := unionRecord(t, arrow.SparseUnionOf(unionChildren, unionCodes))
+	u := r.Column(0).(*array.SparseUnion)
+	if u.Len() != len(unionValues)+1 {
+		t.Fatalf("%d rows, want %d", u.Len(), len(unionValues)+1)
+	}
+	for i, tc := range unionValues {
+		if u.TypeCode(i) != tc.code {
+			t.Errorf("%v went to the child of type code %d, want %d", tc.v, u.TypeCode(i), tc.code)
+			continue
+		}
+		// every child has a slot for every row
+		child := u.Field(u.ChildID(i))
+		if child.Len() != u.Len() {
+			t.Fatalf("child %d has %d rows, want %d", u.ChildID(i), child.Len(), u.Len())
+		}
+		if got := unionValue(t, child, i); got != tc.value {
+			t.Errorf("%v stored as %v, want %v", tc.v, got, tc.value)
+		}
+	}
+	if errs["U"] != convert.ReasonUnsupportedType {
+		t.Errorf("value no child holds reported as %q, want %q", errs["U"], convert.ReasonUnsupportedType)
+	}
+	last := u.Len() - 1
+	if !u.Field(u.ChildID(last)).IsNull(last) {
+		t.Error("value no child holds not stored as null")
+	}
+}
+
+func TestDenseUnion(t *testing.T) {
+	r, errs := unionRecord(t, arrow.DenseUnionOf(unionChildren, unionCodes))
+	u := r.Column(0).(*array.DenseUnion)
+	if u.Len() != len(unionValues)+1 {
+		t.Fatalf("%d rows, want %d", u.Len(), len(unionValues)+1)
+	}
+	// the rows of each child follow each other
+	next := make(map[int]int32)
+	for i, tc := range unionValues {
+		if u.TypeCode(i) != tc.code {
+			t.Errorf("%v went to the child of type code %d, want %d", tc.v, u.TypeCode(i), tc.code)
+			continue
+		}
+		id := u.ChildID(i)
+		if off := u.ValueOffset(i); off != next[id] {
+			t.Errorf("%v at offset %d of child %d, want %d", tc.v, off, id, next[id])
+		}
+		next[id]++
+		if got := unionValue(t, u.Field(id), int(u.ValueOffset(i))); got != tc.value {
+			t.Errorf("%v stored as %v, want %v", tc.v, got, tc.value)
+		}
+	}
+	if errs["U"] != convert.ReasonUnsupportedType {
+		t.Errorf("value no child holds reported as %q, want %q", errs["U"], convert.ReasonUnsupportedType)
+	}
+	last := u.Len() - 1
+	if !u.Field(u.ChildID(last)).IsNull(int(u.ValueOffset(last))) {
+		t.Error("value no child holds not stored as null")
+	}
+}
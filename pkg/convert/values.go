@@ -0,0 +1,440 @@
+package convert
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+	"github.com/itchyny/timefmt-go"
+)
+
+// Reasons reported in ValueError.Reason, they are also used as the reason
+// label of the conversion error metric.
+const (
+	ReasonTypeMismatch    = "type_mismatch"
+	ReasonOverflow        = "overflow"
+	ReasonTimeParse       = "time_parse"
+	ReasonUnsupportedType = "unsupported_type"
+	ReasonNullValue       = "null_value"
+	ReasonMissing         = "missing"
+	ReasonMalformed       = "malformed"
+)
+
+// ValueError describes a value that could not be converted to its column.
+// The row is kept, the column holds a null instead, or the type's zero value
+// if the column is not nullable.
+type ValueError struct {
+	Column string
+	Reason string
+	Value  interface{}
+	Err    error
+}
+
+func (e *ValueError) Error() string {
+	return fmt.Sprintf("column %s: %s: %v", e.Column, e.Reason, e.Err)
+}
+
+func (e *ValueError) Unwrap() error { return e.Err }
+
+// SupportedType reports whether the converter can fill a column of type dt.
+// Sparse and dense unions are supported if their children are of the other
+// supported types, maps only as map<utf8, utf8> and extension types only if
+// they are the UUID, JSON or IP address types of this package.
+func SupportedType(dt arrow.DataType) bool {
+	if isTextMap(dt) || supportedExtension(dt) {
+		return true
+	}
+	if ut, ok := dt.(arrow.UnionType); ok {
+		for _, f := range ut.Fields() {
+			switch f.Type.ID() {
+			case arrow.SPARSE_UNION, arrow.DENSE_UNION, arrow.EXTENSION:
+				return false
+			}
+			if !SupportedType(f.Type) {
+				return false
+			}
+		}
+		return len(ut.Fields()) > 0
+	}
+	switch dt.ID() {
+	case arrow.BOOL,
+		arrow.INT8, arrow.INT16, arrow.INT32, arrow.INT64,
+		arrow.UINT8, arrow.UINT16, arrow.UINT32, arrow.UINT64,
+		arrow.FLOAT32, arrow.FLOAT64,
+		arrow.STRING, arrow.LARGE_STRING, arrow.BINARY, arrow.LARGE_BINARY,
+		arrow.TIMESTAMP:
+		return true
+	}
+	return false
+}
+
+// appender appends a non-nil msgpack value to a column builder.
+type appender func(v interface{}) *ValueError
+
+// newAppender returns the appender for builder b of a column of type dt.
+// timeFormat is the strptime format of string values in timestamp columns.
+func newAppender(dt arrow.DataType, b array.Builder, timeFormat string) (appender, error) {
+	switch dt.ID() {
+	case arrow.BOOL:
+		b := b.(*array.BooleanBuilder)
+		return func(v interface{}) *ValueError {
+			x, err := toBool(v, dt)
+			if err == nil {
+				b.Append(x)
+			}
+			return err
+		}, nil
+	case arrow.INT8:
+		b := b.(*array.Int8Builder)
+		return intAppender(dt, math.MinInt8, math.MaxInt8, func(x int64) { b.Append(int8(x)) }), nil
+	case arrow.INT16:
+		b := b.(*array.Int16Builder)
+		return intAppender(dt, math.MinInt16, math.MaxInt16, func(x int64) { b.Append(int16(x)) }), nil
+	case arrow.INT32:
+		b := b.(*array.Int32Builder)
+		return intAppender(dt, math.MinInt32, math.MaxInt32, func(x int64) { b.Append(int32(x)) }), nil
+	case arrow.INT64:
+		b := b.(*array.Int64Builder)
+		return intAppender(dt, math.MinInt64, math.MaxInt64, b.Append), nil
+	case arrow.UINT8:
+		b := b.(*array.Uint8Builder)
+		return uintAppender(dt, math.MaxUint8, func(x uint64) { b.Append(uint8(x)) }), nil
+	case arrow.UINT16:
+		b := b.(*array.Uint16Builder)
+		return uintAppender(dt, math.MaxUint16, func(x uint64) { b.Append(uint16(x)) }), nil
+	case arrow.UINT32:
+		b := b.(*array.Uint32Builder)
+		return uintAppender(dt, math.MaxUint32, func(x uint64) { b.Append(uint32(x)) }), nil
+	case arrow.UINT64:
+		b := b.(*array.Uint64Builder)
+		return uintAppender(dt, math.MaxUint64, b.Append), nil
+	case arrow.FLOAT32:
+		b := b.(*array.Float32Builder)
+		return func(v interface{}) *ValueError {
+			x, err := toFloat64(v, dt)
+			if err == nil {
+				b.Append(float32(x))
+			}
+			return err
+		}, nil
+	case arrow.FLOAT64:
+		b := b.(*array.Float64Builder)
+		return func(v interface{}) *ValueError {
+			x, err := toFloat64(v, dt)
+			if err == nil {
+				b.Append(x)
+			}
+			return err
+		}, nil
+	case arrow.STRING:
+		b := b.(*array.StringBuilder)
+		return func(v interface{}) *ValueError {
+			x, err := toString(v, dt)
+			if err == nil {
+				b.Append(x)
+			}
+			return err
+		}, nil
+	case arrow.LARGE_STRING:
+		b := b.(*array.LargeStringBuilder)
+		return func(v interface{}) *ValueError {
+			x, err := toString(v, dt)
+			if err == nil {
+				b.Append(x)
+			}
+			return err
+		}, nil
+	case arrow.BINARY, arrow.LARGE_BINARY:
+		b := b.(*array.BinaryBuilder)
+		return func(v interface{}) *ValueError {
+			switch x := v.(type) {
+			case []byte:
+				b.Append(x)
+			case string:
+				b.AppendString(x)
+			default:
+				return mismatch(v, dt)
+			}
+			return nil
+		}, nil
+	case arrow.TIMESTAMP:
+		b := b.(*array.TimestampBuilder)
+		unit := dt.(*arrow.TimestampType).Unit
+		return func(v interface{}) *ValueError {
+			x, err := toTimestamp(v, dt, unit, timeFormat)
+			if err == nil {
+				b.Append(x)
+			}
+			return err
+		}, nil
+	case arrow.EXTENSION:
+		if !supportedExtension(dt) {
+			break
+		}
+		return extensionAppender(dt.(arrow.ExtensionType), b.(*array.ExtensionBuilder))
+	case arrow.MAP:
+		if !isTextMap(dt) {
+			break
+		}
+		return mapAppender(dt, b.(*array.MapBuilder)), nil
+	case arrow.SPARSE_UNION, arrow.DENSE_UNION:
+		if !SupportedType(dt) {
+			break
+		}
+		return unionAppender(dt.(arrow.UnionType), b.(array.UnionBuilder), timeFormat)
+	}
+	return nil, fmt.Errorf("type %s is not supported", dt)
+}
+
+func mismatch(v interface{}, dt arrow.DataType) *ValueError {
+	if isNested(v) {
+		return &ValueError{Reason: ReasonUnsupportedType, Value: v, Err: fmt.Errorf("cannot store %T in a %s column", v, dt)}
+	}
+	return &ValueError{Reason: ReasonTypeMismatch, Value: v, Err: fmt.Errorf("cannot convert %T to %s", v, dt)}
+}
+
+func overflow(v interface{}, dt arrow.DataType) *ValueError {
+	return &ValueError{Reason: ReasonOverflow, Value: v, Err: fmt.Errorf("%v out of range for %s", v, dt)}
+}
+
+func isNested(v interface{}) bool {
+	switch v.(type) {
+	case map[interface{}]interface{}, []interface{}:
+		return true
+	}
+	return false
+}
+
+func intAppender(dt arrow.DataType, min, max int64, add func(int64)) appender {
+	return func(v interface{}) *ValueError {
+		var x int64
+		switch n := v.(type) {
+		case int64:
+			x = n
+		case uint64:
+			if n > math.MaxInt64 {
+				return overflow(v, dt)
+			}
+			x = int64(n)
+		case int:
+			x = int64(n)
+		case float64:
+			if n != math.Trunc(n) || n < math.MinInt64 || n >= math.MaxInt64 {
+				return mismatch(v, dt)
+			}
+			x = int64(n)
+		case float32:
+			if float64(n) != math.Trunc(float64(n)) || n < math.MinInt64 || n >= math.MaxInt64 {
+				return mismatch(v, dt)
+			}
+			x = int64(n)
+		case []byte, string:
+			var err error
+			if x, err = strconv.ParseInt(text(v), 10, 64); err != nil {
+				if ne, ok := err.(*strconv.NumError); ok && ne.Err == strconv.ErrRange {
+					return overflow(v, dt)
+				}
+				return mismatch(v, dt)
+			}
+		default:
+			return mismatch(v, dt)
+		}
+		if x < min || x > max {
+			return overflow(v, dt)
+		}
+		add(x)
+		return nil
+	}
+}
+
+func uintAppender(dt arrow.DataType, max uint64, add func(uint64)) appender {
+	return func(v interface{}) *ValueError {
+		var x uint64
+		switch n := v.(type) {
+		case uint64:
+			x = n
+		case int64:
+			if n < 0 {
+				return overflow(v, dt)
+			}
+			x = uint64(n)
+		case int:
+			if n < 0 {
+				return overflow(v, dt)
+			}
+			x = uint64(n)
+		case float64:
+			if n != math.Trunc(n) || n < 0 || n >= math.MaxUint64 {
+				return mismatch(v, dt)
+			}
+			x = uint64(n)
+		case float32:
+			if float64(n) != math.Trunc(float64(n)) || n < 0 || n >= math.MaxUint64 {
+				return mismatch(v, dt)
+			}
+			x = uint64(n)
+		case []byte, string:
+			var err error
+			if x, err = strconv.ParseUint(text(v), 10, 64); err != nil {
+				if ne, ok := err.(*strconv.NumError); ok && ne.Err == strconv.ErrRange {
+					return overflow(v, dt)
+				}
+				return mismatch(v, dt)
+			}
+		default:
+			return mismatch(v, dt)
+		}
+		if x > max {
+			return overflow(v, dt)
+		}
+		add(x)
+		return nil
+	}
+}
+
+// text returns a []byte or string value as string.
+func text(v interface{}) string {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return v.(string)
+}
+
+func toFloat64(v interface{}, dt arrow.DataType) (float64, *ValueError) {
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case float32:
+		return float64(n), nil
+	case int64:
+		return float64(n), nil
+	case uint64:
+		return float64(n), nil
+	case int:
+		return float64(n), nil
+	case []byte, string:
+		x, err := strconv.ParseFloat(text(v), 64)
+		if err != nil {
+			return 0, mismatch(v, dt)
+		}
+		return x, nil
+	}
+	return 0, mismatch(v, dt)
+}
+
+func toBool(v interface{}, dt arrow.DataType) (bool, *ValueError) {
+	switch b := v.(type) {
+	case bool:
+		return b, nil
+	case []byte, string:
+		x, err := strconv.ParseBool(text(v))
+		if err != nil {
+			return false, mismatch(v, dt)
+		}
+		return x, nil
+	}
+	return false, mismatch(v, dt)
+}
+
+// toString keeps strings as they are and formats numbers and booleans.
+func toString(v interface{}, dt arrow.DataType) (string, *ValueError) {
+	switch s := v.(type) {
+	case []byte:
+		return string(s), nil
+	case string:
+		return s, nil
+	case int64:
+		return strconv.FormatInt(s, 10), nil
+	case uint64:
+		return strconv.FormatUint(s, 10), nil
+	case int:
+		return strconv.Itoa(s), nil
+	case float64:
+		return strconv.FormatFloat(s, 'g', -1, 64), nil
+	case float32:
+		return strconv.FormatFloat(float64(s), 'g', -1, 32), nil
+	case bool:
+		return strconv.FormatBool(s), nil
+	}
+	return "", mismatch(v, dt)
+}
+
+// Text returns v as it would be stored in a utf8 column, ok is false for
+// values such a column does not accept.
+func Text(v interface{}) (s string, ok bool) {
+	s, err := toString(v, arrow.BinaryTypes.String)
+	return s, err == nil
+}
+
+// Number returns v as it would be stored in a float64 column, ok is false
+// for values such a column does not accept.
+func Number(v interface{}) (f float64, ok bool) {
+	f, err := toFloat64(v, arrow.PrimitiveTypes.Float64)
+	return f, err == nil
+}
+
+// Time returns v as it would be stored in a timestamp column of type dt
+// with the given Time_Fields format.
+func Time(v interface{}, dt *arrow.TimestampType, format string) (time.Time, error) {
+	ts, err := toTimestamp(v, dt, dt.Unit, format)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return ts.ToTime(dt.Unit), nil
+}
+
+// toTimestamp converts strings with format, or RFC 3339 if format is empty,
+// integers as a count of unit since the epoch and floats as seconds since
+// the epoch.
+func toTimestamp(v interface{}, dt arrow.DataType, unit arrow.TimeUnit, format string) (arrow.Timestamp, *ValueError) {
+	var t time.Time
+	switch n := v.(type) {
+	case []byte, string:
+		var err error
+		if format != "" {
+			t, err = timefmt.Parse(text(v), format)
+		} else {
+			t, err = time.Parse(time.RFC3339Nano, text(v))
+		}
+		if err != nil {
+			return 0, &ValueError{Reason: ReasonTimeParse, Value: v, Err: err}
+		}
+	case int64:
+		return arrow.Timestamp(n), nil
+	case uint64:
+		if n > math.MaxInt64 {
+			return 0, overflow(v, dt)
+		}
+		return arrow.Timestamp(n), nil
+	case int:
+		return arrow.Timestamp(n), nil
+	case float64:
+		sec := math.Floor(n)
+		t = time.Unix(int64(sec), int64((n-sec)*1e9))
+	case EventTime:
+		t = n.Time
+	case *EventTime:
+		t = n.Time
+	case time.Time:
+		t = n
+	default:
+		return 0, mismatch(v, dt)
+	}
+	return timestamp(t, unit), nil
+}
+
+// timestamp returns t as a count of unit since the epoch.
+func timestamp(t time.Time, unit arrow.TimeUnit) arrow.Timestamp {
+	switch unit {
+	case arrow.Second:
+		return arrow.Timestamp(t.Unix())
+	case arrow.Millisecond:
+		return arrow.Timestamp(t.UnixMilli())
+	case arrow.Microsecond:
+		return arrow.Timestamp(t.UnixMicro())
+	}
+	return arrow.Timestamp(t.UnixNano())
+}
@@ -1,96 +1,1037 @@
 package plugin
 
 import (
-	"context"
+	"errors"
 	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
 	"unsafe"
 
-	"github.com/apache/arrow/go/arrow/memory"
+	arrowschema "github.com/anaray/fluent-bit-arrow-plugin/internal/arrow"
+	"github.com/anaray/fluent-bit-arrow-plugin/internal/flblog"
+	"github.com/anaray/fluent-bit-arrow-plugin/pkg/convert"
 	"github.com/apache/arrow/go/v12/arrow"
-	"github.com/apache/arrow/go/v12/arrow/array"
-	"github.com/apache/arrow/go/v12/arrow/flight"
-	"github.com/apache/arrow/go/v12/arrow/ipc"
-	"google.golang.org/grpc"
+	"github.com/apache/arrow/go/v12/arrow/memory"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-// Plugin provides an interface for initialising a plugin and to build arrow arrays
+// DefaultMaxBatchBytes keeps batches below gRPC's default message limit of
+// 4 MiB, leaving a sixteenth of it for the IPC metadata the size estimate
+// does not cover.
+const DefaultMaxBatchBytes = 4<<20 - 4<<20/16
+
+// Plugin provides an interface for initialising a plugin
 type Plugin interface {
 	Create(ctx unsafe.Pointer) (*PluginContext, error)
-	WriteString(pluginId string, fieldName string, values []string, valid []bool)
-	WriteInt64(pluginId string, fieldName string, values []int64, valid []bool)
-	WriteUInt64(pluginId string, fieldName string, values []uint64, valid []bool)
-	WriteInt32(pluginId string, fieldName string, values []int32, valid []bool)
-	WriteFloat64(pluginId string, fieldName string, values []float64, valid []bool)
-	WriteFloat32(pluginId string, fieldName string, values []float32, valid []bool)
-	WriteTimeStamp(pluginId string, fieldName string, values []arrow.Timestamp, valid []bool)
 }
 
 // PluginContext wraps context required for an individual plugin
 
 // Configurations for each plugin is stored in this context
 type PluginContext struct {
-	Id                   string
-	TimeFields           map[string]string
+	Id         string
+	TimeFields map[string]string
+	// MetadataFields maps keys of the event metadata of Fluent Bit 2.1 and
+	// later to the columns they are stored in, optional.
+	MetadataFields map[string]string
+	// ExtraFieldsColumn collects the keys without a column of their own in
+	// the schemas that have it, optional.
+	ExtraFieldsColumn    string
 	RecordBatchThreshold int
-	RecordBatchCount     int
 	Schema               *arrow.Schema
-	Builder              *ArrowRecordBuilder
-	FlightSvc            *ArrowFlightService
+	Converter            *convert.Converter
+	Memory               *Memory
+	RequireAck           bool
+	FlightSvc            RecordWriter
+	Metrics              *Metrics
+	Logger               *flblog.Logger
+	// Spool keeps the batches that could not be written, optional. Nothing
+	// new is sent before they have been replayed.
+	Spool *Spool
+	// MaxBatchBytes is the estimated size above which batches are sliced
+	// before being written, zero disables splitting.
+	MaxBatchBytes int64
+	// TargetBatchBytes is the estimated size up to which smaller batches of
+	// a chunk are concatenated, zero disables coalescing.
+	TargetBatchBytes int64
+	// Dedup drops records already seen within its window, optional.
+	Dedup *Deduplicator
+	// SortKeys orders the rows of every batch before it is written,
+	// optional.
+	SortKeys []convert.SortKey
+	// Partitioner routes the rows to partitions, each with a Converter of
+	// its own and the writer NewPartitionWriter opens for its path. Without
+	// it all rows go through Converter to FlightSvc.
+	Partitioner        *Partitioner
+	NewPartitionWriter func(path []string, schema *arrow.Schema) (RecordWriter, error)
+	// PartitionIdleTimeout is how long a partition may go without rows
+	// before its writer is closed.
+	PartitionIdleTimeout time.Duration
+	// Kinds routes the records of a kind to the partition at the path of
+	// the kind, built with its schema by NewPartitionWriter. Records of no
+	// kind go through Converter to FlightSvc. It excludes Partitioner.
+	Kinds *Kinds
+	// Rollup summarizes the records over tumbling windows, optional. Its
+	// rows are sent instead of the records, unless NewRollupWriter opens a
+	// stream of their own for them.
+	Rollup          *Rollup
+	NewRollupWriter func(schema *arrow.Schema) (RecordWriter, error)
+
+	mu     sync.Mutex
+	stop   chan struct{}
+	root   partition
+	parts  map[string]*partition
+	rollup *partition
+	// nextSchema is the schema the Flight server changed to, applied by
+	// applySchema once the partitions are no longer in use. refused is the
+	// last one that failed checkSchema.
+	nextSchema *arrow.Schema
+	refused    *arrow.Schema
+	// swapping is set while applySchema runs, the writes of SetSchema must
+	// not start another swap
+	swapping bool
 }
 
-// ArrowFlightService aids and creates a Arrow Flight Client and Flight Writer.
-type ArrowFlightService struct {
-	ArrowFlightServerUrl string
-	Writer               flight.Writer
+// partition is a stream of the output with its own Converter and writer.
+// The output without a Partitioner is the root partition, whose converter
+// and writer are Converter and FlightSvc.
+type partition struct {
+	path      []string
+	conv      *convert.Converter
+	w         RecordWriter
+	lastUsed  time.Time
+	held      []arrow.Record
+	heldBytes int64
+	// prov is the provenance of the rows pending in conv
+	prov provenance
 }
 
-func NewFlightService(url string, schema *arrow.Schema) (*ArrowFlightService, error) {
-	conn, err := grpc.Dial(url, grpc.WithInsecure()) // TODO: convert this into secure
+// SetSchema sets Schema and replaces the converter by one for schema. Rows
+// pending in the old converter have the old schema the Flight server no
+// longer takes, they are counted as dropped. Partitions write or spool their
+// pending rows and are closed, they are reopened with schema on demand.
+//
+// It must not run while the partitions are in use, a schema change reported
+// by the Flight server is applied with applySchema.
+func (c *PluginContext) SetSchema(schema *arrow.Schema) error {
+	conv, err := c.newConverter(schema)
+	if err != nil {
+		return err
+	}
+	if c.Converter != nil {
+		rows := int64(c.Converter.Pending())
+		if r := c.Converter.Flush(); r != nil {
+			r.Release()
+		}
+		for _, h := range c.root.held {
+			rows += h.NumRows()
+		}
+		c.root.releaseHeld()
+		if rows > 0 {
+			c.Logger.Warn("rows of the old schema dropped on schema change", "rows", rows)
+			c.Metrics.RecordsDropped.Add(float64(rows))
+		}
+		c.Converter.Release()
+	}
+	c.Schema = schema
+	c.Converter = conv
+	c.root.prov = provenance{}
+	for key, p := range c.parts {
+		c.salvage(c.Logger, p)
+		p.conv.Release()
+		if err := p.w.Close(); err != nil {
+			c.Logger.Warn("failed to close partition", "partition", key, "error", err)
+		}
+		delete(c.parts, key)
+	}
+	c.Metrics.Partitions.Set(0)
+	c.Metrics.PendingRows.Set(0)
+	return nil
+}
+
+// applySchema switches to the schema the Flight server changed to, if it
+// passes checkSchema. Otherwise the records keep being built with the old
+// schema and the batches the server refuses are dropped.
+func (c *PluginContext) applySchema(l *flblog.Logger) {
+	schema := c.nextSchema
+	if schema == nil || c.swapping {
+		return
+	}
+	c.nextSchema = nil
+	if schema.Equal(c.Schema) || (c.refused != nil && schema.Equal(c.refused)) {
+		return
+	}
+	c.swapping = true
+	defer func() { c.swapping = false }()
+	if err := c.checkSchema(schema); err != nil {
+		c.refused = schema
+		l.Error("flight server schema not applied, record batches of the old schema are dropped", "error", err)
+		return
+	}
+	if err := c.SetSchema(schema); err != nil {
+		c.refused = schema
+		l.Error("flight server schema not applied, record batches of the old schema are dropped", "error", err)
+		return
+	}
+	c.refused = nil
+	l.Info("flight server schema applied", "columns", len(schema.Fields()))
+}
+
+// checkSchema reports whether the records can be built with schema: it must
+// pass ValidateSchema and have the columns the output is configured with.
+func (c *PluginContext) checkSchema(schema *arrow.Schema) error {
+	if issues := ValidateSchema(schema, c.TimeFields, nil); len(issues) > 0 {
+		return &arrowschema.SchemaError{Source: "of the flight server", Issues: issues}
+	}
+	var cols []string
+	if c.ExtraFieldsColumn != "" {
+		cols = append(cols, c.ExtraFieldsColumn)
+	}
+	for _, col := range c.MetadataFields {
+		cols = append(cols, col)
+	}
+	if c.Dedup != nil {
+		cols = append(cols, c.Dedup.Keys...)
+	}
+	for _, col := range cols {
+		if _, ok := schema.FieldsByName(col); !ok {
+			return fmt.Errorf("column [%s] is not in the schema", col)
+		}
+	}
+	if len(c.SortKeys) > 0 {
+		keys := make([]string, len(c.SortKeys))
+		for i, k := range c.SortKeys {
+			keys[i] = k.Column
+		}
+		if _, err := convert.ParseSortKeys(strings.Join(keys, ","), schema); err != nil {
+			return err
+		}
+	}
+	if c.Partitioner != nil {
+		for _, col := range c.Partitioner.Columns {
+			fields, ok := schema.FieldsByName(col.Name)
+			if !ok {
+				return fmt.Errorf("partition column [%s] is not in the schema", col.Name)
+			}
+			if col.Bucket > 0 && !arrow.TypeEqual(fields[0].Type, col.typ) {
+				return fmt.Errorf("partition column [%s]: time bucket requires a %s column, found %s", col.Name, col.typ, fields[0].Type)
+			}
+		}
+	}
+	return nil
+}
+
+// salvage seals the pending rows of p and writes them and the batches held
+// back directly to its writer, which keeps its schema. Batches the writer
+// fails are spooled if there is a Spool, otherwise counted as dropped. It
+// does not replay the spool, SetSchema may run in the middle of a replay.
+func (c *PluginContext) salvage(l *flblog.Logger, p *partition) {
+	batches := p.held
+	p.held, p.heldBytes = nil, 0
+	if r := p.conv.Flush(); r != nil {
+		r = c.sortBatch(l, p, p.prov.attach(r))
+		batches = append(batches, convert.Split(r, c.MaxBatchBytes)...)
+		r.Release()
+	}
+	p.prov = provenance{}
+	for _, r := range batches {
+		err := c.writeRecord(p, r)
+		if err != nil && c.Spool != nil {
+			err = c.Spool.Put(r, p.path)
+		}
+		if err != nil {
+			l.Warn("pending rows of partition dropped on schema change", "partition", partitionKey(p.path), "rows", r.NumRows(), "error", err)
+			c.Metrics.RecordsDropped.Add(float64(r.NumRows()))
+		}
+		r.Release()
+	}
+	if err := p.w.Flush(); err != nil {
+		l.Warn("pending rows of partition not acknowledged on schema change", "partition", partitionKey(p.path), "error", err)
+	}
+}
+
+func (c *PluginContext) newConverter(schema *arrow.Schema) (*convert.Converter, error) {
+	cfg := convert.Config{
+		TimeFields:  c.TimeFields,
+		BatchSize:   c.RecordBatchThreshold,
+		ExtraColumn: c.ExtraFieldsColumn,
+		OnError: func(err *convert.ValueError) {
+			c.Metrics.ConversionError(err.Column, err.Reason)
+			c.Logger.Warn("failed to convert value", "column", err.Column, "reason", err.Reason, "error", err.Err)
+		},
+	}
+	if c.Memory != nil {
+		cfg.Allocator = c.Memory
+	}
+	return convert.New(schema, cfg)
+}
+
+// rootPartition returns the root partition.
+func (c *PluginContext) rootPartition() *partition {
+	c.root.conv = c.Converter
+	c.root.w = c.FlightSvc
+	return &c.root
+}
+
+// partitionAt returns the partition at path, opening it if needed with the
+// schema of the kind at path, or Schema. A nil path is the root partition.
+func (c *PluginContext) partitionAt(path []string) (*partition, error) {
+	if path == nil {
+		return c.rootPartition(), nil
+	}
+	key := partitionKey(path)
+	if c.NewRollupWriter != nil && key == partitionKey(rollupPath) {
+		return c.rollupPartition()
+	}
+	if p, ok := c.parts[key]; ok {
+		return p, nil
+	}
+	if c.NewPartitionWriter == nil {
+		return nil, fmt.Errorf("no writer for partition [%s]", key)
+	}
+	schema := c.Schema
+	if c.Kinds != nil {
+		k := c.Kinds.kindAt(path)
+		if k == nil {
+			return nil, fmt.Errorf("no kind for partition [%s]", key)
+		}
+		schema = k.Schema
+	}
+
+	conv, err := c.newConverter(schema)
+	if err != nil {
+		return nil, err
+	}
+	w, err := c.NewPartitionWriter(path, schema)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create grpc connection [%s]", url)
+		conv.Release()
+		return nil, fmt.Errorf("failed to open partition [%s]: %w", key, err)
+	}
+	p := &partition{path: path, conv: conv, w: w, lastUsed: time.Now()}
+	if c.parts == nil {
+		c.parts = make(map[string]*partition)
 	}
-	//defer conn.Close()
+	c.parts[key] = p
+	c.Metrics.Partitions.Set(float64(len(c.parts)))
+	c.Logger.Debug("partition opened", "partition", key)
+	return p, nil
+}
 
-	client := flight.NewFlightServiceClient(conn)
-	p, err := client.DoPut(context.Background()) // TODO: Pass GRPC call option here
+// CheckKinds reports the first kind of Kinds whose records cannot be
+// converted, e.g. because its ExtraFieldsColumn has an unsuitable type. It
+// is called once the output is configured, a kind failing only once its
+// first record arrives would have its records dropped.
+func (c *PluginContext) CheckKinds() error {
+	if c.Kinds == nil {
+		return nil
+	}
+	for _, k := range c.Kinds.Kinds {
+		conv, err := c.newConverter(k.Schema)
+		if err != nil {
+			return fmt.Errorf("kind [%s]: %w", partitionKey(k.Path), err)
+		}
+		conv.Release()
+	}
+	return nil
+}
+
+// rollupPartition returns the partition of the rollup stream, opening it
+// with NewRollupWriter if needed.
+func (c *PluginContext) rollupPartition() (*partition, error) {
+	if c.rollup != nil {
+		return c.rollup, nil
+	}
+	schema := c.Rollup.Schema()
+	conv, err := c.newConverter(schema)
 	if err != nil {
 		return nil, err
 	}
-	wtr := flight.NewRecordWriter(p, ipc.WithSchema(schema))
-	desc := &flight.FlightDescriptor{
-		Type: flight.DescriptorUNKNOWN,
+	w, err := c.NewRollupWriter(schema)
+	if err != nil {
+		conv.Release()
+		return nil, fmt.Errorf("failed to open rollup stream: %w", err)
 	}
-	wtr.SetFlightDescriptor(desc)
+	c.rollup = &partition{path: rollupPath, conv: conv, w: w, lastUsed: time.Now()}
+	return c.rollup, nil
+}
 
-	return &ArrowFlightService{
-		ArrowFlightServerUrl: url,
-		Writer:               *wtr,
-	}, nil
+// partitions returns the root partition followed by the others and the
+// rollup stream.
+func (c *PluginContext) partitions() []*partition {
+	ps := make([]*partition, 0, len(c.parts)+2)
+	ps = append(ps, c.rootPartition())
+	for _, p := range c.parts {
+		ps = append(ps, p)
+	}
+	if c.rollup != nil {
+		ps = append(ps, c.rollup)
+	}
+	return ps
 }
 
-// Write a Record
-func (svc ArrowFlightService) Write(record arrow.Record) {
-	svc.Writer.Write(record)
+// pendingRows returns the number of rows pending in all partitions.
+func (c *PluginContext) pendingRows() int {
+	var n int
+	for _, p := range c.partitions() {
+		if p.conv != nil {
+			n += p.conv.Pending()
+		}
+	}
+	return n
 }
 
-// ArrowRecordBuilder maps fieldName to its array.Builder
-// This is created based on the given arrow schema.
-type ArrowRecordBuilder struct {
-	RecordBuilder *array.RecordBuilder
-	FieldIndex    map[string]array.Builder
+// Deliver converts a msgpack chunk as handed to the output by Fluent Bit
+// and writes the record batches sealed on the way. With RequireAck the rest
+// of the chunk is sealed too and Deliver waits for the acknowledgements. An
+// error means the chunk has to be retried.
+//
+// Pending rows are sealed early when the memory limit is reached, a chunk
+// arriving while the output is still above it is retried with
+// ErrMemoryLimit. Likewise a full spool with the SpoolRetry policy that
+// cannot be replayed retries the chunk with ErrSpoolFull.
+//
+// With Dedup, records already seen are dropped. With Rollup, the records
+// are summarized and the rows of the windows that have closed are sent. The
+// keys and summaries of a chunk that has to be retried are undone, and so
+// are its rows still pending in the converters.
+//
+// A schema change reported by the Flight server is applied once the chunk
+// is done.
+func (c *PluginContext) Deliver(data []byte, tag string) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// after the rows of a failed chunk are discarded
+	defer c.applySchema(c.Logger.With("tag", tag))
+	pending := make(map[*convert.Converter]int)
+	for _, p := range c.partitions() {
+		pending[p.conv] = p.conv.Pending()
+	}
+	defer func() {
+		if err != nil {
+			c.discardChunk(c.Logger.With("tag", tag), pending)
+		}
+	}()
+	if c.Dedup != nil {
+		defer func() {
+			if err != nil {
+				c.Dedup.Rollback()
+			} else {
+				c.Dedup.Commit()
+			}
+		}()
+	}
+	if c.Rollup != nil {
+		defer func() {
+			if err != nil {
+				c.Rollup.Rollback()
+			} else {
+				c.Rollup.Commit()
+			}
+			c.Metrics.RollupGroups.Set(float64(c.Rollup.Len()))
+		}()
+	}
+	// batches still held back belong to a chunk that is retried
+	defer func() {
+		for _, p := range c.partitions() {
+			p.releaseHeld()
+		}
+	}()
+	l := c.Logger.With("tag", tag)
+	if c.Memory != nil {
+		defer func() { c.Metrics.MemoryBytes.Set(float64(c.Memory.Allocated())) }()
+		if c.Memory.OverLimit() {
+			l.Warn("memory limit reached, retrying chunk", "allocated", c.Memory.Allocated(), "limit", c.Memory.Limit)
+			return ErrMemoryLimit
+		}
+	}
+	if c.Spool != nil && c.Spool.Config.Overflow == SpoolRetry && c.Spool.Full() {
+		if err := c.replaySpool(l); err != nil || c.Spool.Full() {
+			l.Warn("spool full, retrying chunk", "size", c.Spool.Size(), "limit", c.Spool.Config.MaxSize)
+			return ErrSpoolFull
+		}
+	}
+	now := time.Now()
+	dec := convert.NewDecoder(data)
+	for {
+		ts, record, err := dec.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// retrying would fail the same way
+			l.Error("failed to decode chunk", "error", err)
+			break
+		}
+		c.Metrics.RecordsReceived.Inc()
+		if len(c.MetadataFields) > 0 {
+			addMetadata(record, dec.Metadata(), c.MetadataFields)
+		}
+		if l.Enabled(flblog.LevelTrace) {
+			for k, v := range record {
+				if b, ok := v.([]uint8); ok {
+					v = string(b)
+				}
+				l.Trace("field value", "column", fmt.Sprint(k), "value", v)
+			}
+		}
+		if c.Dedup != nil && c.Dedup.Duplicate(record, now) {
+			c.Metrics.RecordsDeduped.Inc()
+			continue
+		}
+		if c.Rollup != nil {
+			c.Rollup.Add(ts, record)
+			if c.NewRollupWriter == nil {
+				continue
+			}
+		}
+		if err := c.appendRecord(l, tag, ts, record, now); err != nil {
+			return err
+		}
+	}
+	if c.Rollup != nil {
+		if err := c.appendRollup(l, c.Rollup.Closed(now), now); err != nil {
+			return err
+		}
+	}
+
+	// With acknowledgements the chunk is only done once every row of it has
+	// been sent and accepted, so seal the remaining rows and wait for the acks.
+	if c.RequireAck {
+		for _, p := range c.partitions() {
+			if r := p.conv.Flush(); r != nil {
+				if err := c.writeBatch(l, p, r); err != nil {
+					return err
+				}
+			}
+		}
+		c.Metrics.PendingRows.Set(0)
+	}
+	for _, p := range c.partitions() {
+		if err := c.flushHeld(l, p); err != nil {
+			return err
+		}
+	}
+	if c.RequireAck {
+		if err := c.flushWriters(); err != nil {
+			l.Error("record batches not acknowledged", "error", err)
+			return err
+		}
+	}
+	c.closeIdle(l, now)
+	return nil
+}
+
+// discardChunk drops the rows a failed chunk appended to the converters,
+// pending holds the rows pending in each converter before the chunk. The
+// rows of earlier chunks pending with them are sealed and written.
+func (c *PluginContext) discardChunk(l *flblog.Logger, pending map[*convert.Converter]int) {
+	for _, p := range c.partitions() {
+		before := pending[p.conv]
+		if p.conv.Pending() <= before {
+			continue
+		}
+		r := p.conv.Flush()
+		l.Debug("rows of the retried chunk discarded", "rows", r.NumRows()-int64(before))
+		if before > 0 {
+			if err := c.writeBatch(l, p, r.NewSlice(0, int64(before))); err != nil {
+				l.Error("failed to write pending rows", "rows", before, "error", err)
+			}
+			c.flushHeld(l, p)
+		}
+		r.Release()
+		p.prov = provenance{}
+	}
+	c.Metrics.PendingRows.Set(float64(c.pendingRows()))
+}
+
+// addMetadata adds the values of the metadata keys in fields to record
+// under their columns. Fields of record take precedence.
+func addMetadata(record, metadata map[interface{}]interface{}, fields map[string]string) {
+	for k, v := range metadata {
+		key, ok := k.(string)
+		if !ok {
+			continue
+		}
+		col, ok := fields[key]
+		if !ok {
+			continue
+		}
+		if _, ok := record[col]; !ok {
+			record[col] = v
+		}
+	}
 }
 
-// NewRecordBuilder creates ArrowRecordBuilder, which maps fieldName to
-// array.Builder. This id derived from a configured arrow Schema.
-func NewRecordBuilder(schema *arrow.Schema) (*ArrowRecordBuilder, error) {
-	b := array.NewRecordBuilder(&memory.GoAllocator{}, schema)
-	bldr := &ArrowRecordBuilder{
-		RecordBuilder: b,
-		FieldIndex:    make(map[string]array.Builder, len(schema.Fields())),
+// appendRecord appends record to the converter of its partition and writes
+// the batch this seals.
+func (c *PluginContext) appendRecord(l *flblog.Logger, tag string, ts time.Time, record map[interface{}]interface{}, now time.Time) error {
+	var path []string
+	switch {
+	case c.Kinds != nil:
+		if k := c.Kinds.Route(tag, record); k != nil {
+			path = k.Path
+		}
+	case c.Partitioner != nil:
+		path = c.Partitioner.Partition(record)
 	}
-	fields := schema.Fields()
-	for indx, field := range fields {
-		bldr.FieldIndex[field.Name] = b.Field(indx)
+	p, err := c.partitionAt(path)
+	if err != nil {
+		// opening it again would fail the same way, retrying the chunk
+		// would only hold back the records of the other partitions
+		l.Error("failed to open partition, record dropped", "partition", partitionKey(path), "error", err)
+		c.Metrics.RecordsDropped.Inc()
+		return nil
+	}
+	p.lastUsed = now
+	return c.appendTo(l, p, tag, ts, record)
+}
+
+// appendTo appends record of tag to the converter of p and writes the batch
+// this seals.
+func (c *PluginContext) appendTo(l *flblog.Logger, p *partition, tag string, ts time.Time, record map[interface{}]interface{}) error {
+	p.prov.add(tag, ts)
+	r := p.conv.Append(ts, record)
+	if r == nil && c.Memory != nil && c.Memory.OverLimit() {
+		r = p.conv.Flush()
+		c.Metrics.LimitFlushes.Inc()
+	}
+	c.Metrics.RecordsConverted.Inc()
+	c.Metrics.PendingRows.Set(float64(c.pendingRows()))
+	if r != nil {
+		return c.writeBatch(l, p, r)
 	}
-	return bldr, nil
+	return nil
+}
+
+// appendRollup appends the rollup rows to the rollup stream, or like
+// records if the rows replace them.
+func (c *PluginContext) appendRollup(l *flblog.Logger, rows []RollupRow, now time.Time) error {
+	if len(rows) > 0 {
+		l.Debug("rollup windows closed", "rows", len(rows))
+	}
+	for _, row := range rows {
+		if c.NewRollupWriter == nil {
+			if err := c.appendRecord(l, "", row.Start, row.Record, now); err != nil {
+				return err
+			}
+			continue
+		}
+		p, err := c.rollupPartition()
+		if err != nil {
+			l.Error("failed to open rollup stream", "error", err)
+			return err
+		}
+		if err := c.appendTo(l, p, "", row.Start, row.Record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBatch sorts r, the rows sealed by the converter of p, slices it into
+// batches of at most MaxBatchBytes and sends them, batches below
+// TargetBatchBytes are held back in p to be coalesced until flushHeld. r is
+// released.
+func (c *PluginContext) writeBatch(l *flblog.Logger, p *partition, r arrow.Record) error {
+	r = p.prov.attach(r)
+	p.prov = provenance{}
+	r = c.sortBatch(l, p, r)
+	defer r.Release()
+	parts := convert.Split(r, c.MaxBatchBytes)
+	if len(parts) > 1 {
+		c.Metrics.BatchesSplit.Inc()
+		l.Debug("record batch split", "rows", r.NumRows(), "parts", len(parts))
+	}
+	var err error
+	for _, part := range parts {
+		if err != nil {
+			part.Release()
+			continue
+		}
+		err = c.queueBatch(l, p, part)
+	}
+	return err
+}
+
+// queueBatch sends r, or holds it back in p if it is smaller than
+// TargetBatchBytes and can be coalesced. r is released.
+func (c *PluginContext) queueBatch(l *flblog.Logger, p *partition, r arrow.Record) error {
+	if c.TargetBatchBytes <= 0 || !convert.Concatenable(r.Schema()) {
+		return c.sendBatch(l, p, r)
+	}
+	size := convert.EstimateSize(r, 0, r.NumRows())
+	if len(p.held) > 0 && (p.heldBytes+size > c.TargetBatchBytes || !p.held[0].Schema().Equal(r.Schema())) {
+		if err := c.flushHeld(l, p); err != nil {
+			r.Release()
+			return err
+		}
+	}
+	if size >= c.TargetBatchBytes {
+		return c.sendBatch(l, p, r)
+	}
+	p.held = append(p.held, r)
+	p.heldBytes += size
+	return nil
+}
+
+// flushHeld concatenates the batches held back in p and sends the result.
+func (c *PluginContext) flushHeld(l *flblog.Logger, p *partition) error {
+	held := p.held
+	p.held, p.heldBytes = nil, 0
+	switch len(held) {
+	case 0:
+		return nil
+	case 1:
+		return c.sendBatch(l, p, held[0])
+	}
+
+	var prov provenance
+	for _, h := range held {
+		prov.merge(provenanceOf(h))
+	}
+	r, err := convert.Concat(held, c.allocator())
+	if err != nil {
+		l.Warn("failed to coalesce record batches, sending them one by one", "batches", len(held), "error", err)
+		for i, h := range held {
+			if err := c.sendBatch(l, p, h); err != nil {
+				releaseRecords(held[i+1:])
+				return err
+			}
+		}
+		return nil
+	}
+	releaseRecords(held)
+	c.Metrics.BatchesCoalesced.Add(float64(len(held)))
+	// the coalesced batches are only sorted one by one
+	return c.sendBatch(l, p, c.sortBatch(l, p, prov.attach(r)))
+}
+
+// sortBatch returns r sorted by SortKeys and releases r. A batch that
+// cannot be sorted is returned as it is, batches of the rollup stream are
+// not sorted.
+func (c *PluginContext) sortBatch(l *flblog.Logger, p *partition, r arrow.Record) arrow.Record {
+	if len(c.SortKeys) == 0 || p == c.rollup || r.NumRows() < 2 {
+		return r
+	}
+	sorted, err := convert.Sort(r, c.SortKeys, c.allocator())
+	if err != nil {
+		l.Warn("failed to sort record batch, sending it unsorted", "rows", r.NumRows(), "error", err)
+		return r
+	}
+	r.Release()
+	return sorted
+}
+
+// allocator returns the allocator for batches built from sealed ones.
+func (c *PluginContext) allocator() memory.Allocator {
+	if c.Memory != nil {
+		return c.Memory
+	}
+	return memory.DefaultAllocator
+}
+
+// releaseHeld discards the batches held back.
+func (p *partition) releaseHeld() {
+	releaseRecords(p.held)
+	p.held, p.heldBytes = nil, 0
+}
+
+// sendBatch writes r to the writer of p and releases it. Failed batches are
+// spooled if there is a Spool, otherwise dropped unless RequireAck is set,
+// then the error is returned.
+func (c *PluginContext) sendBatch(l *flblog.Logger, p *partition, r arrow.Record) error {
+	defer r.Release()
+	if c.Spool != nil && c.Spool.Len() > 0 {
+		// r must not overtake the spooled batches
+		if err := c.replaySpool(l); err != nil {
+			return c.spoolBatch(l, p, r)
+		}
+	}
+	if err := c.writeRecord(p, r); err != nil {
+		l.Error("failed to write record batch", "error", err)
+		// a batch rejected for good would only be discarded on replay
+		if c.Spool != nil && !permanent(err) {
+			return c.spoolBatch(l, p, r)
+		}
+		if c.RequireAck {
+			return err
+		}
+		c.Metrics.RecordsDropped.Add(float64(r.NumRows()))
+	}
+	return nil
+}
+
+// spoolBatch puts r into the spool. If that fails r is dropped unless
+// RequireAck is set, then the error is returned.
+func (c *PluginContext) spoolBatch(l *flblog.Logger, p *partition, r arrow.Record) error {
+	if err := c.Spool.Put(r, p.path); err != nil {
+		l.Error("failed to spool record batch", "error", err)
+		if c.RequireAck {
+			return err
+		}
+		c.Metrics.RecordsDropped.Add(float64(r.NumRows()))
+		return nil
+	}
+	l.Debug("record batch spooled", "rows", r.NumRows(), "batches", c.Spool.Len())
+	return nil
+}
+
+// replaySpool writes the spooled batches to the partitions they were
+// spooled for, see Spool.Replay. Batches whose schema is no longer the one
+// of their partition, e.g. after Schema_File changed across a restart, and
+// batches the writer rejects for good are dropped, they would otherwise
+// block the spool forever.
+// Callers must hold c.mu.
+func (c *PluginContext) replaySpool(l *flblog.Logger) error {
+	n := c.Spool.Len()
+	err := c.Spool.Replay(func(r arrow.Record, path []string) error {
+		p, err := c.partitionAt(path)
+		if err != nil {
+			l.Warn("partition of spooled record batch cannot be opened, dropped", "partition", partitionKey(path), "rows", r.NumRows(), "error", err)
+			c.Metrics.RecordsDropped.Add(float64(r.NumRows()))
+			return nil
+		}
+		if schema := c.partitionSchema(p); schema != nil && !r.Schema().Equal(schema) {
+			l.Warn("spooled record batch does not match the partition schema, dropped", "partition", partitionKey(path), "rows", r.NumRows())
+			c.Metrics.RecordsDropped.Add(float64(r.NumRows()))
+			return nil
+		}
+		err = c.writeRecord(p, r)
+		if permanent(err) {
+			l.Warn("spooled record batch rejected, dropped", "partition", partitionKey(path), "rows", r.NumRows(), "error", err)
+			c.Metrics.RecordsDropped.Add(float64(r.NumRows()))
+			return nil
+		}
+		if err == nil {
+			c.Metrics.BatchesReplayed.Inc()
+		}
+		return err
+	}, c.flushWriters)
+	if err != nil {
+		l.Debug("spool not replayed", "batches", c.Spool.Len(), "error", err)
+		return err
+	}
+	l.Info("spool replayed", "batches", n)
+	return nil
+}
+
+// partitionSchema returns the schema the batches of p are built with, nil
+// if the context has none yet.
+func (c *PluginContext) partitionSchema(p *partition) *arrow.Schema {
+	if p.conv != nil {
+		return p.conv.Schema()
+	}
+	return c.Schema
+}
+
+// permanent reports whether err means that writing the batch again cannot
+// succeed: it was built with a schema the Flight server no longer has, or
+// the server rejected it as invalid.
+func permanent(err error) bool {
+	var sc *SchemaChangedError
+	return errors.As(err, &sc) || status.Code(err) == codes.InvalidArgument
+}
+
+// flushWriters flushes the writers of all partitions.
+func (c *PluginContext) flushWriters() error {
+	for _, p := range c.partitions() {
+		if err := p.w.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeIdle closes the partitions that received no rows since
+// PartitionIdleTimeout before now, their pending rows are written first.
+func (c *PluginContext) closeIdle(l *flblog.Logger, now time.Time) {
+	if c.PartitionIdleTimeout <= 0 {
+		return
+	}
+	for key, p := range c.parts {
+		if now.Sub(p.lastUsed) < c.PartitionIdleTimeout {
+			continue
+		}
+		if err := c.closePartition(l, p); err != nil {
+			l.Error("failed to close partition", "partition", key, "error", err)
+		}
+		delete(c.parts, key)
+		l.Debug("partition closed", "partition", key)
+	}
+	c.Metrics.Partitions.Set(float64(len(c.parts)))
+}
+
+// closePartition writes the pending rows of p and closes its writer.
+func (c *PluginContext) closePartition(l *flblog.Logger, p *partition) error {
+	var err error
+	if r := p.conv.Flush(); r != nil {
+		err = c.writeBatch(l, p, r)
+	}
+	if ferr := c.flushHeld(l, p); err == nil {
+		err = ferr
+	}
+	if err == nil {
+		err = p.w.Flush()
+	}
+	p.releaseHeld()
+	p.conv.Release()
+	if cerr := p.w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// StartTimer replays the spool and sends the rows of the rollup windows
+// that have closed every interval until Close, so that the spool drains
+// once the Flight server is back and windows are sent even if no chunks
+// arrive.
+func (c *PluginContext) StartTimer(interval time.Duration) {
+	c.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-t.C:
+				c.mu.Lock()
+				if c.Spool != nil && c.Spool.Len() > 0 {
+					c.replaySpool(c.Logger)
+				}
+				if c.Rollup != nil && c.Converter != nil {
+					c.closeWindows(c.Logger, now)
+				}
+				c.applySchema(c.Logger)
+				c.mu.Unlock()
+			}
+		}
+	}(c.stop)
+}
+
+// closeWindows writes the rows of the rollup windows that have closed by
+// now. If they cannot be appended they stay in the Rollup for the next
+// chunk or tick.
+func (c *PluginContext) closeWindows(l *flblog.Logger, now time.Time) {
+	pending := make(map[*convert.Converter]int)
+	for _, p := range c.partitions() {
+		pending[p.conv] = p.conv.Pending()
+	}
+	rows := c.Rollup.Closed(now)
+	if len(rows) == 0 {
+		return
+	}
+	if err := c.appendRollup(l, rows, now); err != nil {
+		l.Warn("rollup rows not sent, retrying with the next chunk", "error", err)
+		c.Rollup.Rollback()
+		c.discardChunk(l, pending)
+		for _, p := range c.partitions() {
+			p.releaseHeld()
+		}
+		return
+	}
+	c.Rollup.Commit()
+	c.Metrics.RollupGroups.Set(float64(c.Rollup.Len()))
+	c.flushPartitions(l)
+}
+
+// flushPartitions writes the pending and held back rows of all partitions.
+func (c *PluginContext) flushPartitions(l *flblog.Logger) {
+	for _, p := range c.partitions() {
+		if r := p.conv.Flush(); r != nil {
+			if err := c.writeBatch(l, p, r); err != nil {
+				l.Error("failed to write pending rows", "error", err)
+			}
+		}
+		if err := c.flushHeld(l, p); err != nil {
+			l.Error("failed to write pending rows", "error", err)
+		}
+	}
+	c.Metrics.PendingRows.Set(0)
+}
+
+// Close writes the pending rows and the rows of all rollup windows, or
+// spools them if that fails, then releases the converters and closes the
+// writers of the partitions and FlightSvc. Arrow memory still allocated
+// afterwards has leaked and is logged.
+func (c *PluginContext) Close() error {
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Converter != nil {
+		if c.Rollup != nil {
+			c.appendRollup(c.Logger, c.Rollup.Drain(), time.Now())
+		}
+		c.flushPartitions(c.Logger)
+	}
+	var err error
+	for key, p := range c.parts {
+		p.releaseHeld()
+		p.conv.Release()
+		if cerr := p.w.Close(); err == nil {
+			err = cerr
+		}
+		delete(c.parts, key)
+	}
+	if p := c.rollup; p != nil {
+		p.releaseHeld()
+		p.conv.Release()
+		if cerr := p.w.Close(); err == nil {
+			err = cerr
+		}
+		c.rollup = nil
+	}
+	if c.Converter != nil {
+		c.Converter.Release()
+		c.Converter = nil
+	}
+	if c.FlightSvc != nil {
+		if cerr := c.FlightSvc.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if c.Memory != nil && c.Memory.CheckLeaks(c.Logger) {
+		c.Logger.Error("arrow memory not released on close", "bytes", c.Memory.Allocated())
+	}
+	return err
+}
+
+// WriteRecord hands record to FlightSvc and records the outcome in Metrics.
+// A SchemaChangedError from FlightSvc switches the context to the new
+// schema before it is returned.
+func (c *PluginContext) WriteRecord(record arrow.Record) error {
+	err := c.writeRecord(c.rootPartition(), record)
+	c.applySchema(c.Logger)
+	return err
+}
+
+// writeRecord is WriteRecord for the writer of p.
+func (c *PluginContext) writeRecord(p *partition, record arrow.Record) error {
+	start := time.Now()
+	err := p.w.Write(record)
+	c.Metrics.ObserveWrite(record, time.Since(start), err)
+
+	// the server changed the schema, the rows of the following chunks are
+	// built with the new one
+	var sc *SchemaChangedError
+	if errors.As(err, &sc) {
+		c.nextSchema = sc.Schema
+	}
+	return err
+}
+
+// RecordWriter writes sealed Arrow records to a remote destination.
+// ArrowFlightService and FlightSQLService are its implementations.
+type RecordWriter interface {
+	Write(record arrow.Record) error
+	// Flush blocks until every record written so far has been accepted by
+	// the remote end, or returns an error if that cannot be confirmed.
+	Flush() error
+	Close() error
 }
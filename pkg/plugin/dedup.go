@@ -0,0 +1,168 @@
+package plugin
+
+import (
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/anaray/fluent-bit-arrow-plugin/pkg/convert"
+)
+
+// DefaultDedupMaxKeys bounds the keys a Deduplicator remembers when no
+// bound has been configured.
+const DefaultDedupMaxKeys = 100000
+
+// Deduplicator drops records whose key tuple was already seen within a
+// window. It remembers a 64 bit FNV-1a hash of at most MaxKeys tuples, the
+// oldest are forgotten first, and with Window tuples seen longer ago are
+// forgotten too. Only the hashes are compared, a record whose tuple has the
+// hash of another remembered tuple is dropped too. With 64 bits that takes
+// billions of remembered tuples to become likely.
+//
+// A Deduplicator is not safe for concurrent use.
+type Deduplicator struct {
+	Keys    []string
+	Window  time.Duration
+	MaxKeys int
+
+	seen map[uint64]struct{}
+	// order lists the remembered hashes from the oldest, starting at head
+	order []dedupEntry
+	head  int
+	// gen is the generation of the tuples remembered since the last Commit
+	gen uint64
+	// evicted lists the tuples of earlier generations forgotten since the
+	// last Commit, from the oldest
+	evicted []dedupEntry
+}
+
+type dedupEntry struct {
+	hash uint64
+	at   time.Time
+	gen  uint64
+}
+
+// NewDeduplicator returns a Deduplicator on keys. maxKeys defaults to
+// DefaultDedupMaxKeys, a zero window only forgets keys beyond maxKeys.
+func NewDeduplicator(keys []string, window time.Duration, maxKeys int) (*Deduplicator, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no dedup keys")
+	}
+	if window < 0 || maxKeys < 0 {
+		return nil, fmt.Errorf("invalid dedup window")
+	}
+	if maxKeys == 0 {
+		maxKeys = DefaultDedupMaxKeys
+	}
+	return &Deduplicator{
+		Keys:    keys,
+		Window:  window,
+		MaxKeys: maxKeys,
+		seen:    make(map[uint64]struct{}),
+	}, nil
+}
+
+// Duplicate reports whether the key tuple of record was seen within the
+// window, otherwise it is remembered as seen at now.
+func (d *Deduplicator) Duplicate(record map[interface{}]interface{}, now time.Time) bool {
+	d.expire(now)
+	h := d.hash(record)
+	if _, ok := d.seen[h]; ok {
+		return true
+	}
+	for len(d.seen) >= d.MaxKeys {
+		d.pop()
+	}
+	d.seen[h] = struct{}{}
+	d.order = append(d.order, dedupEntry{hash: h, at: now, gen: d.gen})
+	return false
+}
+
+// Commit keeps the tuples remembered since the last Commit.
+func (d *Deduplicator) Commit() {
+	d.gen++
+	d.evicted = d.evicted[:0]
+}
+
+// Rollback forgets the tuples remembered since the last Commit, so that the
+// records of a retried chunk are not taken for duplicates of themselves, and
+// remembers the tuples forgotten since then again.
+func (d *Deduplicator) Rollback() {
+	n := len(d.order)
+	for n > d.head && d.order[n-1].gen == d.gen {
+		n--
+		delete(d.seen, d.order[n].hash)
+	}
+	d.order = d.order[:n]
+	if len(d.evicted) > 0 {
+		order := make([]dedupEntry, 0, len(d.evicted)+n-d.head)
+		order = append(append(order, d.evicted...), d.order[d.head:]...)
+		for _, e := range d.evicted {
+			d.seen[e.hash] = struct{}{}
+		}
+		d.order, d.head = order, 0
+	}
+	d.gen++
+	d.evicted = d.evicted[:0]
+}
+
+// Len returns the number of key tuples remembered.
+func (d *Deduplicator) Len() int { return len(d.seen) }
+
+// expire forgets the tuples seen more than Window before now.
+func (d *Deduplicator) expire(now time.Time) {
+	if d.Window <= 0 {
+		return
+	}
+	for d.head < len(d.order) && now.Sub(d.order[d.head].at) > d.Window {
+		d.pop()
+	}
+}
+
+// pop forgets the oldest tuple.
+func (d *Deduplicator) pop() {
+	e := d.order[d.head]
+	if e.gen != d.gen {
+		d.evicted = append(d.evicted, e)
+	}
+	delete(d.seen, e.hash)
+	d.order[d.head] = dedupEntry{}
+	d.head++
+	// reuse the front of order once half of it is consumed
+	if d.head > len(d.order)/2 {
+		n := copy(d.order, d.order[d.head:])
+		d.order = d.order[:n]
+		d.head = 0
+	}
+}
+
+// hash hashes the values of the key fields of record in order, absent
+// fields count as null.
+func (d *Deduplicator) hash(record map[interface{}]interface{}) uint64 {
+	values := make(map[string]interface{}, len(d.Keys))
+	for k, v := range record {
+		switch k := k.(type) {
+		case string:
+			values[k] = v
+		case []byte:
+			values[string(k)] = v
+		}
+	}
+
+	h := fnv.New64a()
+	for _, key := range d.Keys {
+		v, ok := values[key]
+		if !ok || v == nil {
+			h.Write([]byte{0})
+			continue
+		}
+		s, ok := convert.Text(v)
+		if !ok {
+			s = fmt.Sprint(v)
+		}
+		h.Write([]byte{1})
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
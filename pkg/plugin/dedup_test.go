@@ -0,0 +1,102 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+)
+
+// duplicates returns for each id whether a record with it is a duplicate.
+func duplicates(d *Deduplicator, now time.Time, ids ...string) []bool {
+	var got []bool
+	for _, id := range ids {
+		got = append(got, d.Duplicate(map[interface{}]interface{}{"ID": id}, now))
+	}
+	return got
+}
+
+func newTestDeduplicator(t *testing.T, window time.Duration, maxKeys int) *Deduplicator {
+	t.Helper()
+	d, err := NewDeduplicator([]string{"ID"}, window, maxKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestDeduplicatorCommitRollback(t *testing.T) {
+	d := newTestDeduplicator(t, 0, 0)
+	now := time.Now()
+	if got := duplicates(d, now, "a", "b", "a"); got[0] || got[1] || !got[2] {
+		t.Fatalf("duplicates %v, want [false false true]", got)
+	}
+	d.Commit()
+
+	duplicates(d, now, "c")
+	d.Rollback()
+	if d.Len() != 2 {
+		t.Fatalf("%d keys remembered after Rollback, want 2", d.Len())
+	}
+	// the retried chunk is not a duplicate of itself, committed keys stay
+	if got := duplicates(d, now, "c", "a"); got[0] || !got[1] {
+		t.Fatalf("duplicates %v after Rollback, want [false true]", got)
+	}
+}
+
+func TestDeduplicatorRollbackRestoresEvicted(t *testing.T) {
+	d := newTestDeduplicator(t, 0, 3)
+	now := time.Now()
+	duplicates(d, now, "a", "b", "c")
+	d.Commit()
+
+	// a and b are forgotten to make room for the chunk
+	duplicates(d, now, "d", "e")
+	d.Rollback()
+	if d.Len() != 3 {
+		t.Fatalf("%d keys remembered after Rollback, want 3", d.Len())
+	}
+	if got := duplicates(d, now, "a", "b", "c"); !got[0] || !got[1] || !got[2] {
+		t.Fatalf("duplicates %v after Rollback, want [true true true]", got)
+	}
+
+	// a is still the oldest and forgotten first
+	duplicates(d, now, "d")
+	d.Commit()
+	if got := duplicates(d, now, "b", "a"); !got[0] || got[1] {
+		t.Fatalf("duplicates %v, want [true false]", got)
+	}
+}
+
+func TestDeduplicatorRollbackLargeChunk(t *testing.T) {
+	d := newTestDeduplicator(t, 0, 2)
+	now := time.Now()
+	duplicates(d, now, "a", "b")
+	d.Commit()
+
+	// more keys than MaxKeys, some of the chunk are forgotten within it
+	duplicates(d, now, "c", "d", "e", "f", "g")
+	d.Rollback()
+	if got := duplicates(d, now, "a", "b"); !got[0] || !got[1] {
+		t.Fatalf("duplicates %v after Rollback, want [true true]", got)
+	}
+	if got := duplicates(d, now, "g"); got[0] {
+		t.Fatal("key of the rolled back chunk still remembered")
+	}
+}
+
+func TestDeduplicatorWindow(t *testing.T) {
+	d := newTestDeduplicator(t, time.Minute, 0)
+	now := time.Now()
+	duplicates(d, now, "a")
+	duplicates(d, now.Add(30*time.Second), "b")
+	d.Commit()
+
+	later := now.Add(90 * time.Second)
+	if got := duplicates(d, later, "a", "b"); got[0] || !got[1] {
+		t.Fatalf("duplicates %v after the window, want [false true]", got)
+	}
+	// a expired within the rolled back chunk and is remembered again
+	d.Rollback()
+	if got := duplicates(d, now.Add(45*time.Second), "a"); !got[0] {
+		t.Fatal("key expired in a rolled back chunk forgotten")
+	}
+}
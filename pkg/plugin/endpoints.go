@@ -0,0 +1,322 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anaray/fluent-bit-arrow-plugin/internal/flblog"
+	"github.com/apache/arrow/go/v12/arrow"
+	"google.golang.org/grpc"
+)
+
+// Endpoint_Strategy values
+const (
+	StrategyFailover   = "failover"
+	StrategyRoundRobin = "round_robin"
+	StrategyDNS        = "dns"
+)
+
+// An endpoint that failed is skipped for a backoff that starts at
+// endpointBackoffMin and doubles with every further failure.
+const (
+	endpointBackoffMin = time.Second
+	endpointBackoffMax = time.Minute
+)
+
+// DNSDialOptions makes a connection balance its streams over every address
+// the DNS name of the target resolves to.
+func DNSDialOptions() []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithDefaultServiceConfig(`{"loadBalancingConfig": [{"round_robin": {}}]}`),
+	}
+}
+
+// DNSTarget returns url as a gRPC target resolved by the DNS resolver.
+func DNSTarget(url string) string {
+	if strings.Contains(url, "://") {
+		return url
+	}
+	return "dns:///" + url
+}
+
+// endpoint is a destination of Endpoints and its health.
+type endpoint struct {
+	url       string
+	w         RecordWriter
+	failures  int
+	downUntil time.Time
+	// records written since the last Flush, kept to be rerouted when the
+	// endpoint does not acknowledge them
+	inflight []arrow.Record
+	// failed is set when a Write failed since the last Flush, the writer
+	// has then given up on the acknowledgements of inflight
+	failed bool
+	// sent is the number of rows of the record last written without
+	// RequireAck, which a failing stream may have lost in flight
+	sent int64
+}
+
+// Endpoints is a RecordWriter spreading records over several destinations.
+// With StrategyFailover every record goes to the first healthy endpoint in
+// the configured order, with StrategyRoundRobin the endpoints take turns.
+//
+// An endpoint that fails a Write or Flush is unhealthy for a backoff, the
+// records it failed are rerouted to the remaining endpoints. Write fails only
+// if no endpoint accepts the record.
+//
+// Without RequireAck nothing confirms that a written record arrived. The
+// record last written to an endpoint whose next Write fails may have been
+// lost with its stream, it is not rerouted but counted as dropped.
+type Endpoints struct {
+	Strategy string
+	// RequireAck keeps written records until Flush so that the records of an
+	// endpoint failing to acknowledge them can be rerouted.
+	RequireAck bool
+
+	open    func(url string) (RecordWriter, error)
+	metrics *Metrics
+	logger  *flblog.Logger
+
+	mu   sync.Mutex
+	eps  []*endpoint
+	next int
+}
+
+// NewEndpoints creates a writer for each of urls with open. Endpoints that
+// cannot be opened are retried after their backoff, at least one has to
+// succeed. metrics and logger are optional.
+func NewEndpoints(urls []string, strategy string, requireAck bool, open func(url string) (RecordWriter, error), metrics *Metrics, logger *flblog.Logger) (*Endpoints, error) {
+	switch strategy {
+	case "":
+		strategy = StrategyFailover
+	case StrategyFailover, StrategyRoundRobin:
+	default:
+		return nil, fmt.Errorf("unsupported endpoint strategy [%s]", strategy)
+	}
+	e := &Endpoints{
+		Strategy:   strategy,
+		RequireAck: requireAck,
+		open:       open,
+		metrics:    metrics,
+		logger:     logger,
+	}
+
+	var errs []string
+	for _, url := range urls {
+		ep := &endpoint{url: url}
+		if w, err := open(url); err != nil {
+			errs = append(errs, fmt.Sprintf("[%s] %v", url, err))
+			e.markDown(ep, err)
+		} else {
+			ep.w = w
+		}
+		e.eps = append(e.eps, ep)
+	}
+	if len(errs) == len(urls) {
+		return nil, fmt.Errorf("no flight endpoint available: %s", strings.Join(errs, ", "))
+	}
+	e.updateConnected()
+	return e, nil
+}
+
+// Write hands record to the next healthy endpoint, moving on to the
+// following ones while they fail.
+func (e *Endpoints) Write(record arrow.Record) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.write(record)
+}
+
+// write implements Write. Callers must hold e.mu.
+func (e *Endpoints) write(record arrow.Record) error {
+	candidates := e.healthy(time.Now())
+	if len(candidates) == 0 {
+		return errors.New("no healthy flight endpoint")
+	}
+	if e.Strategy == StrategyRoundRobin {
+		e.next++
+	}
+
+	var err error
+	for _, ep := range candidates {
+		if ep.w == nil {
+			if ep.w, err = e.open(ep.url); err != nil {
+				e.markDown(ep, err)
+				continue
+			}
+		}
+		err = ep.w.Write(record)
+		var sc *SchemaChangedError
+		if errors.As(err, &sc) {
+			return err
+		}
+		if err != nil {
+			if len(ep.inflight) > 0 {
+				ep.failed = true
+			}
+			e.dropSent(ep)
+			e.markDown(ep, err)
+			continue
+		}
+		e.markUp(ep)
+		if e.RequireAck {
+			record.Retain()
+			ep.inflight = append(ep.inflight, record)
+		} else {
+			ep.sent = record.NumRows()
+		}
+		return nil
+	}
+	return err
+}
+
+// healthy returns the endpoints to try in the order of the strategy,
+// skipping those in their backoff. Callers must hold e.mu.
+func (e *Endpoints) healthy(now time.Time) []*endpoint {
+	start := 0
+	if e.Strategy == StrategyRoundRobin {
+		start = e.next % len(e.eps)
+	}
+	var eps []*endpoint
+	for i := range e.eps {
+		ep := e.eps[(start+i)%len(e.eps)]
+		if !now.Before(ep.downUntil) {
+			eps = append(eps, ep)
+		}
+	}
+	return eps
+}
+
+// Flush waits for the acknowledgements of every endpoint written to. The
+// records of an endpoint that fails are written to the others, Flush only
+// fails if they cannot be placed or acknowledged anywhere.
+func (e *Endpoints) Flush() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for range e.eps {
+		var reroute []arrow.Record
+		for _, ep := range e.eps {
+			if ep.w == nil || (e.RequireAck && len(ep.inflight) == 0) {
+				continue
+			}
+			var err error
+			if ep.failed {
+				err = fmt.Errorf("flight endpoint [%s] failed before acknowledging", ep.url)
+			} else {
+				err = ep.w.Flush()
+			}
+			ep.failed = false
+			if err != nil {
+				e.markDown(ep, err)
+				reroute = append(reroute, ep.inflight...)
+			} else {
+				releaseRecords(ep.inflight)
+			}
+			ep.inflight = nil
+		}
+		if len(reroute) == 0 {
+			return nil
+		}
+
+		if e.logger != nil {
+			e.logger.Warn("rerouting unacknowledged record batches", "batches", len(reroute))
+		}
+		var err error
+		for _, r := range reroute {
+			if err == nil {
+				err = e.write(r)
+			}
+			r.Release()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return errors.New("record batches not acknowledged by any flight endpoint")
+}
+
+// Close closes the writer of every endpoint.
+func (e *Endpoints) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var err error
+	for _, ep := range e.eps {
+		releaseRecords(ep.inflight)
+		ep.inflight = nil
+		if ep.w == nil {
+			continue
+		}
+		if cerr := ep.w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// dropSent counts the rows of the record last written to ep without
+// RequireAck as dropped, the failure of ep may have lost it in flight.
+func (e *Endpoints) dropSent(ep *endpoint) {
+	if ep.sent == 0 {
+		return
+	}
+	if e.logger != nil {
+		e.logger.Warn("record batch possibly lost in flight", "url", ep.url, "rows", ep.sent)
+	}
+	if e.metrics != nil {
+		e.metrics.RecordsDropped.Add(float64(ep.sent))
+	}
+	ep.sent = 0
+}
+
+// markDown starts or extends the backoff of ep.
+func (e *Endpoints) markDown(ep *endpoint, err error) {
+	backoff := endpointBackoffMin << ep.failures
+	if backoff > endpointBackoffMax || backoff <= 0 {
+		backoff = endpointBackoffMax
+	} else {
+		ep.failures++
+	}
+	ep.downUntil = time.Now().Add(backoff)
+	if e.logger != nil {
+		e.logger.Warn("flight endpoint unhealthy", "url", ep.url, "retry_in", backoff, "error", err)
+	}
+	e.updateConnected()
+}
+
+// markUp ends the backoff of ep.
+func (e *Endpoints) markUp(ep *endpoint) {
+	if ep.failures == 0 {
+		return
+	}
+	ep.failures = 0
+	ep.downUntil = time.Time{}
+	if e.logger != nil {
+		e.logger.Info("flight endpoint healthy again", "url", ep.url)
+	}
+	e.updateConnected()
+}
+
+// updateConnected sets the connected metric of the output, which is 1
+// while at least one endpoint is healthy.
+func (e *Endpoints) updateConnected() {
+	if e.metrics == nil {
+		return
+	}
+	now := time.Now()
+	for _, ep := range e.eps {
+		if !now.Before(ep.downUntil) {
+			e.metrics.setConnected(1)
+			return
+		}
+	}
+	e.metrics.setConnected(0)
+}
+
+func releaseRecords(records []arrow.Record) {
+	for _, r := range records {
+		r.Release()
+	}
+}
@@ -0,0 +1,61 @@
+package plugin
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/anaray/fluent-bit-arrow-plugin/internal/flblog"
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/memory"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// failingWriter is a recordWriter whose writes fail while broken is set.
+type failingWriter struct {
+	recordWriter
+	broken bool
+}
+
+func (w *failingWriter) Write(record arrow.Record) error {
+	if w.broken {
+		return errors.New("stream broken")
+	}
+	return w.recordWriter.Write(record)
+}
+
+func TestEndpointsFailoverWithoutAck(t *testing.T) {
+	writers := map[string]*failingWriter{"a": {}, "b": {}}
+	m := NewMetrics("endpoints_test")
+	e, err := NewEndpoints([]string{"a", "b"}, StrategyFailover, false, func(url string) (RecordWriter, error) {
+		return writers[url], nil
+	}, m, flblog.New("output:arrow:endpoints_test", flblog.LevelOff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	mem := memory.NewGoAllocator()
+	write := func(n int64) {
+		t.Helper()
+		r := valueRecord(mem, n)
+		defer r.Release()
+		if err := e.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dropped := testutil.ToFloat64(m.RecordsDropped)
+
+	write(1)
+	writers["a"].broken = true
+	write(2)
+	write(3)
+	if len(writers["a"].records) != 1 || len(writers["b"].records) != 2 {
+		t.Fatalf("%d and %d batches written to a and b, want 1 and 2", len(writers["a"].records), len(writers["b"].records))
+	}
+	// the batch written to a before it failed may be lost
+	if got := testutil.ToFloat64(m.RecordsDropped) - dropped; got != 1 {
+		t.Errorf("%v records dropped, want 1", got)
+	}
+	for _, w := range writers {
+		releaseRecords(w.records)
+	}
+}
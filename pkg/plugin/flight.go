@@ -0,0 +1,424 @@
+package plugin
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/anaray/fluent-bit-arrow-plugin/internal/flblog"
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/flight"
+	"github.com/apache/arrow/go/v12/arrow/ipc"
+	"google.golang.org/grpc"
+)
+
+// DefaultAckTimeout is used when acknowledgements are required but no
+// timeout has been configured.
+const DefaultAckTimeout = 30 * time.Second
+
+// closeGrace bounds how long Close waits for the server to end the stream
+// when no write timeout is configured.
+const closeGrace = 5 * time.Second
+
+// App_Metadata values
+const (
+	AppMetadataSequence = "sequence"
+	AppMetadataJSON     = "json"
+)
+
+// BatchHeader is the app_metadata of a batch with AppMetadataJSON.
+type BatchHeader struct {
+	// BatchId is the sequence number of the batch, it increases by one
+	// with every batch of the service.
+	BatchId  uint64   `json:"batch_id"`
+	Host     string   `json:"host,omitempty"`
+	OutputId string   `json:"output_id,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	Rows     int64    `json:"rows"`
+	// MinTime and MaxTime bound the Fluent Bit timestamps of the rows.
+	MinTime *time.Time `json:"min_time,omitempty"`
+	MaxTime *time.Time `json:"max_time,omitempty"`
+}
+
+// FlightConfig holds the DoPut options of an ArrowFlightService.
+type FlightConfig struct {
+	// RequireAck makes Flush wait for a PutResult for every written batch.
+	RequireAck bool
+	// AckTimeout bounds how long Flush waits for outstanding PutResults.
+	AckTimeout time.Duration
+	// Metrics receives the reconnect count and connection state, optional.
+	Metrics *Metrics
+	// Logger is used for conditions that do not fail a call, optional.
+	Logger *flblog.Logger
+	// Descriptor identifies the stream on the server, DescriptorUNKNOWN
+	// when nil.
+	Descriptor *flight.FlightDescriptor
+	// FetchSchema makes every (re)connect ask the server for the schema of
+	// Descriptor instead of relying on the given one.
+	FetchSchema bool
+	// SchemaCacheFile, when set, receives every schema fetched from the
+	// server so that a later start can proceed while the server is down.
+	SchemaCacheFile string
+	// GRPC tunes the connection and bounds the time to write a batch.
+	GRPC GRPCConfig
+	// DialOptions are added to those of the gRPC connection.
+	DialOptions []grpc.DialOption
+	// Metadata is added to the schema message of every stream, optional.
+	Metadata *SchemaMetadata
+	// AppMetadata is the format of the app_metadata of the batches,
+	// AppMetadataSequence by default.
+	AppMetadata string
+	// Host and OutputId identify the source in AppMetadataJSON headers.
+	Host     string
+	OutputId string
+	// Pool, when set, provides a connection shared with other services to
+	// the same url instead of a connection of its own.
+	Pool *ConnPool
+}
+
+// ArrowFlightService aids and creates a Arrow Flight Client and Flight Writer.
+//
+// Every batch is written with its sequence number, an 8 byte big-endian
+// integer, as app_metadata, or with AppMetadataJSON a BatchHeader carrying
+// it as BatchId. The server acknowledges a batch by sending a PutResult
+// carrying the same 8 bytes, or a JSON object with its batch_id. A broken
+// stream is reopened on the next Write.
+//
+// With FlightConfig.FetchSchema the schema is taken from the server on every
+// connect, Write then fails with a SchemaChangedError for records built with a
+// schema that no longer matches.
+type ArrowFlightService struct {
+	ArrowFlightServerUrl string
+	Schema               *arrow.Schema
+	Config               FlightConfig
+
+	conn   *grpc.ClientConn
+	client flight.FlightServiceClient
+
+	mu      sync.Mutex
+	stream  flight.FlightService_DoPutClient
+	cancel  context.CancelFunc
+	writer  *flight.Writer
+	done    chan struct{}
+	opened  bool
+	seq     uint64
+	pending map[uint64]chan error
+}
+
+// NewFlightService connects to url. The given schema may be nil if it is
+// fetched from the server, in which case the server has to be reachable.
+// Otherwise a failing connect is only logged and retried on the first Write.
+func NewFlightService(url string, schema *arrow.Schema, cfg FlightConfig) (*ArrowFlightService, error) {
+	opts := append([]grpc.DialOption{grpc.WithInsecure()}, cfg.GRPC.DialOptions()...) // TODO: convert this into secure
+	opts = append(opts, cfg.DialOptions...)
+	var conn *grpc.ClientConn
+	var err error
+	if cfg.Pool != nil {
+		conn, err = cfg.Pool.Get(url, opts...)
+	} else {
+		conn, err = grpc.Dial(url, opts...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create grpc connection [%s]", url)
+	}
+	if cfg.AckTimeout <= 0 {
+		cfg.AckTimeout = DefaultAckTimeout
+	}
+	switch cfg.AppMetadata {
+	case "":
+		cfg.AppMetadata = AppMetadataSequence
+	case AppMetadataSequence, AppMetadataJSON:
+	default:
+		return nil, fmt.Errorf("unsupported app_metadata format [%s]", cfg.AppMetadata)
+	}
+	if cfg.Descriptor == nil {
+		cfg.Descriptor = &flight.FlightDescriptor{
+			Type: flight.DescriptorUNKNOWN,
+		}
+	}
+
+	svc := &ArrowFlightService{
+		ArrowFlightServerUrl: url,
+		Schema:               schema,
+		Config:               cfg,
+		conn:                 conn,
+		client:               flight.NewFlightServiceClient(conn),
+		pending:              make(map[uint64]chan error),
+	}
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if err := svc.open(); err != nil {
+		if svc.Schema == nil {
+			svc.closeConn()
+			return nil, err
+		}
+		if l := cfg.Logger; l != nil {
+			l.Warn("flight server unavailable, starting disconnected", "url", url, "error", err)
+		}
+	}
+	return svc, nil
+}
+
+// open starts a new DoPut stream and its acknowledgement reader.
+// Callers must hold svc.mu.
+func (svc *ArrowFlightService) open() error {
+	if svc.Config.FetchSchema {
+		if err := svc.refreshSchema(); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p, err := svc.client.DoPut(ctx)
+	if err != nil {
+		cancel()
+		return err
+	}
+	wtr := flight.NewRecordWriter(p, ipc.WithSchema(svc.Config.Metadata.Apply(svc.Schema)))
+	wtr.SetFlightDescriptor(svc.Config.Descriptor)
+
+	svc.stream = p
+	svc.cancel = cancel
+	svc.writer = wtr
+	svc.done = make(chan struct{})
+	if m := svc.Config.Metrics; m != nil {
+		if svc.opened {
+			m.Reconnects.Inc()
+		}
+		m.setConnected(1)
+	}
+	svc.opened = true
+	go svc.readAcks(p, svc.done)
+	return nil
+}
+
+// refreshSchema replaces svc.Schema by the server's schema of the descriptor
+// and updates the schema cache file when it changed.
+// Callers must hold svc.mu.
+func (svc *ArrowFlightService) refreshSchema() error {
+	s, err := FetchSchema(context.Background(), svc.client, svc.Config.Descriptor)
+	if err != nil {
+		return err
+	}
+	if svc.Schema != nil && svc.Schema.Equal(s) {
+		return nil
+	}
+	svc.Schema = s
+	if svc.Config.SchemaCacheFile != "" {
+		if err := WriteSchemaFile(svc.Config.SchemaCacheFile, s); err != nil && svc.Config.Logger != nil {
+			svc.Config.Logger.Warn("failed to write schema cache", "file", svc.Config.SchemaCacheFile, "error", err)
+		}
+	}
+	return nil
+}
+
+// readAcks matches PutResult messages of stream to outstanding batches until
+// the stream ends, then fails whatever is still outstanding.
+func (svc *ArrowFlightService) readAcks(stream flight.FlightService_DoPutClient, done chan struct{}) {
+	defer close(done)
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				err = errors.New("flight stream closed before acknowledgement")
+			}
+			svc.mu.Lock()
+			if svc.stream == stream {
+				svc.reset(err)
+			}
+			svc.mu.Unlock()
+			return
+		}
+		seq, ok := ackSeq(res.AppMetadata)
+		if !ok {
+			continue
+		}
+		svc.mu.Lock()
+		if ch, ok := svc.pending[seq]; ok {
+			ch <- nil
+			delete(svc.pending, seq)
+		}
+		svc.mu.Unlock()
+	}
+}
+
+// ackSeq returns the sequence number a PutResult acknowledges.
+func ackSeq(meta []byte) (uint64, bool) {
+	if len(meta) == 8 {
+		return binary.BigEndian.Uint64(meta), true
+	}
+	var ack struct {
+		BatchId *uint64 `json:"batch_id"`
+	}
+	if json.Unmarshal(meta, &ack) != nil || ack.BatchId == nil {
+		return 0, false
+	}
+	return *ack.BatchId, true
+}
+
+// reset drops the current stream and fails every outstanding batch with err.
+// Callers must hold svc.mu.
+func (svc *ArrowFlightService) reset(err error) {
+	for seq, ch := range svc.pending {
+		ch <- err
+		delete(svc.pending, seq)
+	}
+	if svc.stream != nil {
+		svc.stream.CloseSend()
+		svc.cancel()
+	}
+	svc.stream = nil
+	svc.cancel = nil
+	svc.writer = nil
+	if m := svc.Config.Metrics; m != nil {
+		m.setConnected(0)
+	}
+}
+
+// Write a Record
+func (svc *ArrowFlightService) Write(record arrow.Record) error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if svc.stream == nil {
+		if err := svc.open(); err != nil {
+			return err
+		}
+	}
+	if svc.Config.FetchSchema && !record.Schema().Equal(svc.Schema) {
+		return &SchemaChangedError{Schema: svc.Schema}
+	}
+
+	svc.seq++
+	meta, err := svc.appMetadata(record)
+	if err != nil {
+		return err
+	}
+	if svc.Config.RequireAck {
+		svc.pending[svc.seq] = make(chan error, 1)
+	}
+	if err := svc.send(record, meta); err != nil {
+		svc.reset(err)
+		return err
+	}
+	return nil
+}
+
+// appMetadata returns the app_metadata of record as batch svc.seq.
+// Callers must hold svc.mu.
+func (svc *ArrowFlightService) appMetadata(record arrow.Record) ([]byte, error) {
+	if svc.Config.AppMetadata != AppMetadataJSON {
+		meta := make([]byte, 8)
+		binary.BigEndian.PutUint64(meta, svc.seq)
+		return meta, nil
+	}
+	prov := provenanceOf(record)
+	h := BatchHeader{
+		BatchId:  svc.seq,
+		Host:     svc.Config.Host,
+		OutputId: svc.Config.OutputId,
+		Tags:     prov.tags,
+		Rows:     record.NumRows(),
+	}
+	if !prov.min.IsZero() {
+		h.MinTime, h.MaxTime = &prov.min, &prov.max
+	}
+	return json.Marshal(h)
+}
+
+// send writes record to the stream. With a WriteTimeout a write that does
+// not complete in time cancels the stream.
+// Callers must hold svc.mu.
+func (svc *ArrowFlightService) send(record arrow.Record, meta []byte) error {
+	timeout := svc.Config.GRPC.WriteTimeout
+	if timeout <= 0 {
+		return svc.writer.WriteWithAppMetadata(record, meta)
+	}
+	t := time.AfterFunc(timeout, svc.cancel)
+	err := svc.writer.WriteWithAppMetadata(record, meta)
+	if !t.Stop() {
+		return fmt.Errorf("writing record batch to [%s] took longer than %s", svc.ArrowFlightServerUrl, timeout)
+	}
+	return err
+}
+
+// Flush waits until every batch written so far is acknowledged. It is a
+// no-op unless acknowledgements are required. On timeout the stream is
+// dropped so that the batches are resent on a fresh stream after a retry.
+func (svc *ArrowFlightService) Flush() error {
+	if !svc.Config.RequireAck {
+		return nil
+	}
+	svc.mu.Lock()
+	waits := make([]chan error, 0, len(svc.pending))
+	for _, ch := range svc.pending {
+		waits = append(waits, ch)
+	}
+	svc.mu.Unlock()
+
+	timeout := time.NewTimer(svc.Config.AckTimeout)
+	defer timeout.Stop()
+	for _, ch := range waits {
+		select {
+		case err := <-ch:
+			if err != nil {
+				return err
+			}
+		case <-timeout.C:
+			err := fmt.Errorf("no acknowledgement from [%s] within %s", svc.ArrowFlightServerUrl, svc.Config.AckTimeout)
+			svc.mu.Lock()
+			svc.reset(err)
+			svc.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// Close ends the DoPut stream, waits for the remaining acknowledgements and
+// closes the connection. A server that does not end the stream within the
+// write timeout, or closeGrace without one, has the stream cancelled.
+func (svc *ArrowFlightService) Close() error {
+	svc.mu.Lock()
+	var err error
+	done, cancel := svc.done, svc.cancel
+	if svc.writer != nil {
+		err = svc.writer.Close()
+		svc.stream.CloseSend()
+	}
+	svc.mu.Unlock()
+	if done != nil {
+		grace := svc.Config.GRPC.WriteTimeout
+		if grace <= 0 {
+			grace = closeGrace
+		}
+		t := time.NewTimer(grace)
+		select {
+		case <-done:
+		case <-t.C:
+			if l := svc.Config.Logger; l != nil {
+				l.Warn("flight stream not closed by the server, cancelling it", "url", svc.ArrowFlightServerUrl, "after", grace)
+			}
+			if cancel != nil {
+				cancel()
+			}
+			<-done
+		}
+		t.Stop()
+	}
+	if cerr := svc.closeConn(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// closeConn closes the connection, or returns it to the pool.
+func (svc *ArrowFlightService) closeConn() error {
+	if svc.Config.Pool != nil {
+		return svc.Config.Pool.Put(svc.conn)
+	}
+	return svc.conn.Close()
+}
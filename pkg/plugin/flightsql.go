@@ -0,0 +1,228 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+	"github.com/apache/arrow/go/v12/arrow/flight/flightsql"
+	"google.golang.org/grpc"
+)
+
+// FlightSQLService ingests Arrow records into a table of a Flight SQL server.
+// Each record is bound as the parameter batch of a prepared INSERT statement.
+// A failed INSERT closes the statement and the client, the next Write
+// reconnects and prepares the statement again.
+type FlightSQLService struct {
+	ArrowFlightServerUrl string
+	Table                string
+	Client               *flightsql.Client
+	Stmt                 *flightsql.PreparedStatement
+	// WriteTimeout bounds each INSERT, zero means no deadline.
+	WriteTimeout time.Duration
+
+	schema *arrow.Schema
+	opts   []grpc.DialOption
+}
+
+// NewFlightSQLService connects to the Flight SQL server at url, optionally
+// creates table from the given schema and prepares the INSERT statement used
+// for every subsequent Write. The connection is tuned by cfg, opts are added
+// to its options.
+func NewFlightSQLService(url string, table string, createTable bool, schema *arrow.Schema, cfg GRPCConfig, opts ...grpc.DialOption) (*FlightSQLService, error) {
+	svc := &FlightSQLService{
+		ArrowFlightServerUrl: url,
+		Table:                table,
+		WriteTimeout:         cfg.WriteTimeout,
+		schema:               schema,
+		opts:                 append(append([]grpc.DialOption{grpc.WithInsecure()}, cfg.DialOptions()...), opts...), // TODO: convert this into secure
+	}
+	if err := svc.connect(); err != nil {
+		return nil, err
+	}
+
+	if createTable {
+		ddl, err := CreateTableStatement(table, schema)
+		if err != nil {
+			svc.Close()
+			return nil, err
+		}
+		if _, err := svc.Client.ExecuteUpdate(context.Background(), ddl); err != nil {
+			svc.Close()
+			return nil, fmt.Errorf("failed to create table [%s]: %w", table, err)
+		}
+	}
+
+	if err := svc.prepare(); err != nil {
+		svc.Close()
+		return nil, err
+	}
+	return svc, nil
+}
+
+// connect creates the client.
+func (svc *FlightSQLService) connect() error {
+	client, err := flightsql.NewClient(svc.ArrowFlightServerUrl, nil, nil, svc.opts...)
+	if err != nil {
+		return fmt.Errorf("failed to create flight sql client [%s]", svc.ArrowFlightServerUrl)
+	}
+	svc.Client = client
+	return nil
+}
+
+// prepare prepares the INSERT statement.
+func (svc *FlightSQLService) prepare() error {
+	stmt, err := svc.Client.Prepare(context.Background(), InsertStatement(svc.Table, svc.schema))
+	if err != nil {
+		return fmt.Errorf("failed to prepare insert into [%s]: %w", svc.Table, err)
+	}
+	svc.Stmt = stmt
+	return nil
+}
+
+// Write binds the record as the parameters of the prepared INSERT and
+// executes it. After a failure the client is reconnected and the statement
+// prepared again first.
+func (svc *FlightSQLService) Write(record arrow.Record) error {
+	if svc.Client == nil {
+		if err := svc.connect(); err != nil {
+			return err
+		}
+	}
+	if svc.Stmt == nil {
+		if err := svc.prepare(); err != nil {
+			svc.Close()
+			return err
+		}
+	}
+
+	ctx := context.Background()
+	if svc.WriteTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, svc.WriteTimeout)
+		defer cancel()
+	}
+	svc.Stmt.SetParameters(record)
+	if _, err := svc.Stmt.ExecuteUpdate(ctx); err != nil {
+		svc.Close()
+		return err
+	}
+	return svc.unbind()
+}
+
+// unbind releases the record bound to the statement, which would otherwise
+// keep its buffers, and with them Mem_Buf_Limit, until the next Write. The
+// statement only drops its binding when another one is set, so an empty
+// stream takes its place.
+func (svc *FlightSQLService) unbind() error {
+	rdr, err := array.NewRecordReader(svc.schema, nil)
+	if err != nil {
+		return err
+	}
+	svc.Stmt.SetRecordReader(rdr)
+	rdr.Release()
+	return nil
+}
+
+// Flush is a no-op, ExecuteUpdate only returns once the server has applied
+// the insert.
+func (svc *FlightSQLService) Flush() error {
+	return nil
+}
+
+// Close releases the prepared statement and the underlying client.
+func (svc *FlightSQLService) Close() error {
+	var err error
+	if svc.Stmt != nil {
+		err = svc.Stmt.Close(context.Background())
+		svc.Stmt = nil
+	}
+	if svc.Client != nil {
+		if cerr := svc.Client.Close(); err == nil {
+			err = cerr
+		}
+		svc.Client = nil
+	}
+	return err
+}
+
+// InsertStatement returns a parameterised INSERT for all fields of schema.
+func InsertStatement(table string, schema *arrow.Schema) string {
+	fields := schema.Fields()
+	cols := make([]string, len(fields))
+	params := make([]string, len(fields))
+	for i, f := range fields {
+		cols[i] = quoteIdent(f.Name)
+		params[i] = "?"
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		quoteTable(table), strings.Join(cols, ", "), strings.Join(params, ", "))
+}
+
+// CreateTableStatement returns a CREATE TABLE IF NOT EXISTS statement whose
+// columns are derived from schema.
+func CreateTableStatement(table string, schema *arrow.Schema) (string, error) {
+	fields := schema.Fields()
+	cols := make([]string, len(fields))
+	for i, f := range fields {
+		t, err := sqlType(f.Type)
+		if err != nil {
+			return "", fmt.Errorf("column [%s]: %w", f.Name, err)
+		}
+		cols[i] = quoteIdent(f.Name) + " " + t
+		if !f.Nullable {
+			cols[i] += " NOT NULL"
+		}
+	}
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)",
+		quoteTable(table), strings.Join(cols, ", ")), nil
+}
+
+// sqlType maps an arrow DataType to the closest ANSI SQL column type.
+func sqlType(dt arrow.DataType) (string, error) {
+	switch dt := dt.(type) {
+	case *arrow.BooleanType:
+		return "BOOLEAN", nil
+	case *arrow.Int8Type, *arrow.Int16Type, *arrow.Uint8Type:
+		return "SMALLINT", nil
+	case *arrow.Int32Type, *arrow.Uint16Type:
+		return "INTEGER", nil
+	case *arrow.Int64Type, *arrow.Uint32Type, *arrow.Uint64Type:
+		return "BIGINT", nil
+	case *arrow.Float32Type:
+		return "REAL", nil
+	case *arrow.Float64Type:
+		return "DOUBLE PRECISION", nil
+	case *arrow.StringType, *arrow.LargeStringType:
+		return "VARCHAR", nil
+	case *arrow.BinaryType, *arrow.LargeBinaryType, *arrow.FixedSizeBinaryType:
+		return "VARBINARY", nil
+	case *arrow.Date32Type, *arrow.Date64Type:
+		return "DATE", nil
+	case *arrow.TimestampType:
+		if dt.TimeZone != "" {
+			return "TIMESTAMP WITH TIME ZONE", nil
+		}
+		return "TIMESTAMP", nil
+	case *arrow.Decimal128Type:
+		return fmt.Sprintf("DECIMAL(%d, %d)", dt.Precision, dt.Scale), nil
+	}
+	return "", fmt.Errorf("no sql type for arrow type %s", dt)
+}
+
+// quoteTable quotes each part of a table name qualified with its schema or
+// catalog, e.g. logs.events.
+func quoteTable(name string) string {
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		parts[i] = quoteIdent(p)
+	}
+	return strings.Join(parts, ".")
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
@@ -0,0 +1,137 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/anaray/fluent-bit-arrow-plugin/internal/flblog"
+	"github.com/anaray/fluent-bit-arrow-plugin/pkg/convert/convtest"
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/flight"
+	"github.com/apache/arrow/go/v12/arrow/flight/flightsql"
+	"github.com/apache/arrow/go/v12/arrow/memory"
+)
+
+func TestStatements(t *testing.T) {
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "ts", Type: arrow.FixedWidthTypes.Timestamp_ms},
+		{Name: `say "hi"`, Type: arrow.BinaryTypes.String, Nullable: true},
+	}, nil)
+	for _, tc := range []struct {
+		table, insert, create string
+	}{
+		{
+			"events",
+			`INSERT INTO "events" ("ts", "say ""hi""") VALUES (?, ?)`,
+			`CREATE TABLE IF NOT EXISTS "events" ("ts" TIMESTAMP WITH TIME ZONE NOT NULL, "say ""hi""" VARCHAR)`,
+		},
+		{
+			"logs.events",
+			`INSERT INTO "logs"."events" ("ts", "say ""hi""") VALUES (?, ?)`,
+			`CREATE TABLE IF NOT EXISTS "logs"."events" ("ts" TIMESTAMP WITH TIME ZONE NOT NULL, "say ""hi""" VARCHAR)`,
+		},
+	} {
+		if got := InsertStatement(tc.table, schema); got != tc.insert {
+			t.Errorf("insert into %s:\n%s\nwant\n%s", tc.table, got, tc.insert)
+		}
+		got, err := CreateTableStatement(tc.table, schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.create {
+			t.Errorf("create %s:\n%s\nwant\n%s", tc.table, got, tc.create)
+		}
+	}
+}
+
+// insertServer is a Flight SQL server counting the rows inserted through
+// its prepared statements.
+type insertServer struct {
+	flightsql.BaseServer
+	rows int64
+}
+
+func (s *insertServer) CreatePreparedStatement(_ context.Context, req flightsql.ActionCreatePreparedStatementRequest) (flightsql.ActionCreatePreparedStatementResult, error) {
+	return flightsql.ActionCreatePreparedStatementResult{Handle: []byte(req.GetQuery())}, nil
+}
+
+func (s *insertServer) ClosePreparedStatement(context.Context, flightsql.ActionClosePreparedStatementRequest) error {
+	return nil
+}
+
+func (s *insertServer) DoPutPreparedStatementUpdate(_ context.Context, _ flightsql.PreparedStatementUpdate, rdr flight.MessageReader) (int64, error) {
+	var n int64
+	for rdr.Next() {
+		n += rdr.Record().NumRows()
+	}
+	atomic.AddInt64(&s.rows, n)
+	return n, rdr.Err()
+}
+
+// startInsertServer serves an insertServer on a free port until the end of
+// the test.
+func startInsertServer(t *testing.T) (string, *insertServer) {
+	t.Helper()
+	s := &insertServer{}
+	srv := flight.NewServerWithMiddleware(nil)
+	if err := srv.Init("localhost:0"); err != nil {
+		t.Fatal(err)
+	}
+	srv.RegisterFlightService(flightsql.NewFlightServer(s))
+	go srv.Serve()
+	t.Cleanup(srv.Shutdown)
+	return srv.Addr().String(), s
+}
+
+func TestFlightSQLReleasesParameters(t *testing.T) {
+	addr, s := startInsertServer(t)
+	svc, err := NewFlightSQLService(addr, "events", false, locSchema, GRPCConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &PluginContext{
+		Id:                   "flightsql_test",
+		RecordBatchThreshold: 150,
+		FlightSvc:            svc,
+		Memory:               NewMemory(memory.NewGoAllocator(), 4000, false),
+		Metrics:              NewMetrics("flightsql_test"),
+		Logger:               flblog.New("output:arrow:flightsql_test", flblog.LevelOff),
+	}
+	if err := c.SetSchema(locSchema); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// each chunk seals a batch close to the limit, the batch bound to the
+	// INSERT must not keep the next chunk out
+	ids := 0
+	for i := 0; i < 5; i++ {
+		var entries []convtest.Entry
+		for j := 0; j < 150; j++ {
+			ids++
+			entries = append(entries, convtest.Entry{Time: time.Unix(1700000000, 0), Record: map[string]interface{}{"ID": ids, "LOC": fmt.Sprint(ids)}})
+		}
+		data, err := convtest.Encode(entries...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Deliver(data, "test"); err != nil {
+			t.Fatalf("chunk %d: %v, %d bytes held", i, err, c.Memory.Allocated())
+		}
+		if got := c.Memory.Allocated(); got != 0 {
+			t.Fatalf("%d bytes held after chunk %d was written", got, i)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt64(&s.rows); got != int64(ids) {
+		t.Errorf("%d rows inserted, want %d", got, ids)
+	}
+	if got := c.Memory.Allocated(); got != 0 {
+		t.Errorf("%d bytes held after Close", got)
+	}
+}
@@ -0,0 +1,152 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+	_ "google.golang.org/grpc/encoding/gzip" // registers the gzip compressor
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+)
+
+// GRPCConfig tunes the gRPC connection to a Flight server. The zero value
+// leaves gRPC's defaults in place.
+type GRPCConfig struct {
+	// KeepaliveTime is the idle time after which the connection is pinged,
+	// zero disables keepalive pings.
+	KeepaliveTime time.Duration
+	// KeepaliveTimeout is how long to wait for a ping to be answered before
+	// the connection is closed.
+	KeepaliveTimeout time.Duration
+	// MaxSendMsgSize is the largest message that may be sent in bytes, zero
+	// means gRPC's default.
+	MaxSendMsgSize int64
+	// Compression is the name of a registered gRPC compressor, e.g. "gzip".
+	Compression string
+	// UserAgent is prepended to gRPC's own user agent.
+	UserAgent string
+	// Headers are sent as metadata with every call.
+	Headers map[string]string
+	// WriteTimeout bounds how long writing a single record batch may take,
+	// zero means no deadline.
+	WriteTimeout time.Duration
+}
+
+// Validate reports options gRPC would reject only once a call is made.
+func (c GRPCConfig) Validate() error {
+	if c.Compression != "" && encoding.GetCompressor(c.Compression) == nil {
+		return fmt.Errorf("unsupported grpc compression [%s]", c.Compression)
+	}
+	if c.MaxSendMsgSize < 0 || int64(int(c.MaxSendMsgSize)) != c.MaxSendMsgSize {
+		return fmt.Errorf("invalid grpc max send message size [%d]", c.MaxSendMsgSize)
+	}
+	for k := range c.Headers {
+		if k == "" || strings.HasPrefix(k, "grpc-") {
+			return fmt.Errorf("invalid grpc header [%s]", k)
+		}
+	}
+	return nil
+}
+
+// DialOptions returns the options of a connection tuned by c.
+func (c GRPCConfig) DialOptions() []grpc.DialOption {
+	var opts []grpc.DialOption
+	if c.KeepaliveTime > 0 {
+		opts = append(opts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                c.KeepaliveTime,
+			Timeout:             c.KeepaliveTimeout,
+			PermitWithoutStream: true,
+		}))
+	}
+
+	var call []grpc.CallOption
+	if c.MaxSendMsgSize > 0 {
+		call = append(call, grpc.MaxCallSendMsgSize(int(c.MaxSendMsgSize)))
+	}
+	if c.Compression != "" {
+		call = append(call, grpc.UseCompressor(c.Compression))
+	}
+	if len(call) > 0 {
+		opts = append(opts, grpc.WithDefaultCallOptions(call...))
+	}
+
+	if c.UserAgent != "" {
+		opts = append(opts, grpc.WithUserAgent(c.UserAgent))
+	}
+	if len(c.Headers) > 0 {
+		md := metadata.New(c.Headers)
+		opts = append(opts,
+			grpc.WithChainUnaryInterceptor(func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+				return invoker(withHeaders(ctx, md), method, req, reply, cc, opts...)
+			}),
+			grpc.WithChainStreamInterceptor(func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+				return streamer(withHeaders(ctx, md), desc, cc, method, opts...)
+			}),
+		)
+	}
+	return opts
+}
+
+// withHeaders adds md to the outgoing metadata of ctx.
+func withHeaders(ctx context.Context, md metadata.MD) context.Context {
+	if out, ok := metadata.FromOutgoingContext(ctx); ok {
+		md = metadata.Join(out, md)
+	}
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// ConnPool shares gRPC connections by target. A connection is closed when
+// the last user returned it.
+type ConnPool struct {
+	mu    sync.Mutex
+	conns map[string]*pooledConn
+}
+
+type pooledConn struct {
+	conn *grpc.ClientConn
+	refs int
+}
+
+// NewConnPool returns an empty ConnPool.
+func NewConnPool() *ConnPool {
+	return &ConnPool{conns: make(map[string]*pooledConn)}
+}
+
+// Get returns the connection to target, dialing it with opts if there is
+// none yet. Every Get has to be matched by a Put.
+func (p *ConnPool) Get(target string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pc, ok := p.conns[target]; ok {
+		pc.refs++
+		return pc.conn, nil
+	}
+	conn, err := grpc.Dial(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+	p.conns[target] = &pooledConn{conn: conn, refs: 1}
+	return conn, nil
+}
+
+// Put returns a connection obtained from Get.
+func (p *ConnPool) Put(conn *grpc.ClientConn) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for target, pc := range p.conns {
+		if pc.conn != conn {
+			continue
+		}
+		if pc.refs--; pc.refs > 0 {
+			return nil
+		}
+		delete(p.conns, target)
+		return conn.Close()
+	}
+	return conn.Close()
+}
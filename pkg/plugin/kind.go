@@ -0,0 +1,103 @@
+package plugin
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/anaray/fluent-bit-arrow-plugin/pkg/convert"
+	"github.com/apache/arrow/go/v12/arrow"
+)
+
+// Kind is a kind of record with a schema and stream of its own. A record is
+// of the kind if the discriminator field has Value, or if its tag matches
+// TagPattern.
+type Kind struct {
+	Value string
+	// TagPattern is matched like Fluent Bit's Match, '*' matches any part
+	// of the tag.
+	TagPattern string
+	Schema     *arrow.Schema
+	// Path is the descriptor path of the stream of the kind.
+	Path []string
+}
+
+// Kinds routes records to their Kind. Records of no kind stay with the
+// schema and stream of the output.
+type Kinds struct {
+	// Field is the discriminator field Kind.Value is compared to.
+	Field string
+	Kinds []Kind
+
+	byPath map[string]*Kind
+}
+
+// NewKinds returns Kinds for the discriminator field and kinds, every kind
+// needs a schema and a path of its own.
+func NewKinds(field string, kinds []Kind) (*Kinds, error) {
+	if len(kinds) == 0 {
+		return nil, fmt.Errorf("no kinds")
+	}
+	k := &Kinds{Field: field, Kinds: kinds, byPath: make(map[string]*Kind, len(kinds))}
+	for i := range k.Kinds {
+		kind := &k.Kinds[i]
+		switch {
+		case kind.Value == "" && kind.TagPattern == "":
+			return nil, fmt.Errorf("kind #%d has neither a value nor a tag pattern", i+1)
+		case kind.Value != "" && field == "":
+			return nil, fmt.Errorf("kind [%s] needs a discriminator field", kind.Value)
+		case kind.Schema == nil:
+			return nil, fmt.Errorf("kind #%d has no schema", i+1)
+		case len(kind.Path) == 0:
+			return nil, fmt.Errorf("kind #%d has no descriptor", i+1)
+		}
+		if kind.TagPattern != "" {
+			if _, err := path.Match(kind.TagPattern, ""); err != nil {
+				return nil, fmt.Errorf("kind #%d: invalid tag pattern [%s]", i+1, kind.TagPattern)
+			}
+		}
+		key := partitionKey(kind.Path)
+		if _, ok := k.byPath[key]; ok {
+			return nil, fmt.Errorf("descriptor [%s] is used by more than one kind", key)
+		}
+		k.byPath[key] = kind
+	}
+	return k, nil
+}
+
+// Route returns the first kind record of tag is of, or nil.
+func (k *Kinds) Route(tag string, record map[interface{}]interface{}) *Kind {
+	var value string
+	var ok bool
+	if k.Field != "" {
+		for key, v := range record {
+			var name string
+			switch key := key.(type) {
+			case string:
+				name = key
+			case []byte:
+				name = string(key)
+			}
+			if name == k.Field {
+				value, ok = convert.Text(v)
+				break
+			}
+		}
+	}
+	for i := range k.Kinds {
+		kind := &k.Kinds[i]
+		if kind.Value != "" && ok && kind.Value == value {
+			return kind
+		}
+		if kind.TagPattern != "" {
+			if m, _ := path.Match(kind.TagPattern, tag); m {
+				return kind
+			}
+		}
+	}
+	return nil
+}
+
+// kindAt returns the kind streamed at path, or nil.
+func (k *Kinds) kindAt(path []string) *Kind {
+	return k.byPath[partitionKey(path)]
+}
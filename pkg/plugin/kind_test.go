@@ -0,0 +1,92 @@
+package plugin
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/anaray/fluent-bit-arrow-plugin/internal/flblog"
+	"github.com/anaray/fluent-bit-arrow-plugin/pkg/convert/convtest"
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newKindsContext returns a context routing the records with KIND login
+// and audit to kinds of their own, the writer of audit cannot be opened.
+func newKindsContext(t *testing.T) (*PluginContext, map[string]*recordWriter) {
+	t.Helper()
+	kinds, err := NewKinds("KIND", []Kind{
+		{Value: "login", Schema: locSchema, Path: []string{"login"}},
+		{Value: "audit", Schema: locSchema, Path: []string{"audit"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writers := map[string]*recordWriter{"": {}}
+	c := &PluginContext{
+		Id:                   "kind_test",
+		RecordBatchThreshold: 1,
+		FlightSvc:            writers[""],
+		Kinds:                kinds,
+		Metrics:              NewMetrics("kind_test"),
+		Logger:               flblog.New("output:arrow:kind_test", flblog.LevelOff),
+		NewPartitionWriter: func(path []string, _ *arrow.Schema) (RecordWriter, error) {
+			if path[0] == "audit" {
+				return nil, errors.New("descriptor refused")
+			}
+			w := &recordWriter{}
+			writers[path[0]] = w
+			return w, nil
+		},
+	}
+	if err := c.SetSchema(locSchema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		for _, w := range writers {
+			releaseRecords(w.records)
+		}
+	})
+	return c, writers
+}
+
+func TestKindNotOpenedDropped(t *testing.T) {
+	c, writers := newKindsContext(t)
+	if err := c.CheckKinds(); err != nil {
+		t.Fatal(err)
+	}
+	dropped := testutil.ToFloat64(c.Metrics.RecordsDropped)
+	data, err := convtest.Encode(
+		convtest.Entry{Time: time.Now(), Record: map[string]interface{}{"ID": 1, "KIND": "audit"}},
+		convtest.Entry{Time: time.Now(), Record: map[string]interface{}{"ID": 2, "KIND": "login"}},
+		convtest.Entry{Time: time.Now(), Record: map[string]interface{}{"ID": 3}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// retrying the chunk would not open audit either
+	if err := c.Deliver(data, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if len(writers["login"].records) != 1 || len(writers[""].records) != 1 {
+		t.Errorf("%d and %d batches written to login and the output, want 1 each", len(writers["login"].records), len(writers[""].records))
+	}
+	if got := testutil.ToFloat64(c.Metrics.RecordsDropped) - dropped; got != 1 {
+		t.Errorf("%v records dropped, want 1", got)
+	}
+}
+
+func TestCheckKinds(t *testing.T) {
+	c, _ := newKindsContext(t)
+	// ID cannot collect the keys without a column
+	c.ExtraFieldsColumn = "ID"
+	if err := c.CheckKinds(); err == nil {
+		t.Error("kind with an int64 extra fields column accepted")
+	}
+	// kinds without the column are fine
+	c.ExtraFieldsColumn = "EXTRA"
+	if err := c.CheckKinds(); err != nil {
+		t.Error(err)
+	}
+}
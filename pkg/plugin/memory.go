@@ -0,0 +1,114 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/anaray/fluent-bit-arrow-plugin/internal/flblog"
+	"github.com/apache/arrow/go/v12/arrow/memory"
+	"github.com/apache/arrow/go/v12/arrow/memory/mallocator"
+)
+
+// Allocator values
+const (
+	AllocatorGo = "go"
+	AllocatorC  = "c"
+)
+
+// ErrMemoryLimit is returned by Deliver while the output holds more than
+// its memory limit.
+var ErrMemoryLimit = errors.New("memory limit reached")
+
+// NewAllocator returns the Go allocator for "go" or "", and an allocator
+// backed by C malloc for "c". The latter keeps Arrow buffers out of the Go
+// heap, which is the better fit inside Fluent Bit's C process.
+func NewAllocator(kind string) (memory.Allocator, error) {
+	switch kind {
+	case "", AllocatorGo:
+		return memory.NewGoAllocator(), nil
+	case AllocatorC:
+		return mallocator.NewMallocator(), nil
+	}
+	return nil, fmt.Errorf("unsupported allocator [%s]", kind)
+}
+
+// Memory accounts for the Arrow buffers allocated by one output. It is an
+// allocator counting the bytes it holds. With leak checking it also records
+// the caller of every allocation, which is too slow for the conversion path
+// of a production output, so that the allocations not released can be
+// listed.
+type Memory struct {
+	// Limit is the number of bytes above which pending rows are sealed
+	// early and new chunks are retried, zero means no limit.
+	Limit int64
+
+	mem       memory.Allocator
+	checked   *memory.CheckedAllocator
+	allocated int64
+}
+
+// NewMemory returns a Memory allocating from mem, recording the callers with
+// checkLeaks.
+func NewMemory(mem memory.Allocator, limit int64, checkLeaks bool) *Memory {
+	m := &Memory{Limit: limit, mem: mem}
+	if checkLeaks {
+		m.checked = memory.NewCheckedAllocator(mem)
+		m.mem = m.checked
+	}
+	return m
+}
+
+func (m *Memory) Allocate(size int) []byte {
+	b := m.mem.Allocate(size)
+	atomic.AddInt64(&m.allocated, int64(len(b)))
+	return b
+}
+
+func (m *Memory) Reallocate(size int, b []byte) []byte {
+	old := len(b)
+	b = m.mem.Reallocate(size, b)
+	atomic.AddInt64(&m.allocated, int64(len(b)-old))
+	return b
+}
+
+func (m *Memory) Free(b []byte) {
+	atomic.AddInt64(&m.allocated, -int64(len(b)))
+	m.mem.Free(b)
+}
+
+// Allocated returns the number of bytes currently allocated.
+func (m *Memory) Allocated() int64 {
+	return atomic.LoadInt64(&m.allocated)
+}
+
+// OverLimit reports whether Limit is set and reached.
+func (m *Memory) OverLimit() bool {
+	return m.Limit > 0 && m.Allocated() >= m.Limit
+}
+
+// CheckLeaks reports whether memory is still allocated, it is called once
+// everything allocated from m has been released. With leak checking every
+// allocation still held is logged.
+func (m *Memory) CheckLeaks(l *flblog.Logger) bool {
+	if m.Allocated() == 0 {
+		return false
+	}
+	if m.checked != nil {
+		m.checked.AssertSize(leakReporter{l}, 0)
+	}
+	return true
+}
+
+// leakReporter passes the leaks found by memory.CheckedAllocator to a
+// Logger.
+type leakReporter struct {
+	l *flblog.Logger
+}
+
+func (r leakReporter) Helper() {}
+
+func (r leakReporter) Errorf(format string, args ...interface{}) {
+	r.l.Error(strings.TrimSpace(fmt.Sprintf(format, args...)))
+}
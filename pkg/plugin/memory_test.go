@@ -0,0 +1,31 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/apache/arrow/go/v12/arrow/memory"
+)
+
+func TestMemoryAccounting(t *testing.T) {
+	for _, checkLeaks := range []bool{false, true} {
+		m := NewMemory(memory.NewGoAllocator(), 100, checkLeaks)
+		b := m.Allocate(64)
+		if got := m.Allocated(); got != 64 {
+			t.Fatalf("allocated %d after Allocate(64)", got)
+		}
+		if m.OverLimit() {
+			t.Fatal("over the limit of 100 with 64 bytes")
+		}
+		b = m.Reallocate(128, b)
+		if got := m.Allocated(); got != 128 || !m.OverLimit() {
+			t.Fatalf("allocated %d after Reallocate(128), over limit %v", got, m.OverLimit())
+		}
+		m.Free(b)
+		if got := m.Allocated(); got != 0 {
+			t.Fatalf("allocated %d after Free", got)
+		}
+		if m.CheckLeaks(nil) {
+			t.Fatal("leaks reported with nothing allocated")
+		}
+	}
+}
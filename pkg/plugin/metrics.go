@@ -0,0 +1,265 @@
+package plugin
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "fluentbit_arrow"
+
+// registry holds the metrics of every output of the plugin, each output
+// is told apart by the "output" label carrying its Id.
+var registry = prometheus.NewRegistry()
+
+var (
+	recordsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "records_received_total",
+		Help: "Records handed to the output by Fluent Bit.",
+	}, []string{"output"})
+	recordsConverted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "records_converted_total",
+		Help: "Records appended to the Arrow record builder.",
+	}, []string{"output"})
+	recordsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "records_dropped_total",
+		Help: "Records discarded instead of being sent.",
+	}, []string{"output"})
+	recordsDeduplicated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "records_deduplicated_total",
+		Help: "Records dropped as duplicates of a record within Dedup_Window.",
+	}, []string{"output"})
+	conversionErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "conversion_errors_total",
+		Help: "Field values that could not be converted to their column type.",
+	}, []string{"output", "column", "reason"})
+	batchesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "batches_sent_total",
+		Help: "Record batches written to the Flight server.",
+	}, []string{"output"})
+	bytesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "bytes_sent_total",
+		Help: "Arrow buffer bytes of the record batches written to the Flight server.",
+	}, []string{"output"})
+	writeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "write_errors_total",
+		Help: "Record batches that failed to be written.",
+	}, []string{"output"})
+	writeLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace, Name: "write_duration_seconds",
+		Help:    "Time taken to write a record batch to the Flight server.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"output"})
+	batchesSplit = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "batches_split_total",
+		Help: "Record batches sliced to stay under Max_Batch_Bytes.",
+	}, []string{"output"})
+	batchesCoalesced = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "batches_coalesced_total",
+		Help: "Record batches merged into a larger one to reach Target_Batch_Bytes.",
+	}, []string{"output"})
+	pendingRows = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace, Name: "pending_rows",
+		Help: "Rows held in the Arrow record builder waiting to be sealed into a batch.",
+	}, []string{"output"})
+	rollupGroups = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace, Name: "rollup_groups",
+		Help: "Groups of rollup windows not emitted yet.",
+	}, []string{"output"})
+	partitions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace, Name: "partitions",
+		Help: "Partitions with an open stream.",
+	}, []string{"output"})
+	reconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "reconnects_total",
+		Help: "Flight streams reopened after a failure.",
+	}, []string{"output"})
+	connected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace, Name: "connected",
+		Help: "1 while the output has an open Flight stream, 0 otherwise.",
+	}, []string{"output"})
+	endpointConnected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace, Name: "endpoint_connected",
+		Help: "1 while the output has an open Flight stream to the endpoint, 0 otherwise.",
+	}, []string{"output", "endpoint"})
+	memoryBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace, Name: "memory_bytes",
+		Help: "Bytes of Arrow buffers allocated by the output.",
+	}, []string{"output"})
+	memoryLimitFlushes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "memory_limit_flushes_total",
+		Help: "Record batches sealed early because Mem_Buf_Limit was reached.",
+	}, []string{"output"})
+	spoolBatches = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace, Name: "spool_batches",
+		Help: "Record batches waiting in the spool to be replayed.",
+	}, []string{"output"})
+	spoolBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace, Name: "spool_bytes",
+		Help: "Bytes taken by the spooled Arrow IPC files.",
+	}, []string{"output"})
+	batchesReplayed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "batches_replayed_total",
+		Help: "Spooled record batches written to the Flight server.",
+	}, []string{"output"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		recordsReceived, recordsConverted, recordsDropped, recordsDeduplicated, conversionErrors,
+		batchesSent, bytesSent, writeErrors, writeLatency,
+		batchesSplit, batchesCoalesced,
+		pendingRows, partitions, rollupGroups, reconnects, connected, endpointConnected,
+		memoryBytes, memoryLimitFlushes,
+		spoolBatches, spoolBytes, batchesReplayed,
+	)
+}
+
+// Metrics are the Prometheus metrics of a single output. Connected is nil in
+// the copy for partition writers.
+type Metrics struct {
+	id               string
+	RecordsReceived  prometheus.Counter
+	RecordsConverted prometheus.Counter
+	RecordsDropped   prometheus.Counter
+	RecordsDeduped   prometheus.Counter
+	BatchesSent      prometheus.Counter
+	BytesSent        prometheus.Counter
+	WriteErrors      prometheus.Counter
+	WriteLatency     prometheus.Observer
+	BatchesSplit     prometheus.Counter
+	BatchesCoalesced prometheus.Counter
+	PendingRows      prometheus.Gauge
+	Partitions       prometheus.Gauge
+	RollupGroups     prometheus.Gauge
+	Reconnects       prometheus.Counter
+	Connected        prometheus.Gauge
+	MemoryBytes      prometheus.Gauge
+	LimitFlushes     prometheus.Counter
+	SpoolBatches     prometheus.Gauge
+	SpoolBytes       prometheus.Gauge
+	BatchesReplayed  prometheus.Counter
+}
+
+// NewMetrics returns the metrics labelled with the output id.
+func NewMetrics(id string) *Metrics {
+	return &Metrics{
+		id:               id,
+		RecordsReceived:  recordsReceived.WithLabelValues(id),
+		RecordsConverted: recordsConverted.WithLabelValues(id),
+		RecordsDropped:   recordsDropped.WithLabelValues(id),
+		RecordsDeduped:   recordsDeduplicated.WithLabelValues(id),
+		BatchesSent:      batchesSent.WithLabelValues(id),
+		BytesSent:        bytesSent.WithLabelValues(id),
+		WriteErrors:      writeErrors.WithLabelValues(id),
+		WriteLatency:     writeLatency.WithLabelValues(id),
+		BatchesSplit:     batchesSplit.WithLabelValues(id),
+		BatchesCoalesced: batchesCoalesced.WithLabelValues(id),
+		PendingRows:      pendingRows.WithLabelValues(id),
+		Partitions:       partitions.WithLabelValues(id),
+		RollupGroups:     rollupGroups.WithLabelValues(id),
+		Reconnects:       reconnects.WithLabelValues(id),
+		Connected:        connected.WithLabelValues(id),
+		MemoryBytes:      memoryBytes.WithLabelValues(id),
+		LimitFlushes:     memoryLimitFlushes.WithLabelValues(id),
+		SpoolBatches:     spoolBatches.WithLabelValues(id),
+		SpoolBytes:       spoolBytes.WithLabelValues(id),
+		BatchesReplayed:  batchesReplayed.WithLabelValues(id),
+	}
+}
+
+// ForEndpoint returns a copy of m for the writer of one of several
+// endpoints, its Connected reports the stream to url only.
+func (m *Metrics) ForEndpoint(url string) *Metrics {
+	em := *m
+	em.Connected = endpointConnected.WithLabelValues(m.id, url)
+	return &em
+}
+
+// ForPartition returns a copy of m for the writers of partitions, their
+// streams come and go with the rows and are not reported, so its Connected
+// is nil.
+func (m *Metrics) ForPartition() *Metrics {
+	pm := *m
+	pm.Connected = nil
+	return &pm
+}
+
+// setConnected sets Connected to v unless the stream is not reported.
+func (m *Metrics) setConnected(v float64) {
+	if m.Connected != nil {
+		m.Connected.Set(v)
+	}
+}
+
+// ConversionError counts a value of column that could not be converted.
+func (m *Metrics) ConversionError(column string, reason string) {
+	conversionErrors.WithLabelValues(m.id, column, reason).Inc()
+}
+
+// ObserveWrite records the outcome of writing record.
+func (m *Metrics) ObserveWrite(record arrow.Record, took time.Duration, err error) {
+	m.WriteLatency.Observe(took.Seconds())
+	if err != nil {
+		m.WriteErrors.Inc()
+		return
+	}
+	m.BatchesSent.Inc()
+	m.BytesSent.Add(float64(RecordSize(record)))
+}
+
+// RecordSize returns the number of bytes held by the buffers of record.
+func RecordSize(record arrow.Record) int64 {
+	var size int64
+	for _, col := range record.Columns() {
+		size += dataSize(col.Data())
+	}
+	return size
+}
+
+func dataSize(data arrow.ArrayData) int64 {
+	var size int64
+	for _, buf := range data.Buffers() {
+		if buf != nil {
+			size += int64(buf.Len())
+		}
+	}
+	for _, child := range data.Children() {
+		size += dataSize(child)
+	}
+	return size
+}
+
+var (
+	listenersMu sync.Mutex
+	listeners   = make(map[string]*http.Server)
+)
+
+// ServeMetrics exposes the metrics of all outputs on addr under /metrics.
+// Outputs configured with the same address share one listener.
+func ServeMetrics(addr string) error {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	if _, ok := listeners[addr]; ok {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start metrics listener [%s]: %w", addr, err)
+	}
+	listeners[addr] = srv
+	go srv.Serve(ln)
+	return nil
+}
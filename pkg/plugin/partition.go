@@ -0,0 +1,116 @@
+package plugin
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/anaray/fluent-bit-arrow-plugin/pkg/convert"
+	"github.com/apache/arrow/go/v12/arrow"
+)
+
+// DefaultPartitionIdleTimeout is how long a partition may go without rows
+// before its stream is closed when no timeout has been configured.
+const DefaultPartitionIdleTimeout = 5 * time.Minute
+
+// partitionNull is the value segment of rows without a usable value.
+const partitionNull = "null"
+
+// PartitionColumn is an entry of Partition_By.
+type PartitionColumn struct {
+	Name string
+	// Bucket groups the values of a timestamp column into intervals of
+	// this length, zero partitions by the values as they are.
+	Bucket time.Duration
+
+	typ    *arrow.TimestampType
+	format string
+}
+
+// Partitioner derives the partition of a record from the values of its
+// partition columns. A partition is identified by one path segment per
+// column, "<column>=<value>", with the start of the bucket in RFC 3339 as
+// value for bucketed columns.
+type Partitioner struct {
+	Columns []PartitionColumn
+}
+
+// NewPartitioner parses a Partition_By value, a comma separated list of
+// columns of schema each optionally followed by ':' and the length of its
+// time buckets, e.g. "LOCATION_ID,MEASUREMENT_DATE:1h". timeFields are the
+// formats of the timestamp columns as for the Converter.
+func NewPartitioner(spec string, schema *arrow.Schema, timeFields map[string]string) (*Partitioner, error) {
+	p := &Partitioner{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, bucket, hasBucket := strings.Cut(entry, ":")
+		fields, ok := schema.FieldsByName(name)
+		if !ok {
+			return nil, fmt.Errorf("partition column [%s] is not in the schema", name)
+		}
+		col := PartitionColumn{Name: name}
+		if hasBucket {
+			d, err := time.ParseDuration(bucket)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("partition column [%s]: invalid time bucket [%s]", name, bucket)
+			}
+			ts, ok := fields[0].Type.(*arrow.TimestampType)
+			if !ok {
+				return nil, fmt.Errorf("partition column [%s]: time bucket requires a timestamp column, found %s", name, fields[0].Type)
+			}
+			col.Bucket, col.typ, col.format = d, ts, timeFields[name]
+		}
+		p.Columns = append(p.Columns, col)
+	}
+	if len(p.Columns) == 0 {
+		return nil, fmt.Errorf("no partition columns in [%s]", spec)
+	}
+	return p, nil
+}
+
+// Partition returns the path segments of the partition of record.
+func (p *Partitioner) Partition(record map[interface{}]interface{}) []string {
+	values := make(map[string]interface{}, len(p.Columns))
+	for k, v := range record {
+		switch k := k.(type) {
+		case string:
+			values[k] = v
+		case []byte:
+			values[string(k)] = v
+		}
+	}
+
+	path := make([]string, len(p.Columns))
+	for i, col := range p.Columns {
+		path[i] = col.Name + "=" + url.PathEscape(col.value(values[col.Name]))
+	}
+	return path
+}
+
+// value formats v as the partition value of col.
+func (col *PartitionColumn) value(v interface{}) string {
+	if v == nil {
+		return partitionNull
+	}
+	if col.Bucket > 0 {
+		t, err := convert.Time(v, col.typ, col.format)
+		if err != nil {
+			return partitionNull
+		}
+		return t.UTC().Truncate(col.Bucket).Format(time.RFC3339)
+	}
+	s, ok := convert.Text(v)
+	if !ok {
+		return partitionNull
+	}
+	return s
+}
+
+// partitionKey identifies the partition of path in maps.
+func partitionKey(path []string) string {
+	return strings.Join(path, "/")
+}
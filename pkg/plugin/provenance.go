@@ -0,0 +1,99 @@
+package plugin
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+)
+
+// Keys of the provenance a batch carries in the metadata of its schema.
+const (
+	provenanceTags    = "fluentbit.batch.tags"
+	provenanceMinTime = "fluentbit.batch.min_time"
+	provenanceMaxTime = "fluentbit.batch.max_time"
+)
+
+// provenance is where the rows of a batch came from. It travels with the
+// batch in the metadata of its schema, so that it survives sorting,
+// splitting, coalescing and the spool, schema metadata is not compared by
+// arrow.Schema.Equal.
+type provenance struct {
+	tags     []string
+	min, max time.Time
+}
+
+// add accounts for a row of tag with the Fluent Bit timestamp ts, an empty
+// tag is not recorded.
+func (p *provenance) add(tag string, ts time.Time) {
+	if tag != "" && !p.hasTag(tag) {
+		p.tags = append(p.tags, tag)
+	}
+	if p.min.IsZero() || ts.Before(p.min) {
+		p.min = ts
+	}
+	if p.max.IsZero() || ts.After(p.max) {
+		p.max = ts
+	}
+}
+
+func (p *provenance) hasTag(tag string) bool {
+	for _, t := range p.tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// merge accounts for the rows of o.
+func (p *provenance) merge(o provenance) {
+	for _, t := range o.tags {
+		if !p.hasTag(t) {
+			p.tags = append(p.tags, t)
+		}
+	}
+	if !o.min.IsZero() {
+		p.add("", o.min)
+	}
+	if !o.max.IsZero() {
+		p.add("", o.max)
+	}
+}
+
+// attach returns r with p in the metadata of its schema and releases r.
+func (p provenance) attach(r arrow.Record) arrow.Record {
+	if len(p.tags) == 0 && p.min.IsZero() {
+		return r
+	}
+	var keys, vals []string
+	if len(p.tags) > 0 {
+		tags, _ := json.Marshal(p.tags)
+		keys, vals = append(keys, provenanceTags), append(vals, string(tags))
+	}
+	if !p.min.IsZero() {
+		keys = append(keys, provenanceMinTime, provenanceMaxTime)
+		vals = append(vals, p.min.UTC().Format(time.RFC3339Nano), p.max.UTC().Format(time.RFC3339Nano))
+	}
+	schema := WithMetadata(r.Schema(), arrow.NewMetadata(keys, vals))
+	out := array.NewRecord(schema, r.Columns(), r.NumRows())
+	r.Release()
+	return out
+}
+
+// provenanceOf returns the provenance attached to r.
+func provenanceOf(r arrow.Record) provenance {
+	var p provenance
+	md := r.Schema().Metadata()
+	if i := md.FindKey(provenanceTags); i >= 0 {
+		json.Unmarshal([]byte(md.Values()[i]), &p.tags)
+	}
+	if i := md.FindKey(provenanceMinTime); i >= 0 {
+		p.min, _ = time.Parse(time.RFC3339Nano, md.Values()[i])
+	}
+	if i := md.FindKey(provenanceMaxTime); i >= 0 {
+		p.max, _ = time.Parse(time.RFC3339Nano, md.Values()[i])
+	}
+	return p
+}
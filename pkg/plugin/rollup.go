@@ -0,0 +1,341 @@
+package plugin
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anaray/fluent-bit-arrow-plugin/pkg/convert"
+	"github.com/apache/arrow/go/v12/arrow"
+)
+
+// Rollup_Functions values
+const (
+	RollupCount = "count"
+	RollupSum   = "sum"
+	RollupMin   = "min"
+	RollupMax   = "max"
+	RollupAvg   = "avg"
+	RollupLast  = "last"
+)
+
+// Rollup_Mode values
+const (
+	RollupReplace = "replace"
+	RollupBoth    = "both"
+)
+
+// RollupWindowStart is the column of a rollup row holding the start of its
+// window.
+const RollupWindowStart = "window_start"
+
+// rollupPath is the partition path of the rollup stream of RollupBoth, it
+// cannot collide with the "<column>=<value>" paths of a Partitioner.
+var rollupPath = []string{"rollup"}
+
+// RollupConfig configures a Rollup.
+type RollupConfig struct {
+	// Dimensions are the columns the records are grouped by.
+	Dimensions []string
+	// Measures are the numeric columns Functions are applied to.
+	Measures []string
+	// Functions are the Rollup_Functions values computed, all by default.
+	Functions []string
+	// Interval is the length of the tumbling windows.
+	Interval time.Duration
+	// TimeField is the timestamp column whose value places a record in a
+	// window, the Fluent Bit timestamp is used if it is empty.
+	TimeField string
+	// Delay keeps a window open for late records after it ended.
+	Delay time.Duration
+}
+
+// RollupRow is a row emitted by a Rollup, Record has a value for every
+// column of Rollup.Schema.
+type RollupRow struct {
+	Start  time.Time
+	Record map[interface{}]interface{}
+}
+
+// Rollup groups records by their dimensions over tumbling windows and
+// summarizes their measures. The rows of a window are emitted once Delay
+// has passed after its end, records arriving for it later are summarized
+// in a further row.
+//
+// Changes since the last Commit can be undone with Rollback. A Rollup is
+// not safe for concurrent use.
+type Rollup struct {
+	Config RollupConfig
+
+	schema     *arrow.Schema
+	timeType   *arrow.TimestampType
+	timeFormat string
+	funcs      map[string]bool
+
+	groups map[string]*rollupGroup
+	// undo holds the groups changed since the last Commit as they were
+	// before, nil for groups that did not exist
+	undo map[string]*rollupGroup
+}
+
+type rollupGroup struct {
+	start    time.Time
+	dims     []interface{}
+	count    int64
+	measures []rollupMeasure
+}
+
+// rollupMeasure summarizes the n values of a measure.
+type rollupMeasure struct {
+	n                   int64
+	sum, min, max, last float64
+}
+
+func (g *rollupGroup) clone() *rollupGroup {
+	c := *g
+	c.measures = append([]rollupMeasure(nil), g.measures...)
+	return &c
+}
+
+// NewRollup returns a Rollup for records of schema. timeFields are the
+// formats of the timestamp columns as for the Converter.
+func NewRollup(cfg RollupConfig, schema *arrow.Schema, timeFields map[string]string) (*Rollup, error) {
+	if cfg.Interval <= 0 {
+		return nil, fmt.Errorf("invalid rollup interval [%s]", cfg.Interval)
+	}
+	if len(cfg.Functions) == 0 {
+		cfg.Functions = []string{RollupCount, RollupSum, RollupMin, RollupMax, RollupAvg, RollupLast}
+	}
+	r := &Rollup{
+		Config: cfg,
+		funcs:  make(map[string]bool),
+		groups: make(map[string]*rollupGroup),
+		undo:   make(map[string]*rollupGroup),
+	}
+	for _, f := range cfg.Functions {
+		switch f {
+		case RollupCount, RollupSum, RollupMin, RollupMax, RollupAvg, RollupLast:
+			r.funcs[f] = true
+		default:
+			return nil, fmt.Errorf("unsupported rollup function [%s]", f)
+		}
+	}
+
+	if cfg.TimeField != "" {
+		fields, ok := schema.FieldsByName(cfg.TimeField)
+		if !ok {
+			return nil, fmt.Errorf("rollup time field [%s] is not in the schema", cfg.TimeField)
+		}
+		ts, ok := fields[0].Type.(*arrow.TimestampType)
+		if !ok {
+			return nil, fmt.Errorf("rollup time field [%s] is not a timestamp column", cfg.TimeField)
+		}
+		r.timeType, r.timeFormat = ts, timeFields[cfg.TimeField]
+	}
+
+	out := []arrow.Field{{Name: RollupWindowStart, Type: &arrow.TimestampType{Unit: arrow.Millisecond, TimeZone: "UTC"}}}
+	for _, d := range cfg.Dimensions {
+		fields, ok := schema.FieldsByName(d)
+		if !ok {
+			return nil, fmt.Errorf("rollup dimension [%s] is not in the schema", d)
+		}
+		f := fields[0]
+		f.Nullable = true
+		out = append(out, f)
+	}
+	if r.funcs[RollupCount] {
+		out = append(out, arrow.Field{Name: RollupCount, Type: arrow.PrimitiveTypes.Int64})
+	}
+	for _, m := range cfg.Measures {
+		fields, ok := schema.FieldsByName(m)
+		if !ok {
+			return nil, fmt.Errorf("rollup measure [%s] is not in the schema", m)
+		}
+		if !arrow.IsInteger(fields[0].Type.ID()) && !arrow.IsFloating(fields[0].Type.ID()) {
+			return nil, fmt.Errorf("rollup measure [%s] is not numeric", m)
+		}
+		for _, f := range cfg.Functions {
+			if f != RollupCount {
+				out = append(out, arrow.Field{Name: m + "_" + f, Type: arrow.PrimitiveTypes.Float64, Nullable: true})
+			}
+		}
+	}
+
+	names := make(map[string]bool, len(out))
+	for _, f := range out {
+		if names[f.Name] {
+			return nil, fmt.Errorf("rollup column [%s] is not unique", f.Name)
+		}
+		names[f.Name] = true
+	}
+	r.schema = arrow.NewSchema(out, nil)
+	return r, nil
+}
+
+// Schema returns the schema of the rows of r.
+func (r *Rollup) Schema() *arrow.Schema { return r.schema }
+
+// Len returns the number of groups not emitted yet.
+func (r *Rollup) Len() int { return len(r.groups) }
+
+// Add summarizes record into its group. ts is the Fluent Bit timestamp of
+// record, which is also used if the TimeField value cannot be parsed.
+func (r *Rollup) Add(ts time.Time, record map[interface{}]interface{}) {
+	values := make(map[string]interface{}, len(record))
+	for k, v := range record {
+		switch k := k.(type) {
+		case string:
+			values[k] = v
+		case []byte:
+			values[string(k)] = v
+		}
+	}
+
+	t := ts
+	if r.timeType != nil {
+		if v, ok := values[r.Config.TimeField]; ok && v != nil {
+			if vt, err := convert.Time(v, r.timeType, r.timeFormat); err == nil {
+				t = vt
+			}
+		}
+	}
+	start := t.UTC().Truncate(r.Config.Interval)
+
+	var key strings.Builder
+	fmt.Fprintf(&key, "%020d", start.UnixNano())
+	dims := make([]interface{}, len(r.Config.Dimensions))
+	for i, d := range r.Config.Dimensions {
+		dims[i] = values[d]
+		key.WriteByte(0)
+		if s, ok := convert.Text(dims[i]); ok {
+			key.WriteByte(1)
+			key.WriteString(s)
+		}
+	}
+
+	g := r.group(key.String(), start, dims)
+	g.count++
+	for i, m := range r.Config.Measures {
+		x, ok := convert.Number(values[m])
+		if !ok {
+			continue
+		}
+		s := &g.measures[i]
+		if s.n == 0 || x < s.min {
+			s.min = x
+		}
+		if s.n == 0 || x > s.max {
+			s.max = x
+		}
+		s.n++
+		s.sum += x
+		s.last = x
+	}
+}
+
+// group returns the group of key, creating it if needed, and keeps its
+// state for Rollback.
+func (r *Rollup) group(key string, start time.Time, dims []interface{}) *rollupGroup {
+	g, ok := r.groups[key]
+	if _, changed := r.undo[key]; !changed {
+		if ok {
+			r.undo[key] = g.clone()
+		} else {
+			r.undo[key] = nil
+		}
+	}
+	if !ok {
+		g = &rollupGroup{start: start, dims: dims, measures: make([]rollupMeasure, len(r.Config.Measures))}
+		r.groups[key] = g
+	}
+	return g
+}
+
+// Closed removes and returns the rows of the windows that ended more than
+// Delay before now, ordered by window.
+func (r *Rollup) Closed(now time.Time) []RollupRow {
+	return r.emit(func(g *rollupGroup) bool {
+		return !now.Before(g.start.Add(r.Config.Interval + r.Config.Delay))
+	})
+}
+
+// Drain removes and returns the rows of all windows, ordered by window.
+func (r *Rollup) Drain() []RollupRow {
+	return r.emit(func(*rollupGroup) bool { return true })
+}
+
+func (r *Rollup) emit(done func(*rollupGroup) bool) []RollupRow {
+	var keys []string
+	for key, g := range r.groups {
+		if done(g) {
+			keys = append(keys, key)
+		}
+	}
+	// keys start with the window
+	sort.Strings(keys)
+
+	rows := make([]RollupRow, 0, len(keys))
+	for _, key := range keys {
+		g := r.groups[key]
+		if _, changed := r.undo[key]; !changed {
+			r.undo[key] = g
+		}
+		delete(r.groups, key)
+		rows = append(rows, RollupRow{Start: g.start, Record: r.row(g)})
+	}
+	return rows
+}
+
+// row returns the columns of the rollup row of g.
+func (r *Rollup) row(g *rollupGroup) map[interface{}]interface{} {
+	row := map[interface{}]interface{}{RollupWindowStart: g.start}
+	for i, d := range r.Config.Dimensions {
+		row[d] = g.dims[i]
+	}
+	if r.funcs[RollupCount] {
+		row[RollupCount] = g.count
+	}
+	for i, m := range r.Config.Measures {
+		s := g.measures[i]
+		for _, f := range r.Config.Functions {
+			if f == RollupCount || s.n == 0 {
+				continue
+			}
+			var v float64
+			switch f {
+			case RollupSum:
+				v = s.sum
+			case RollupMin:
+				v = s.min
+			case RollupMax:
+				v = s.max
+			case RollupAvg:
+				v = s.sum / float64(s.n)
+			case RollupLast:
+				v = s.last
+			}
+			row[m+"_"+f] = v
+		}
+	}
+	return row
+}
+
+// Commit keeps the changes since the last Commit.
+func (r *Rollup) Commit() {
+	r.undo = make(map[string]*rollupGroup)
+}
+
+// Rollback undoes the changes since the last Commit, so that the records of
+// a retried chunk are not summarized twice and rows emitted for it are
+// emitted again.
+func (r *Rollup) Rollback() {
+	for key, g := range r.undo {
+		if g == nil {
+			delete(r.groups, key)
+		} else {
+			r.groups[key] = g
+		}
+	}
+	r.Commit()
+}
@@ -0,0 +1,184 @@
+package plugin
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/anaray/fluent-bit-arrow-plugin/internal/flblog"
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+)
+
+var rollupInput = arrow.NewSchema([]arrow.Field{
+	{Name: "HOST", Type: arrow.BinaryTypes.String},
+	{Name: "VAL", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
+}, nil)
+
+// window is the start of the first window of the tests.
+var window = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func newTestRollup(t *testing.T) *Rollup {
+	t.Helper()
+	r, err := NewRollup(RollupConfig{
+		Dimensions: []string{"HOST"},
+		Measures:   []string{"VAL"},
+		Functions:  []string{RollupCount, RollupSum, RollupMax},
+		Interval:   time.Minute,
+		Delay:      10 * time.Second,
+	}, rollupInput, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func addReading(r *Rollup, at time.Time, host string, val float64) {
+	r.Add(at, map[interface{}]interface{}{"HOST": host, "VAL": val})
+}
+
+// summaries returns the host, count and sum of rows.
+func summaries(rows []RollupRow) [][3]interface{} {
+	var got [][3]interface{}
+	for _, row := range rows {
+		got = append(got, [3]interface{}{row.Record["HOST"], row.Record[RollupCount], row.Record["VAL_sum"]})
+	}
+	return got
+}
+
+func TestRollupClosed(t *testing.T) {
+	r := newTestRollup(t)
+	addReading(r, window.Add(5*time.Second), "b", 2)
+	addReading(r, window.Add(10*time.Second), "a", 1)
+	addReading(r, window.Add(50*time.Second), "a", 3)
+	addReading(r, window.Add(70*time.Second), "a", 4)
+
+	if rows := r.Closed(window.Add(65 * time.Second)); len(rows) != 0 {
+		t.Fatalf("%d rows emitted before the delay has passed", len(rows))
+	}
+	rows := r.Closed(window.Add(70 * time.Second))
+	want := [][3]interface{}{{"a", int64(2), 4.0}, {"b", int64(1), 2.0}}
+	if got := summaries(rows); !reflect.DeepEqual(got, want) {
+		t.Fatalf("closed windows %v, want %v", got, want)
+	}
+	if rows[0].Record["VAL_max"] != 3.0 || !rows[0].Start.Equal(window) {
+		t.Errorf("row %v, want the max 3 and the window %v", rows[0].Record, window)
+	}
+	if r.Len() != 1 {
+		t.Errorf("%d groups left, want the one of the next window", r.Len())
+	}
+
+	// a late record is summarized into a further row
+	addReading(r, window.Add(30*time.Second), "a", 5)
+	rows = r.Drain()
+	want = [][3]interface{}{{"a", int64(1), 5.0}, {"a", int64(1), 4.0}}
+	if got := summaries(rows); !reflect.DeepEqual(got, want) {
+		t.Fatalf("drained %v, want %v", got, want)
+	}
+	if r.Len() != 0 {
+		t.Errorf("%d groups left after Drain", r.Len())
+	}
+}
+
+func TestRollupRollback(t *testing.T) {
+	r := newTestRollup(t)
+	addReading(r, window, "a", 1)
+	addReading(r, window.Add(70*time.Second), "a", 2)
+	r.Commit()
+
+	// a chunk adds to both windows and closes the first
+	addReading(r, window, "a", 10)
+	addReading(r, window, "b", 10)
+	addReading(r, window.Add(70*time.Second), "a", 10)
+	if rows := r.Closed(window.Add(70 * time.Second)); len(rows) != 2 {
+		t.Fatalf("%d rows emitted, want 2", len(rows))
+	}
+	r.Rollback()
+
+	want := [][3]interface{}{{"a", int64(1), 1.0}, {"a", int64(1), 2.0}}
+	if got := summaries(r.Drain()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("drained %v after Rollback, want %v", got, want)
+	}
+}
+
+// recordWriter keeps the records written to it.
+type recordWriter struct {
+	records []arrow.Record
+}
+
+func (w *recordWriter) Write(record arrow.Record) error {
+	record.Retain()
+	w.records = append(w.records, record)
+	return nil
+}
+
+func (w *recordWriter) Flush() error { return nil }
+func (w *recordWriter) Close() error { return nil }
+
+// hosts returns the HOST values of the records written to w and releases
+// them.
+func (w *recordWriter) hosts() []string {
+	var got []string
+	for _, r := range w.records {
+		col := r.Column(int(r.Schema().FieldIndices("HOST")[0])).(*array.String)
+		for i := 0; i < col.Len(); i++ {
+			got = append(got, col.Value(i))
+		}
+		r.Release()
+	}
+	w.records = nil
+	return got
+}
+
+func newRollupContext(t *testing.T) (*PluginContext, *recordWriter) {
+	t.Helper()
+	r := newTestRollup(t)
+	w := &recordWriter{}
+	c := &PluginContext{
+		Id:        "rollup_test",
+		Schema:    r.Schema(),
+		FlightSvc: w,
+		Metrics:   NewMetrics("rollup_test"),
+		Logger:    flblog.New("output:arrow:rollup_test", flblog.LevelOff),
+		Rollup:    r,
+	}
+	conv, err := c.newConverter(r.Schema())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Converter = conv
+	return c, w
+}
+
+func TestCloseWindowsOnTimer(t *testing.T) {
+	c, w := newRollupContext(t)
+	defer c.Close()
+	addReading(c.Rollup, window, "a", 1)
+	addReading(c.Rollup, window.Add(70*time.Second), "b", 2)
+	c.Rollup.Commit()
+
+	c.closeWindows(c.Logger, window.Add(30*time.Second))
+	if len(w.records) != 0 {
+		t.Fatal("open window sent")
+	}
+	c.closeWindows(c.Logger, window.Add(80*time.Second))
+	if got := w.hosts(); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("sent %v, want the closed window of a", got)
+	}
+	if c.Rollup.Len() != 1 || c.Converter.Pending() != 0 {
+		t.Errorf("%d groups and %d pending rows left, want 1 and 0", c.Rollup.Len(), c.Converter.Pending())
+	}
+}
+
+func TestCloseSendsRollupWithoutSpool(t *testing.T) {
+	c, w := newRollupContext(t)
+	addReading(c.Rollup, window, "a", 1)
+	addReading(c.Rollup, window.Add(70*time.Second), "b", 2)
+	c.Rollup.Commit()
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.hosts(); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Fatalf("sent %v on Close, want the windows of a and b", got)
+	}
+}
@@ -0,0 +1,136 @@
+package plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	arrowschema "github.com/anaray/fluent-bit-arrow-plugin/internal/arrow"
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/flight"
+	"github.com/apache/arrow/go/v12/arrow/memory"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Keys of the runtime metadata added to the schema message of a stream.
+const (
+	MetadataHostname    = "fluentbit.hostname"
+	MetadataOutputId    = "fluentbit.output_id"
+	MetadataVersion     = "fluentbit.version"
+	MetadataFingerprint = "fluentbit.schema_fingerprint"
+)
+
+// SchemaMetadata is the metadata an ArrowFlightService adds to the schema
+// message of its streams. It does not change the schema of the records,
+// arrow.Schema.Equal ignores schema metadata.
+type SchemaMetadata struct {
+	// Pairs replace the schema metadata of the same key.
+	Pairs arrow.Metadata
+	// Fingerprint adds MetadataFingerprint for the schema of the stream.
+	Fingerprint bool
+}
+
+// Apply returns schema with the metadata of m.
+func (m *SchemaMetadata) Apply(schema *arrow.Schema) *arrow.Schema {
+	if m == nil {
+		return schema
+	}
+	pairs := m.Pairs
+	if m.Fingerprint {
+		pairs = arrow.NewMetadata(append(pairs.Keys(), MetadataFingerprint), append(pairs.Values(), Fingerprint(schema)))
+	}
+	return WithMetadata(schema, pairs)
+}
+
+// WithMetadata returns schema with the pairs of md added to its metadata,
+// replacing those of the same key.
+func WithMetadata(schema *arrow.Schema, md arrow.Metadata) *arrow.Schema {
+	if md.Len() == 0 {
+		return schema
+	}
+	old := schema.Metadata()
+	keys := make([]string, 0, old.Len()+md.Len())
+	vals := make([]string, 0, old.Len()+md.Len())
+	for i, k := range old.Keys() {
+		if md.FindKey(k) < 0 {
+			keys, vals = append(keys, k), append(vals, old.Values()[i])
+		}
+	}
+	keys, vals = append(keys, md.Keys()...), append(vals, md.Values()...)
+	meta := arrow.NewMetadata(keys, vals)
+	return arrow.NewSchema(schema.Fields(), &meta)
+}
+
+// Fingerprint returns the hex SHA-256 of the IPC encoding of the fields of
+// schema, field metadata included. Schemas with the same columns have the
+// same fingerprint regardless of their schema metadata.
+func Fingerprint(schema *arrow.Schema) string {
+	sum := sha256.Sum256(flight.SerializeSchema(arrow.NewSchema(schema.Fields(), nil), memory.DefaultAllocator))
+	return hex.EncodeToString(sum[:])
+}
+
+// SchemaChangedError is returned by Write when the schema fetched from the
+// Flight server after a reconnect differs from the schema of the record.
+type SchemaChangedError struct {
+	Schema *arrow.Schema
+}
+
+func (e *SchemaChangedError) Error() string {
+	return "flight server schema changed, record batch discarded"
+}
+
+// FetchSchema asks the Flight server for the schema of desc using GetSchema,
+// falling back to GetFlightInfo for servers that do not implement it.
+func FetchSchema(ctx context.Context, client flight.FlightServiceClient, desc *flight.FlightDescriptor) (*arrow.Schema, error) {
+	var raw []byte
+	res, err := client.GetSchema(ctx, desc)
+	switch {
+	case err == nil:
+		raw = res.Schema
+	case status.Code(err) == codes.Unimplemented:
+		info, err := client.GetFlightInfo(ctx, desc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get flight info: %w", err)
+		}
+		raw = info.Schema
+	default:
+		return nil, fmt.Errorf("failed to get schema: %w", err)
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("flight server returned an empty schema")
+	}
+	return flight.DeserializeSchema(raw, memory.DefaultAllocator)
+}
+
+// WriteSchemaFile stores schema at path in the Schema_File JSON format. The
+// file is replaced atomically so a concurrent start never reads half of it.
+func WriteSchemaFile(path string, schema *arrow.Schema) error {
+	data, err := json.MarshalIndent(arrowschema.SchemaToJSON(schema), "", "    ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic replaces path by data through a temporary file in the
+// same directory, readers never see a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
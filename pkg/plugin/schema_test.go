@@ -0,0 +1,109 @@
+package plugin
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/anaray/fluent-bit-arrow-plugin/internal/flblog"
+	"github.com/anaray/fluent-bit-arrow-plugin/pkg/convert/convtest"
+	"github.com/apache/arrow/go/v12/arrow"
+)
+
+// changingWriter fails its first Write with a SchemaChangedError to next.
+type changingWriter struct {
+	recordWriter
+	next *arrow.Schema
+}
+
+func (w *changingWriter) Write(record arrow.Record) error {
+	if next := w.next; next != nil {
+		w.next = nil
+		return &SchemaChangedError{Schema: next}
+	}
+	return w.recordWriter.Write(record)
+}
+
+var locSchema = arrow.NewSchema([]arrow.Field{
+	{Name: "ID", Type: arrow.PrimitiveTypes.Int64},
+	{Name: "LOC", Type: arrow.BinaryTypes.String, Nullable: true},
+}, nil)
+
+// newSchemaContext returns a context for locSchema sealing every row,
+// whose writer reports a change to next.
+func newSchemaContext(t *testing.T, next *arrow.Schema) (*PluginContext, *changingWriter) {
+	t.Helper()
+	w := &changingWriter{next: next}
+	c := &PluginContext{
+		Id:                   "schema_test",
+		RecordBatchThreshold: 1,
+		FlightSvc:            w,
+		Metrics:              NewMetrics("schema_test"),
+		Logger:               flblog.New("output:arrow:schema_test", flblog.LevelOff),
+	}
+	if err := c.SetSchema(locSchema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		for _, r := range w.records {
+			r.Release()
+		}
+	})
+	return c, w
+}
+
+func deliverIds(t *testing.T, c *PluginContext, ids ...int) {
+	t.Helper()
+	var entries []convtest.Entry
+	for _, id := range ids {
+		entries = append(entries, convtest.Entry{Time: time.Unix(1700000000, 0), Record: map[string]interface{}{"ID": id, "LOC": fmt.Sprint(id)}})
+	}
+	data, err := convtest.Encode(entries...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Deliver(data, "test"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSchemaChangeAppliedAfterChunk(t *testing.T) {
+	next := arrow.NewSchema(append(locSchema.Fields(), arrow.Field{Name: "VAL", Type: arrow.PrimitiveTypes.Float64, Nullable: true}), nil)
+	c, w := newSchemaContext(t, next)
+	deliverIds(t, c, 1, 2)
+
+	// the rest of the chunk is still built with the old schema
+	if len(w.records) != 1 || !w.records[0].Schema().Equal(locSchema) {
+		t.Fatalf("%d batches written during the chunk, want 1 of the old schema", len(w.records))
+	}
+	if !c.Schema.Equal(next) {
+		t.Fatal("new schema not applied after the chunk")
+	}
+	deliverIds(t, c, 3)
+	if len(w.records) != 2 || !w.records[1].Schema().Equal(next) {
+		t.Fatal("next chunk not built with the new schema")
+	}
+}
+
+func TestSchemaChangeRefused(t *testing.T) {
+	// the new schema lacks the dedup key
+	next := arrow.NewSchema(locSchema.Fields()[:1], nil)
+	c, w := newSchemaContext(t, next)
+	d, err := NewDeduplicator([]string{"LOC"}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Dedup = d
+	deliverIds(t, c, 1)
+	if !c.Schema.Equal(locSchema) {
+		t.Fatal("schema without the dedup key applied")
+	}
+	if err := c.checkSchema(next); err == nil {
+		t.Error("checkSchema accepts a schema without the dedup key")
+	}
+	deliverIds(t, c, 2)
+	if len(w.records) != 1 || !w.records[0].Schema().Equal(locSchema) {
+		t.Fatalf("%d batches written, want 1 of the old schema", len(w.records))
+	}
+}
@@ -0,0 +1,358 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/anaray/fluent-bit-arrow-plugin/internal/flblog"
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/ipc"
+	"github.com/apache/arrow/go/v12/arrow/memory"
+)
+
+// Spool_Overflow values
+const (
+	SpoolDropOldest = "drop_oldest"
+	SpoolDropNewest = "drop_newest"
+	SpoolRetry      = "retry"
+)
+
+// DefaultSpoolRetryInterval is how often a non-empty spool is replayed when
+// no interval has been configured.
+const DefaultSpoolRetryInterval = 10 * time.Second
+
+// ErrSpoolFull is returned by Deliver while the spool is full and its
+// overflow policy is SpoolRetry.
+var ErrSpoolFull = errors.New("spool full")
+
+const (
+	spoolManifest = "manifest.json"
+	spoolExt      = ".arrow"
+)
+
+// SpoolConfig bounds a Spool.
+type SpoolConfig struct {
+	// MaxSize is the number of bytes the spooled files may take, zero means
+	// no limit.
+	MaxSize int64
+	// MaxAge discards batches spooled longer ago, zero keeps them until
+	// they are replayed.
+	MaxAge time.Duration
+	// Overflow decides what gives way when MaxSize is reached, one of the
+	// Spool_Overflow values. Defaults to SpoolDropOldest.
+	Overflow string
+	// Metrics receives the spool size and discarded rows, optional.
+	Metrics *Metrics
+	// Logger is used for discarded batches, optional.
+	Logger *flblog.Logger
+}
+
+// spoolEntry is a spooled batch as listed in the manifest.
+type spoolEntry struct {
+	File    string    `json:"file"`
+	Rows    int64     `json:"rows"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+	// Partition is the path of the partition the batch belongs to.
+	Partition []string `json:"partition,omitempty"`
+}
+
+// manifest is the content of the manifest file, Entries are in the order
+// the batches were spooled.
+type manifest struct {
+	Next    uint64       `json:"next"`
+	Entries []spoolEntry `json:"entries"`
+}
+
+// Spool persists record batches that could not be delivered as Arrow IPC
+// files in a directory. A manifest next to them keeps their order, so that
+// they survive restarts and are replayed in the order they were spooled.
+//
+// A Spool is not safe for concurrent use.
+type Spool struct {
+	Dir    string
+	Config SpoolConfig
+
+	mem  memory.Allocator
+	m    manifest
+	size int64
+}
+
+// OpenSpool opens the spool in dir, creating the directory if needed.
+// Batches listed in an existing manifest are kept, files the manifest does
+// not know about are left overs of an interrupted Put and are removed.
+func OpenSpool(dir string, cfg SpoolConfig, mem memory.Allocator) (*Spool, error) {
+	switch cfg.Overflow {
+	case "":
+		cfg.Overflow = SpoolDropOldest
+	case SpoolDropOldest, SpoolDropNewest, SpoolRetry:
+	default:
+		return nil, fmt.Errorf("unsupported spool overflow policy [%s]", cfg.Overflow)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory %s: %w", dir, err)
+	}
+
+	s := &Spool{Dir: dir, Config: cfg, mem: mem}
+	data, err := os.ReadFile(filepath.Join(dir, spoolManifest))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &s.m); err != nil {
+			return nil, fmt.Errorf("invalid spool manifest in %s: %w", dir, err)
+		}
+	}
+
+	known := make(map[string]bool, len(s.m.Entries))
+	entries := s.m.Entries[:0]
+	for _, e := range s.m.Entries {
+		fi, err := os.Stat(filepath.Join(dir, e.File))
+		if err != nil {
+			s.logWarn("spooled record batch missing", "file", e.File, "rows", e.Rows)
+			continue
+		}
+		e.Size = fi.Size()
+		s.size += e.Size
+		known[e.File] = true
+		entries = append(entries, e)
+	}
+	s.m.Entries = entries
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), spoolExt) && !known[f.Name()] {
+			os.Remove(filepath.Join(dir, f.Name()))
+		}
+	}
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Len returns the number of spooled batches.
+func (s *Spool) Len() int {
+	return len(s.m.Entries)
+}
+
+// Size returns the number of bytes taken by the spooled files.
+func (s *Spool) Size() int64 {
+	return s.size
+}
+
+// Full reports whether MaxSize is set and reached.
+func (s *Spool) Full() bool {
+	return s.Config.MaxSize > 0 && s.size >= s.Config.MaxSize
+}
+
+// Put spools record of the partition at path, nil for an unpartitioned
+// output. When this exceeds MaxSize the oldest batches are discarded with
+// SpoolDropOldest and record itself with SpoolDropNewest.
+// SpoolRetry keeps record, Deliver stops accepting chunks until the spool
+// has drained below MaxSize.
+func (s *Spool) Put(record arrow.Record, path []string) error {
+	s.expire(time.Now())
+
+	e := spoolEntry{
+		File:      fmt.Sprintf("%020d%s", s.m.Next, spoolExt),
+		Rows:      record.NumRows(),
+		Created:   time.Now(),
+		Partition: path,
+	}
+	size, err := s.writeFile(e.File, record)
+	if err != nil {
+		return err
+	}
+	e.Size = size
+
+	if limit := s.Config.MaxSize; limit > 0 && s.size+e.Size > limit {
+		switch s.Config.Overflow {
+		case SpoolDropNewest:
+			s.discard(e, "spool full")
+			return nil
+		case SpoolDropOldest:
+			for len(s.m.Entries) > 0 && s.size+e.Size > limit {
+				s.discard(s.m.Entries[0], "spool full")
+				s.size -= s.m.Entries[0].Size
+				s.m.Entries = s.m.Entries[1:]
+			}
+		}
+	}
+
+	s.m.Next++
+	s.m.Entries = append(s.m.Entries, e)
+	s.size += e.Size
+	if err := s.save(); err != nil {
+		s.m.Entries = s.m.Entries[:len(s.m.Entries)-1]
+		s.size -= e.Size
+		os.Remove(filepath.Join(s.Dir, e.File))
+		return err
+	}
+	return nil
+}
+
+// Replay hands the spooled batches and the paths of their partitions to
+// write in the order they were spooled until write fails. The batches
+// written are then confirmed with commit and removed from the spool if it
+// succeeds. The error of write or commit is returned.
+func (s *Spool) Replay(write func(arrow.Record, []string) error, commit func() error) error {
+	s.expire(time.Now())
+
+	var err error
+	written := make(map[string]bool)
+	discarded := make(map[string]bool)
+	for _, e := range s.m.Entries {
+		record, rerr := s.readFile(e.File)
+		if rerr != nil {
+			// an unreadable file would block the spool for good
+			s.discard(e, rerr.Error())
+			discarded[e.File] = true
+			continue
+		}
+		err = write(record, e.Partition)
+		record.Release()
+		if err != nil {
+			break
+		}
+		written[e.File] = true
+	}
+	if len(written) > 0 {
+		if cerr := commit(); cerr != nil {
+			// kept and resent with the next replay
+			err = cerr
+			written = nil
+		}
+	}
+	if len(written) == 0 && len(discarded) == 0 {
+		return err
+	}
+
+	entries := s.m.Entries[:0]
+	for _, e := range s.m.Entries {
+		if !written[e.File] && !discarded[e.File] {
+			entries = append(entries, e)
+			continue
+		}
+		os.Remove(filepath.Join(s.Dir, e.File))
+		s.size -= e.Size
+	}
+	s.m.Entries = entries
+	if serr := s.save(); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// expire discards the batches spooled more than MaxAge before now.
+func (s *Spool) expire(now time.Time) {
+	if s.Config.MaxAge <= 0 {
+		return
+	}
+	var n int
+	for _, e := range s.m.Entries {
+		if now.Sub(e.Created) <= s.Config.MaxAge {
+			break
+		}
+		s.discard(e, "spooled longer than max age")
+		s.size -= e.Size
+		n++
+	}
+	if n > 0 {
+		s.m.Entries = s.m.Entries[n:]
+		s.save()
+	}
+}
+
+// discard removes the file of e and counts its rows as dropped. Callers
+// remove e from the manifest and from the spool size.
+func (s *Spool) discard(e spoolEntry, reason string) {
+	os.Remove(filepath.Join(s.Dir, e.File))
+	s.logWarn("spooled record batch discarded", "file", e.File, "rows", e.Rows, "reason", reason)
+	if m := s.Config.Metrics; m != nil {
+		m.RecordsDropped.Add(float64(e.Rows))
+	}
+}
+
+// save writes the manifest and updates the spool metrics.
+func (s *Spool) save() error {
+	if m := s.Config.Metrics; m != nil {
+		m.SpoolBatches.Set(float64(len(s.m.Entries)))
+		m.SpoolBytes.Set(float64(s.size))
+	}
+	data, err := json.MarshalIndent(&s.m, "", "    ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.Dir, spoolManifest), data)
+}
+
+// writeFile stores record as an Arrow IPC file and returns its size.
+func (s *Spool) writeFile(name string, record arrow.Record) (int64, error) {
+	f, err := os.Create(filepath.Join(s.Dir, name))
+	if err != nil {
+		return 0, err
+	}
+	w, err := ipc.NewFileWriter(f, ipc.WithSchema(record.Schema()), ipc.WithAllocator(s.mem))
+	if err == nil {
+		err = w.Write(record)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	var size int64
+	if err == nil {
+		var fi os.FileInfo
+		if fi, err = f.Stat(); err == nil {
+			size = fi.Size()
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return 0, fmt.Errorf("failed to spool record batch: %w", err)
+	}
+	return size, nil
+}
+
+// readFile reads back the record stored by writeFile.
+func (s *Spool) readFile(name string) (arrow.Record, error) {
+	f, err := os.Open(filepath.Join(s.Dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := ipc.NewFileReader(f, ipc.WithAllocator(s.mem))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	defer r.Close()
+	if r.NumRecords() != 1 {
+		return nil, fmt.Errorf("%s: expected 1 record batch, found %d", name, r.NumRecords())
+	}
+	record, err := r.RecordAt(0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return record, nil
+}
+
+func (s *Spool) logWarn(msg string, kv ...interface{}) {
+	if l := s.Config.Logger; l != nil {
+		l.Warn(msg, kv...)
+	}
+}
@@ -0,0 +1,201 @@
+package plugin
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+	"github.com/apache/arrow/go/v12/arrow/memory"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var valueSchema = arrow.NewSchema([]arrow.Field{{Name: "N", Type: arrow.PrimitiveTypes.Int64}}, nil)
+
+// valueRecord returns a record of one row holding n.
+func valueRecord(mem memory.Allocator, n int64) arrow.Record {
+	b := array.NewRecordBuilder(mem, valueSchema)
+	defer b.Release()
+	b.Field(0).(*array.Int64Builder).Append(n)
+	return b.NewRecord()
+}
+
+// putValues spools a record for each of values.
+func putValues(t *testing.T, s *Spool, mem memory.Allocator, path []string, values ...int64) {
+	t.Helper()
+	for _, n := range values {
+		r := valueRecord(mem, n)
+		err := s.Put(r, path)
+		r.Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// replayValues replays s, failing the write of the batch holding failAt,
+// and returns the values written and the error of Replay.
+func replayValues(s *Spool, failAt int64) ([]int64, error) {
+	var got []int64
+	err := s.Replay(func(r arrow.Record, _ []string) error {
+		n := r.Column(0).(*array.Int64).Value(0)
+		if n == failAt {
+			return errors.New("write failed")
+		}
+		got = append(got, n)
+		return nil
+	}, func() error { return nil })
+	return got, err
+}
+
+func openTestSpool(t *testing.T, dir string, cfg SpoolConfig) (*Spool, *memory.CheckedAllocator) {
+	t.Helper()
+	mem := memory.NewCheckedAllocator(memory.NewGoAllocator())
+	t.Cleanup(func() { mem.AssertSize(t, 0) })
+	s, err := OpenSpool(dir, cfg, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, mem
+}
+
+func TestSpoolReplayOrder(t *testing.T) {
+	s, mem := openTestSpool(t, t.TempDir(), SpoolConfig{})
+	putValues(t, s, mem, nil, 1, 2, 3, 4)
+
+	got, err := replayValues(s, 3)
+	if err == nil {
+		t.Fatal("Replay did not return the error of write")
+	}
+	if !reflect.DeepEqual(got, []int64{1, 2}) || s.Len() != 2 {
+		t.Fatalf("replayed %v and kept %d batches, want [1 2] and 2", got, s.Len())
+	}
+
+	got, err = replayValues(s, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, []int64{3, 4}) || s.Len() != 0 || s.Size() != 0 {
+		t.Fatalf("replayed %v, %d batches of %d bytes left, want [3 4] and an empty spool", got, s.Len(), s.Size())
+	}
+	files, _ := os.ReadDir(s.Dir)
+	if len(files) != 1 || files[0].Name() != spoolManifest {
+		t.Fatalf("spool directory holds %d files after replay, want only the manifest", len(files))
+	}
+}
+
+func TestSpoolReplayCommitFails(t *testing.T) {
+	s, mem := openTestSpool(t, t.TempDir(), SpoolConfig{})
+	putValues(t, s, mem, nil, 1, 2)
+	err := s.Replay(func(arrow.Record, []string) error { return nil }, func() error { return errors.New("not acknowledged") })
+	if err == nil || s.Len() != 2 {
+		t.Fatalf("Replay with a failing commit returned %v and kept %d batches, want an error and 2", err, s.Len())
+	}
+	if got, _ := replayValues(s, -1); !reflect.DeepEqual(got, []int64{1, 2}) {
+		t.Fatalf("replayed %v after the failed commit, want [1 2]", got)
+	}
+}
+
+func TestSpoolOverflow(t *testing.T) {
+	// the size of the file of one batch
+	probe, mem := openTestSpool(t, t.TempDir(), SpoolConfig{})
+	putValues(t, probe, mem, nil, 0)
+	one := probe.Size()
+	if _, err := replayValues(probe, -1); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		overflow string
+		want     []int64
+		full     bool
+	}{
+		{SpoolDropOldest, []int64{2, 3}, false},
+		{SpoolDropNewest, []int64{1, 2}, false},
+		{SpoolRetry, []int64{1, 2, 3}, true},
+	} {
+		t.Run(tc.overflow, func(t *testing.T) {
+			s, mem := openTestSpool(t, t.TempDir(), SpoolConfig{MaxSize: 2*one + one/2, Overflow: tc.overflow})
+			putValues(t, s, mem, nil, 1, 2, 3)
+			if s.Full() != tc.full {
+				t.Errorf("Full() is %v, want %v", s.Full(), tc.full)
+			}
+			got, err := replayValues(s, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("replayed %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSpoolRestart(t *testing.T) {
+	dir := t.TempDir()
+	s, mem := openTestSpool(t, dir, SpoolConfig{})
+	putValues(t, s, mem, []string{"site", "a"}, 1, 2)
+	putValues(t, s, mem, nil, 3)
+	// a file written by a Put that was interrupted before the manifest
+	stray := filepath.Join(dir, "99999999999999999999"+spoolExt)
+	if err := os.WriteFile(stray, []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, _ = openTestSpool(t, dir, SpoolConfig{})
+	if s.Len() != 3 {
+		t.Fatalf("reopened spool has %d batches, want 3", s.Len())
+	}
+	if _, err := os.Stat(stray); !os.IsNotExist(err) {
+		t.Error("file unknown to the manifest not removed")
+	}
+	var got []int64
+	var paths [][]string
+	err := s.Replay(func(r arrow.Record, path []string) error {
+		got = append(got, r.Column(0).(*array.Int64).Value(0))
+		paths = append(paths, path)
+		return nil
+	}, func() error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, []int64{1, 2, 3}) {
+		t.Errorf("replayed %v after the restart, want [1 2 3]", got)
+	}
+	if !reflect.DeepEqual(paths, [][]string{{"site", "a"}, {"site", "a"}, nil}) {
+		t.Errorf("replayed partitions %v", paths)
+	}
+
+	// batches put after the restart follow the replayed ones
+	putValues(t, s, mem, nil, 4)
+	s, _ = openTestSpool(t, dir, SpoolConfig{})
+	if got, _ := replayValues(s, -1); !reflect.DeepEqual(got, []int64{4}) {
+		t.Errorf("replayed %v, want [4]", got)
+	}
+}
+
+func TestSpoolReplaySchemaChanged(t *testing.T) {
+	dir := t.TempDir()
+	s, mem := openTestSpool(t, dir, SpoolConfig{})
+	putValues(t, s, mem, nil, 1, 2)
+
+	// the plugin restarts with another Schema_File
+	s, _ = openTestSpool(t, dir, SpoolConfig{})
+	c, w := newSchemaContext(t, nil)
+	c.Spool = s
+	dropped := testutil.ToFloat64(c.Metrics.RecordsDropped)
+	deliverIds(t, c, 3)
+
+	if s.Len() != 0 {
+		t.Fatalf("%d batches left in the spool, want none", s.Len())
+	}
+	if len(w.records) != 1 || !w.records[0].Schema().Equal(locSchema) {
+		t.Fatalf("%d batches written, want the one of the chunk", len(w.records))
+	}
+	if got := testutil.ToFloat64(c.Metrics.RecordsDropped) - dropped; got != 2 {
+		t.Errorf("%v records dropped, want 2", got)
+	}
+}
@@ -0,0 +1,61 @@
+package plugin
+
+import (
+	"fmt"
+	"sort"
+
+	arrowschema "github.com/anaray/fluent-bit-arrow-plugin/internal/arrow"
+	"github.com/anaray/fluent-bit-arrow-plugin/pkg/convert"
+	"github.com/apache/arrow/go/v12/arrow"
+)
+
+// ValidateSchema checks that every column of schema can be filled by the
+// converter and that every Time_Fields entry names a timestamp column. doc
+// is used to attach line numbers to the issues and may be nil.
+func ValidateSchema(schema *arrow.Schema, timeFields map[string]string, doc *arrowschema.Document) []arrowschema.Issue {
+	var issues []arrowschema.Issue
+	add := func(field string, format string, args ...interface{}) {
+		issues = append(issues, arrowschema.Issue{
+			Line:  doc.Line(field),
+			Field: field,
+			Msg:   fmt.Sprintf(format, args...),
+		})
+	}
+
+	if schema == nil {
+		return issues
+	}
+	seen := make(map[string]bool, len(schema.Fields()))
+	for _, f := range schema.Fields() {
+		if seen[f.Name] {
+			add(f.Name, "duplicate field name")
+			continue
+		}
+		seen[f.Name] = true
+
+		_, isTime := timeFields[f.Name]
+		switch {
+		case !convert.SupportedType(f.Type):
+			add(f.Name, "type %s is not supported by the write path", f.Type)
+		case f.Type.ID() != arrow.TIMESTAMP && isTime:
+			add(f.Name, "listed in Time_Fields but has type %s, expected timestamp", f.Type)
+		}
+		if f.Type.ID() == arrow.NULL && !f.Nullable {
+			add(f.Name, "column of type null must be nullable")
+		}
+	}
+
+	// Time_Fields naming columns missing from the schema, sorted for a
+	// stable report
+	var missing []string
+	for name := range timeFields {
+		if !seen[name] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	for _, name := range missing {
+		add(name, "listed in Time_Fields but not present in the schema")
+	}
+	return issues
+}